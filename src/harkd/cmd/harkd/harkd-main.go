@@ -32,7 +32,7 @@ func main() {
 		fail(err)
 	}
 
-	contextFactory, err := context.HomeDirFactory()
+	contextFactory, err := context.HomeDirFactory(serverCfg.ContextConfig())
 	if err != nil {
 		fail(err)
 	}
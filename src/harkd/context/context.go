@@ -2,19 +2,26 @@ package context
 
 import (
 	"harkd/dal"
+	"harkd/events"
 )
 
 // Context is an interface that can provide a context for interacting with hark
 // state and the hark VM runtime.
 type Context interface {
 	GetDal() dal.Dal
+	GetEventBus() events.Bus
 }
 
 type dirContext struct {
-	dir string
-	dal dal.Dal
+	dir    string
+	dal    dal.Dal
+	events events.Bus
 }
 
 func (d dirContext) GetDal() dal.Dal {
 	return d.dal
 }
+
+func (d dirContext) GetEventBus() events.Bus {
+	return d.events
+}
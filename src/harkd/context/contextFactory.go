@@ -3,24 +3,54 @@ package context
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"harkd/dal"
+	"harkd/errors"
+	"harkd/events"
 	"harkd/util"
 )
 
 const dalFileName = "hark-state.json"
+const journalBaseName = "hark-state"
 const dirFileMode = 0700
 
+// The backends which can store hark's state.
+const (
+	// StateBackendJSON keeps the state in a single JSON file, which is
+	// rewritten on every change.
+	StateBackendJSON = "json"
+
+	// StateBackendJournal keeps the state in memory, appending changes to a
+	// journal which is periodically compacted into a snapshot.
+	StateBackendJournal = "journal"
+)
+
 // Factory is an interface that can provide a hark Context.
 type Factory interface {
 	GetContext() Context
 }
 
+// Config configures how a Factory stores hark's state.
+type Config struct {
+	// StateBackend is the backend which stores the state: one of the
+	// StateBackend constants. It defaults to StateBackendJSON.
+	StateBackend string
+
+	// StateBackups is the number of backup generations kept of the state
+	// file.
+	StateBackups int
+
+	// StateLockTimeout is how long to wait for the state lock before giving
+	// up. Zero means util.DefaultLockTimeout.
+	StateLockTimeout time.Duration
+}
+
 // HomeDirFactory returns a Factory providing a Context
 // based on the home directory of the current user.
 //
 // This is the most simple form of storage available.
-func HomeDirFactory() (Factory, error) {
+func HomeDirFactory(config Config) (Factory, error) {
 	homeDir, err := util.GetUserHomeDir()
 	if err != nil {
 		return nil, err
@@ -37,12 +67,26 @@ func HomeDirFactory() (Factory, error) {
 	// The dal is kept in the state of the factory - rather than instantiated on
 	// demand when creating a Context - so that its locking facilities can be
 	// shared across the app.
-	d, err := dal.NewJSONFileDal(dalFilePath(dir))
+	d, err := openDal(dir, config)
 	if err != nil {
 		return nil, err
 	}
 
-	return dirFactory{homeDir, d}, nil
+	// The event bus is shared for the same reason: every publisher and
+	// subscriber must see the same bus.
+	bus := events.NewBus(events.DefaultBufferSize)
+
+	return dirFactory{homeDir, d, bus}, nil
+}
+
+func openDal(dir string, config Config) (dal.Dal, error) {
+	switch config.StateBackend {
+	case "", StateBackendJSON:
+		return dal.OpenJSONFileDal(dalFilePath(dir), config.StateBackups, config.StateLockTimeout)
+	case StateBackendJournal:
+		return dal.OpenJournalDal(filepath.Join(dir, journalBaseName), config.StateLockTimeout)
+	}
+	return nil, errors.ErrUnknownStateBackend(config.StateBackend)
 }
 
 func initializeHarkDir(path string) error {
@@ -61,8 +105,9 @@ func harkDir(parent string) string {
 }
 
 type dirFactory struct {
-	dir string
-	dal dal.Dal
+	dir    string
+	dal    dal.Dal
+	events events.Bus
 }
 
 func dalFilePath(contextDir string) string {
@@ -70,5 +115,5 @@ func dalFilePath(contextDir string) string {
 }
 
 func (d dirFactory) GetContext() Context {
-	return dirContext{d.dir, d.dal}
+	return dirContext{d.dir, d.dal, d.events}
 }
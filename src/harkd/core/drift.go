@@ -0,0 +1,92 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DriftReport describes how the machines in hark's state differ from the VMs
+// which actually exist in their drivers' backends.
+type DriftReport struct {
+	CheckedAt time.Time `json:"checkedAt"`
+
+	// Missing lists the IDs of machines in the state whose VM does not exist.
+	Missing []string `json:"missing"`
+
+	// Orphaned lists VMs which look like they were created by hark, but which
+	// have no machine in the state.
+	Orphaned []OrphanedVM `json:"orphaned"`
+
+	// Mismatched lists the ways existing VMs are configured differently to
+	// their machines.
+	Mismatched []ConfigMismatch `json:"mismatched"`
+
+	// Errors lists anything which could not be checked, e.g. because a
+	// driver's backend is not installed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// OrphanedVM is a VM owned by hark which has no machine in the state.
+type OrphanedVM struct {
+	Driver    string `json:"driver"`
+	MachineID string `json:"machineID"`
+}
+
+// ConfigMismatch is a single setting on which a VM differs from its machine.
+type ConfigMismatch struct {
+	MachineID string      `json:"machineID"`
+	Field     string      `json:"field"`
+	Expected  interface{} `json:"expected"`
+	Actual    interface{} `json:"actual"`
+}
+
+// HasDrift reports whether any drift was found.
+func (r DriftReport) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Orphaned) > 0 || len(r.Mismatched) > 0
+}
+
+// Summary describes the drift found in a single line.
+func (r DriftReport) Summary() string {
+	return fmt.Sprintf("%d missing, %d orphaned and %d mismatched machines",
+		len(r.Missing), len(r.Orphaned), len(r.Mismatched))
+}
+
+// FindMissingAndOrphaned compares the machines owned by a driver with the IDs
+// of the machines the driver has VMs for. It returns the IDs of machines with
+// no VM, and of VMs with no machine, both sorted.
+func FindMissingAndOrphaned(machines []Machine, vmIDs []string) (missing []string, orphaned []string) {
+	known := make(map[string]bool, len(machines))
+	for _, m := range machines {
+		known[m.ID] = true
+	}
+	exists := make(map[string]bool, len(vmIDs))
+	for _, id := range vmIDs {
+		exists[id] = true
+	}
+
+	for _, m := range machines {
+		if !exists[m.ID] {
+			missing = append(missing, m.ID)
+		}
+	}
+	for id := range exists {
+		if !known[id] {
+			orphaned = append(orphaned, id)
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(orphaned)
+	return missing, orphaned
+}
+
+// CompareHardware reports the ways a VM's live configuration differs from the
+// hardware configured on its machine.
+func CompareHardware(m Machine, info RuntimeInfo) []ConfigMismatch {
+	var mismatches []ConfigMismatch
+	if info.MemoryMB != m.MemoryMB {
+		mismatches = append(mismatches, ConfigMismatch{m.ID, "memoryMB", m.MemoryMB, info.MemoryMB})
+	}
+	return mismatches
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var findMissingAndOrphanedTests = []struct {
+	name           string
+	machines       []Machine
+	vmIDs          []string
+	expectMissing  []string
+	expectOrphaned []string
+}{
+	{"nothing", nil, nil, nil, nil},
+	{"in sync", []Machine{{ID: "a"}, {ID: "b"}}, []string{"b", "a"}, nil, nil},
+	{"missing", []Machine{{ID: "c"}, {ID: "a"}, {ID: "b"}}, []string{"b"}, []string{"a", "c"}, nil},
+	{"orphaned", []Machine{{ID: "a"}}, []string{"c", "a", "b"}, nil, []string{"b", "c"}},
+	{"both", []Machine{{ID: "a"}, {ID: "b"}}, []string{"b", "c"}, []string{"a"}, []string{"c"}},
+}
+
+func TestFindMissingAndOrphaned(t *testing.T) {
+	for _, c := range findMissingAndOrphanedTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			missing, orphaned := FindMissingAndOrphaned(c.machines, c.vmIDs)
+			require.Equal(t, c.expectMissing, missing)
+			require.Equal(t, c.expectOrphaned, orphaned)
+		})
+	}
+}
+
+var compareHardwareTests = []struct {
+	name   string
+	info   RuntimeInfo
+	expect []ConfigMismatch
+}{
+	{"same", RuntimeInfo{State: StateRunning, MemoryMB: 512}, nil},
+	{"memory", RuntimeInfo{State: StateRunning, MemoryMB: 1024}, []ConfigMismatch{{"foo", "memoryMB", uint(512), uint(1024)}}},
+}
+
+func TestCompareHardware(t *testing.T) {
+	m := Machine{ID: "foo", Name: "Foo", MemoryMB: 512}
+	for _, c := range compareHardwareTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expect, CompareHardware(m, c.info))
+		})
+	}
+}
+
+func TestDriftReportHasDrift(t *testing.T) {
+	require.False(t, DriftReport{Errors: []string{"virtualbox: not installed"}}.HasDrift())
+	require.True(t, DriftReport{Missing: []string{"foo"}}.HasDrift())
+	require.True(t, DriftReport{Orphaned: []OrphanedVM{{"virtualbox", "foo"}}}.HasDrift())
+	require.True(t, DriftReport{Mismatched: []ConfigMismatch{{MachineID: "foo"}}}.HasDrift())
+}
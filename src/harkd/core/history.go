@@ -0,0 +1,61 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// MachineVersion is a machine's definition as it was saved at one revision.
+type MachineVersion struct {
+	Revision uint64    `json:"revision"`
+	SavedAt  time.Time `json:"savedAt"`
+	Machine  Machine   `json:"machine"`
+
+	// Changes lists how this version differs from the one it replaced. The
+	// first version of a machine has no changes.
+	Changes []FieldChange `json:"changes"`
+}
+
+// FieldChange is a single field which differs between two versions of a
+// machine.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// DiffMachines lists the fields which differ between two versions of a
+// machine, sorted by their JSON names. The revision is not compared, since it
+// differs between every pair of versions.
+func DiffMachines(before, after Machine) []FieldChange {
+	from, to := machineFields(before), machineFields(after)
+
+	var fields []string
+	for field := range to {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if field == "revision" || reflect.DeepEqual(from[field], to[field]) {
+			continue
+		}
+		changes = append(changes, FieldChange{field, from[field], to[field]})
+	}
+	return changes
+}
+
+// machineFields gives a machine's fields by their JSON names, so that new
+// fields are compared without having to be listed.
+func machineFields(m Machine) map[string]interface{} {
+	fields := make(map[string]interface{})
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(b, &fields)
+	return fields
+}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var diffMachinesTests = []struct {
+	name          string
+	before        Machine
+	after         Machine
+	expectChanges []FieldChange
+}{
+	{"no changes", Machine{ID: "foo", Name: "Foo"}, Machine{ID: "foo", Name: "Foo"}, []FieldChange{}},
+	{"only the revision changes", Machine{ID: "foo", Revision: 1}, Machine{ID: "foo", Revision: 2}, []FieldChange{}},
+	{"one change", Machine{ID: "foo", MemoryMB: 512}, Machine{ID: "foo", MemoryMB: 1024}, []FieldChange{{"memoryMB", 512.0, 1024.0}}},
+	{"several changes, sorted by field", Machine{ID: "foo", Name: "Foo", MemoryMB: 512}, Machine{ID: "foo", Name: "Bar", MemoryMB: 1024}, []FieldChange{{"memoryMB", 512.0, 1024.0}, {"name", "Foo", "Bar"}}},
+}
+
+func TestDiffMachines(t *testing.T) {
+	for _, c := range diffMachinesTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expectChanges, DiffMachines(c.before, c.after))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+
+	"harkd/errors"
+)
+
+// ImportMode says how imported machines are combined with the existing ones.
+type ImportMode string
+
+const (
+	// ImportMerge adds the imported machines to the existing ones. An
+	// existing machine is never changed: if an imported machine has the same
+	// ID but a different definition, it is reported as a conflict.
+	ImportMerge ImportMode = "merge"
+
+	// ImportReplace makes the imported machines the only ones. Existing
+	// machines are updated to match the import, or deleted if the import does
+	// not have them.
+	ImportReplace ImportMode = "replace"
+)
+
+// ParseImportMode parses an import mode, which is merge if it is empty.
+func ParseImportMode(mode string) (ImportMode, error) {
+	switch ImportMode(mode) {
+	case "", ImportMerge:
+		return ImportMerge, nil
+	case ImportReplace:
+		return ImportReplace, nil
+	}
+	return "", errors.ErrInvalidQueryParam("mode", mode)
+}
+
+// ImportReport describes the changes an import makes, by machine ID.
+type ImportReport struct {
+	Mode   ImportMode `json:"mode"`
+	DryRun bool       `json:"dryRun"`
+
+	Created   []string         `json:"created"`
+	Updated   []string         `json:"updated"`
+	Deleted   []string         `json:"deleted"`
+	Unchanged []string         `json:"unchanged"`
+	Conflicts []ImportConflict `json:"conflicts"`
+}
+
+// ImportConflict is an imported machine which was not imported because an
+// existing machine has the same ID.
+type ImportConflict struct {
+	MachineID string        `json:"machineID"`
+	Changes   []FieldChange `json:"changes"`
+}
+
+// PlanImport works out the changes needed to import machines. The imported
+// machines must be valid, with no two sharing an ID.
+func PlanImport(existing, imported []Machine, mode ImportMode) (ImportReport, error) {
+	report := ImportReport{
+		Mode:      mode,
+		Created:   []string{},
+		Updated:   []string{},
+		Deleted:   []string{},
+		Unchanged: []string{},
+		Conflicts: []ImportConflict{},
+	}
+
+	ids := make(map[string]bool, len(imported))
+	for _, m := range imported {
+		if err := m.Validate(); err != nil {
+			return report, err
+		}
+		if ids[m.ID] {
+			return report, errors.ErrEntityInvalid(fmt.Sprintf("import has more than one machine with id %q", m.ID))
+		}
+		ids[m.ID] = true
+	}
+
+	current := make(map[string]Machine, len(existing))
+	for _, m := range existing {
+		current[m.ID] = m
+		if !ids[m.ID] && mode == ImportReplace {
+			report.Deleted = append(report.Deleted, m.ID)
+		}
+	}
+
+	for _, m := range imported {
+		c, ok := current[m.ID]
+		if !ok {
+			report.Created = append(report.Created, m.ID)
+			continue
+		}
+
+		changes := DiffMachines(c, m)
+		switch {
+		case len(changes) == 0:
+			report.Unchanged = append(report.Unchanged, m.ID)
+		case mode == ImportReplace:
+			report.Updated = append(report.Updated, m.ID)
+		default:
+			report.Conflicts = append(report.Conflicts, ImportConflict{m.ID, changes})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func importMachine(id string, memoryMB uint) Machine {
+	return Machine{ID: id, Name: id, MemoryMB: memoryMB, Driver: "virtualbox"}
+}
+
+var planImportTests = []struct {
+	name           string
+	existing       []Machine
+	imported       []Machine
+	mode           ImportMode
+	expectCreated  []string
+	expectUpdated  []string
+	expectDeleted  []string
+	expectConflict []string
+	valid          bool
+}{
+	{"merge into nothing", nil, []Machine{importMachine("a", 512)}, ImportMerge, []string{"a"}, []string{}, []string{}, []string{}, true},
+	{"merge alongside others", []Machine{importMachine("a", 512)}, []Machine{importMachine("b", 512)}, ImportMerge, []string{"b"}, []string{}, []string{}, []string{}, true},
+	{"merge conflict", []Machine{importMachine("a", 512)}, []Machine{importMachine("a", 1024)}, ImportMerge, []string{}, []string{}, []string{}, []string{"a"}, true},
+	{"merge identical machine", []Machine{importMachine("a", 512)}, []Machine{importMachine("a", 512)}, ImportMerge, []string{}, []string{}, []string{}, []string{}, true},
+	{"replace", []Machine{importMachine("a", 512), importMachine("b", 512)}, []Machine{importMachine("b", 1024), importMachine("c", 512)}, ImportReplace, []string{"c"}, []string{"b"}, []string{"a"}, []string{}, true},
+	{"invalid machine", nil, []Machine{{ID: "a"}}, ImportMerge, nil, nil, nil, nil, false},
+	{"duplicate machine", nil, []Machine{importMachine("a", 512), importMachine("a", 512)}, ImportMerge, nil, nil, nil, nil, false},
+}
+
+func TestPlanImport(t *testing.T) {
+	for _, c := range planImportTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			report, err := PlanImport(c.existing, c.imported, c.mode)
+
+			// Assert
+			if !c.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expectCreated, report.Created)
+			require.Equal(t, c.expectUpdated, report.Updated)
+			require.Equal(t, c.expectDeleted, report.Deleted)
+
+			conflicts := []string{}
+			for _, conflict := range report.Conflicts {
+				conflicts = append(conflicts, conflict.MachineID)
+			}
+			require.Equal(t, c.expectConflict, conflicts)
+		})
+	}
+}
+
+func TestParseImportMode(t *testing.T) {
+	mode, err := ParseImportMode("")
+	require.NoError(t, err)
+	require.Equal(t, ImportMerge, mode)
+
+	mode, err = ParseImportMode("replace")
+	require.NoError(t, err)
+	require.Equal(t, ImportReplace, mode)
+
+	_, err = ParseImportMode("overwrite")
+	require.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"harkd/errors"
+)
+
+// Action is a power action which can be taken on a machine.
+type Action string
+
+// The power actions which can be taken on a machine.
+const (
+	ActionStart   Action = "start"
+	ActionStop    Action = "stop"
+	ActionRestart Action = "restart"
+	ActionPause   Action = "pause"
+	ActionResume  Action = "resume"
+	ActionSave    Action = "save"
+)
+
+type transition struct {
+	from []MachineState
+	to   MachineState
+}
+
+// transitions is the lifecycle state machine: for each action, the states a
+// machine may be in for the action to be taken, and the state it leads to.
+var transitions = map[Action]transition{
+	ActionStart:   {[]MachineState{StatePoweroff, StateSaved, StateAborted}, StateRunning},
+	ActionStop:    {[]MachineState{StateRunning, StatePaused}, StatePoweroff},
+	ActionRestart: {[]MachineState{StateRunning}, StateRunning},
+	ActionPause:   {[]MachineState{StateRunning}, StatePaused},
+	ActionResume:  {[]MachineState{StatePaused}, StateRunning},
+	ActionSave:    {[]MachineState{StateRunning, StatePaused}, StateSaved},
+}
+
+// Transition checks that an action can be taken on a machine in the given
+// state, and returns the state the machine will be in once it has been.
+func Transition(from MachineState, action Action) (MachineState, error) {
+	t, ok := transitions[action]
+	if !ok {
+		return from, errors.ErrIllegalTransition(string(action), string(from))
+	}
+
+	for _, s := range t.from {
+		if s == from {
+			return t.to, nil
+		}
+	}
+	return from, errors.ErrIllegalTransition(string(action), string(from))
+}
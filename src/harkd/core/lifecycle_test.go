@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var transitionTests = []struct {
+	from   MachineState
+	action Action
+	to     MachineState
+	valid  bool
+}{
+	{StatePoweroff, ActionStart, StateRunning, true},
+	{StateSaved, ActionStart, StateRunning, true},
+	{StateAborted, ActionStart, StateRunning, true},
+	{StateRunning, ActionStart, StateRunning, false},
+	{StateRunning, ActionStop, StatePoweroff, true},
+	{StatePaused, ActionStop, StatePoweroff, true},
+	{StatePoweroff, ActionStop, StatePoweroff, false},
+	{StateRunning, ActionRestart, StateRunning, true},
+	{StatePaused, ActionRestart, StatePaused, false},
+	{StateRunning, ActionPause, StatePaused, true},
+	{StatePoweroff, ActionPause, StatePoweroff, false},
+	{StatePaused, ActionResume, StateRunning, true},
+	{StateRunning, ActionResume, StateRunning, false},
+	{StateRunning, ActionSave, StateSaved, true},
+	{StatePaused, ActionSave, StateSaved, true},
+	{StateSaved, ActionSave, StateSaved, false},
+	{StateUnknown, ActionStart, StateUnknown, false},
+	{StateStarting, ActionStop, StateStarting, false},
+	{StateRunning, Action("explode"), StateRunning, false},
+}
+
+func TestTransition(t *testing.T) {
+	for _, c := range transitionTests {
+		c := c
+		t.Run(string(c.action)+" from "+string(c.from), func(t *testing.T) {
+			to, err := Transition(c.from, c.action)
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.Equal(t, c.to, to)
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"harkd/errors"
+)
+
+// MachineQuery selects, orders and pages a list of machines. Its zero value
+// lists every machine, in the order they were created.
+type MachineQuery struct {
+	// Name, Driver and State select only the machines which have them, if
+	// they are set.
+	Name   string
+	Driver string
+	State  MachineState
+
+	Sort MachineSort
+
+	// Limit is the most machines in a page, or 0 for no limit.
+	Limit int
+
+	// Cursor is where the page starts, as given by the previous page's
+	// NextCursor. An empty cursor starts at the first machine.
+	Cursor string
+}
+
+// MachinePage is one page of a list of machines.
+type MachinePage struct {
+	Machines []Machine
+
+	// Total is the number of machines the query selects, across all pages.
+	Total int
+
+	// NextCursor is the cursor of the next page, or empty if this is the
+	// last.
+	NextCursor string
+}
+
+// MachineSort is the order in which machines are listed. Machines which are
+// equal in the sorted field are listed by ID. The zero MachineSort lists
+// machines in the order they were created.
+type MachineSort struct {
+	Field      string
+	Descending bool
+}
+
+// machineSortFields compare machines by each of the fields they can be sorted
+// by, by their JSON names.
+var machineSortFields = map[string]func(a, b Machine) int{
+	"id":     func(a, b Machine) int { return strings.Compare(a.ID, b.ID) },
+	"name":   func(a, b Machine) int { return strings.Compare(a.Name, b.Name) },
+	"driver": func(a, b Machine) int { return strings.Compare(a.Driver, b.Driver) },
+	"memoryMB": func(a, b Machine) int {
+		switch {
+		case a.MemoryMB < b.MemoryMB:
+			return -1
+		case a.MemoryMB > b.MemoryMB:
+			return 1
+		}
+		return 0
+	},
+}
+
+// ParseMachineSort parses a sort order such as "name" or "-memoryMB", where a
+// leading "-" sorts in descending order. An empty order is the order the
+// machines were created in.
+func ParseMachineSort(s string) (MachineSort, error) {
+	if s == "" {
+		return MachineSort{}, nil
+	}
+
+	ms := MachineSort{Field: strings.TrimPrefix(s, "-"), Descending: strings.HasPrefix(s, "-")}
+	if _, ok := machineSortFields[ms.Field]; !ok {
+		return MachineSort{}, errors.ErrInvalidQueryParam("sort", s)
+	}
+	return ms, nil
+}
+
+func (s MachineSort) String() string {
+	if s.Descending {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// compare orders two machines, with ties broken by ID.
+func (s MachineSort) compare(a, b Machine) int {
+	c := machineSortFields[s.Field](a, b)
+	if s.Descending {
+		c = -c
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	return c
+}
+
+// machineCursor is the content of a cursor: the order a page was in, and
+// where in that order its last machine was. The next page starts with the
+// first machine after it in that order, so that machines being added or
+// removed does not make a page skip or repeat any.
+type machineCursor struct {
+	Sort string `json:"sort"`
+
+	// Key is the last machine's value of the sorted field, and ID its ID.
+	Key json.RawMessage `json:"key,omitempty"`
+	ID  string          `json:"id"`
+
+	// Index is the position of the last machine, for pages in the order
+	// machines were created in. It is only used if the machine has since
+	// been deleted.
+	Index int `json:"index,omitempty"`
+}
+
+// encodeMachineCursor encodes a cursor for a page ending with the i'th of the
+// selected machines.
+func encodeMachineCursor(ms MachineSort, selected []Machine, i int) string {
+	c := machineCursor{Sort: ms.String(), ID: selected[i].ID}
+	if ms.Field == "" {
+		c.Index = i
+	} else {
+		var fields map[string]json.RawMessage
+		b, _ := json.Marshal(selected[i])
+		json.Unmarshal(b, &fields)
+		c.Key = fields[ms.Field]
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeMachineCursor decodes a cursor, which must have come from a page in
+// the given order. The last machine is returned with only its ID and sorted
+// field set, which is all it is compared by.
+func decodeMachineCursor(cursor string, ms MachineSort) (machineCursor, Machine, error) {
+	var c machineCursor
+	var last Machine
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err == nil && ms.Field != "" {
+		var key []byte
+		if key, err = json.Marshal(map[string]json.RawMessage{"id": mustMarshal(c.ID), ms.Field: c.Key}); err == nil {
+			err = json.Unmarshal(key, &last)
+		}
+	}
+	if err != nil || c.Sort != ms.String() || c.ID == "" {
+		return c, last, errors.ErrInvalidQueryParam("cursor", cursor)
+	}
+	last.ID = c.ID
+	return c, last, nil
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// SelectMachines runs a query over machines, which must be in the order they
+// were created. stateOf gives the state of a machine, and is only used if the
+// query selects by state.
+func SelectMachines(machines []Machine, q MachineQuery, stateOf func(Machine) MachineState) (MachinePage, error) {
+	selected := []Machine{}
+	for _, m := range machines {
+		if (q.Name == "" || m.Name == q.Name) &&
+			(q.Driver == "" || m.Driver == q.Driver) &&
+			(q.State == "" || stateOf(m) == q.State) {
+			selected = append(selected, m)
+		}
+	}
+	if q.Sort.Field != "" {
+		sort.Sort(machineSorter{selected, q.Sort})
+	}
+
+	start := 0
+	if q.Cursor != "" {
+		c, last, err := decodeMachineCursor(q.Cursor, q.Sort)
+		if err != nil {
+			return MachinePage{}, err
+		}
+		start = pageStart(selected, q.Sort, c, last)
+	}
+
+	page := MachinePage{Machines: selected[start:], Total: len(selected)}
+	if q.Limit > 0 && len(page.Machines) > q.Limit {
+		page.Machines = page.Machines[:q.Limit]
+		page.NextCursor = encodeMachineCursor(q.Sort, selected, start+q.Limit-1)
+	}
+	return page, nil
+}
+
+// pageStart finds where the page after a cursor starts in the selected
+// machines.
+func pageStart(selected []Machine, ms MachineSort, c machineCursor, last Machine) int {
+	if ms.Field != "" {
+		return sort.Search(len(selected), func(i int) bool {
+			return ms.compare(selected[i], last) > 0
+		})
+	}
+
+	for i, m := range selected {
+		if m.ID == c.ID {
+			return i + 1
+		}
+	}
+	// The machine has been deleted, so the machines after it have each moved
+	// up one place, to where it was.
+	if c.Index < 0 || c.Index > len(selected) {
+		return len(selected)
+	}
+	return c.Index
+}
+
+type machineSorter struct {
+	machines []Machine
+	sort     MachineSort
+}
+
+func (s machineSorter) Len() int {
+	return len(s.machines)
+}
+
+func (s machineSorter) Less(i, j int) bool {
+	return s.sort.compare(s.machines[i], s.machines[j]) < 0
+}
+
+func (s machineSorter) Swap(i, j int) {
+	s.machines[i], s.machines[j] = s.machines[j], s.machines[i]
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var listMachines = []Machine{
+	{ID: "c", Name: "web", MemoryMB: 512, Driver: "virtualbox"},
+	{ID: "a", Name: "db", MemoryMB: 2048, Driver: "virtualbox"},
+	{ID: "d", Name: "web", MemoryMB: 1024, Driver: "other"},
+	{ID: "b", Name: "cache", MemoryMB: 512, Driver: "virtualbox"},
+}
+
+var listStates = map[string]MachineState{
+	"a": StateRunning,
+	"b": StatePoweroff,
+	"c": StateRunning,
+	"d": StatePaused,
+}
+
+func machineIDs(machines []Machine) []string {
+	ids := []string{}
+	for _, m := range machines {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func mustParseSort(t *testing.T, s string) MachineSort {
+	ms, err := ParseMachineSort(s)
+	require.NoError(t, err)
+	return ms
+}
+
+func TestSelectMachines(t *testing.T) {
+	cases := []struct {
+		name      string
+		query     MachineQuery
+		expectIDs []string
+	}{
+		{"everything, in creation order", MachineQuery{}, []string{"c", "a", "d", "b"}},
+		{"by name", MachineQuery{Name: "web"}, []string{"c", "d"}},
+		{"by driver", MachineQuery{Driver: "virtualbox"}, []string{"c", "a", "b"}},
+		{"by state", MachineQuery{State: StateRunning}, []string{"c", "a"}},
+		{"sorted by id", MachineQuery{Sort: mustParseSort(t, "id")}, []string{"a", "b", "c", "d"}},
+		{"by everything", MachineQuery{Name: "web", Driver: "virtualbox", State: StateRunning}, []string{"c"}},
+		{"sorted by name", MachineQuery{Sort: mustParseSort(t, "name")}, []string{"b", "a", "c", "d"}},
+		{"sorted by memory, descending", MachineQuery{Sort: mustParseSort(t, "-memoryMB")}, []string{"a", "d", "b", "c"}},
+		{"nothing selected", MachineQuery{Name: "none"}, []string{}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			page, err := SelectMachines(listMachines, c.query, func(m Machine) MachineState {
+				return listStates[m.ID]
+			})
+
+			// Assert
+			require.NoError(t, err)
+			require.Equal(t, c.expectIDs, machineIDs(page.Machines))
+			require.Equal(t, len(c.expectIDs), page.Total)
+			require.Empty(t, page.NextCursor)
+		})
+	}
+}
+
+func TestSelectMachinesPages(t *testing.T) {
+	// Prepare
+	q := MachineQuery{Sort: mustParseSort(t, "-memoryMB"), Limit: 3}
+
+	// Execute
+	first, err := SelectMachines(listMachines, q, nil)
+	require.NoError(t, err)
+
+	// A machine added after the first page does not make the second repeat
+	// any machines.
+	q.Cursor = first.NextCursor
+	second, err := SelectMachines(append([]Machine{{ID: "e", Name: "new", MemoryMB: 4096}}, listMachines...), q, nil)
+	require.NoError(t, err)
+
+	// Assert
+	require.Equal(t, []string{"a", "d", "b"}, machineIDs(first.Machines))
+	require.Equal(t, 4, first.Total)
+	require.NotEmpty(t, first.NextCursor)
+
+	require.Equal(t, []string{"c"}, machineIDs(second.Machines))
+	require.Equal(t, 5, second.Total)
+	require.Empty(t, second.NextCursor)
+}
+
+func TestSelectMachinesPagesInCreationOrder(t *testing.T) {
+	cases := []struct {
+		name      string
+		machines  []Machine
+		expectIDs []string
+	}{
+		{"unchanged", listMachines, []string{"d", "b"}},
+		{"machine added", append(listMachines, Machine{ID: "e"}), []string{"d", "b"}},
+		{"last machine of the page deleted", []Machine{listMachines[0], listMachines[2], listMachines[3]}, []string{"d", "b"}},
+		{"earlier machine deleted", []Machine{listMachines[1], listMachines[2], listMachines[3]}, []string{"d", "b"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			first, err := SelectMachines(listMachines, MachineQuery{Limit: 2}, nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"c", "a"}, machineIDs(first.Machines))
+
+			// Execute
+			second, err := SelectMachines(c.machines, MachineQuery{Limit: 2, Cursor: first.NextCursor}, nil)
+
+			// Assert
+			require.NoError(t, err)
+			require.Equal(t, c.expectIDs, machineIDs(second.Machines))
+		})
+	}
+}
+
+func TestSelectMachinesPagesInCreationOrderAfterDeletes(t *testing.T) {
+	// Prepare: list the first two pages of one machine.
+	q := MachineQuery{Limit: 1}
+	first, err := SelectMachines(listMachines, q, nil)
+	require.NoError(t, err)
+	q.Cursor = first.NextCursor
+	second, err := SelectMachines(listMachines, q, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, machineIDs(second.Machines))
+
+	// Execute: the last machine of the second page is deleted.
+	q.Cursor = second.NextCursor
+	third, err := SelectMachines([]Machine{listMachines[0], listMachines[2], listMachines[3]}, q, nil)
+
+	// Assert
+	require.NoError(t, err)
+	require.Equal(t, []string{"d"}, machineIDs(third.Machines))
+}
+
+func TestMachineCursorHoldsOnlySortKeyAndID(t *testing.T) {
+	// Prepare
+	q := MachineQuery{Sort: mustParseSort(t, "name"), Limit: 1}
+	first, err := SelectMachines(listMachines, q, nil)
+	require.NoError(t, err)
+
+	// Execute
+	b, err := base64.RawURLEncoding.DecodeString(first.NextCursor)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &fields))
+
+	// Assert
+	require.Equal(t, map[string]interface{}{"sort": "name", "key": "cache", "id": "b"}, fields)
+}
+
+func TestSelectMachinesRejectsBadCursor(t *testing.T) {
+	first, err := SelectMachines(listMachines, MachineQuery{Limit: 1}, nil)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name  string
+		query MachineQuery
+	}{
+		{"not a cursor", MachineQuery{Cursor: "!!"}},
+		{"cursor for another order", MachineQuery{Cursor: first.NextCursor, Sort: mustParseSort(t, "name")}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, err := SelectMachines(listMachines, c.query, nil)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseMachineSort(t *testing.T) {
+	require.Equal(t, MachineSort{}, mustParseSort(t, ""))
+	require.Equal(t, MachineSort{"memoryMB", true}, mustParseSort(t, "-memoryMB"))
+
+	_, err := ParseMachineSort("revision")
+	require.Error(t, err)
+}
@@ -1,26 +1,47 @@
 package core
 
 import (
+	"regexp"
+
 	"harkd/errors"
 )
 
+// validMachineID matches the IDs which can be used in a machine's URL.
+var validMachineID = regexp.MustCompile(`^[\w-]+$`)
+
 // Machine is the core hark data structure for a single machine.
 type Machine struct {
 	ID       string `json:"id"`
 	Name     string `json:"name"`
 	MemoryMB uint   `json:"memoryMB"`
+
+	// Driver is the name of the driver whose backend owns this machine's VM.
+	Driver string `json:"driver"`
+
+	// Revision is maintained by the Dal, and changes every time the machine
+	// is saved.
+	Revision uint64 `json:"revision"`
 }
 
-// Validate validates the machine.
+// Validate validates the machine, reporting every invalid field.
 func (m Machine) Validate() error {
+	var v errors.Violations
 	if m.ID == "" {
-		return errors.ErrEntityInvalid("machine id cannot be empty")
+		v.Add("/id", errors.ReasonRequired, "machine id cannot be empty")
+	} else if !validMachineID.MatchString(m.ID) {
+		v.Add("/id", errors.ReasonPattern, "machine id can only contain letters, digits, '_' and '-'")
 	}
 	if m.Name == "" {
-		return errors.ErrEntityInvalid("machine name cannot be empty")
+		v.Add("/name", errors.ReasonRequired, "machine name cannot be empty")
 	}
 	if m.MemoryMB == 0 {
-		return errors.ErrEntityInvalid("machine memoryMB cannot be 0")
+		v.Add("/memoryMB", errors.ReasonMinimum, "machine memoryMB cannot be 0")
 	}
-	return nil
+	return v.Err()
+}
+
+// HardwareDiffers reports whether two machines have different virtual
+// hardware. Hardware can only be changed while a machine is powered off.
+func (m Machine) HardwareDiffers(other Machine) bool {
+	return m.MemoryMB != other.MemoryMB
 }
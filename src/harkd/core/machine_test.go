@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+
+	"harkd/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+var machineValidateTests = []struct {
+	name         string
+	machine      Machine
+	expectFields []string
+}{
+	{"valid", Machine{ID: "foo", Name: "Foo", MemoryMB: 512}, nil},
+	{"ulid", Machine{ID: "01ARYZ6S410000000000000000", Name: "Foo", MemoryMB: 512}, nil},
+	{"dashes and underscores", Machine{ID: "my-machine_2", Name: "Foo", MemoryMB: 512}, nil},
+	{"no id", Machine{Name: "Foo", MemoryMB: 512}, []string{"/id"}},
+	{"id with slash", Machine{ID: "foo/bar", Name: "Foo", MemoryMB: 512}, []string{"/id"}},
+	{"id with space", Machine{ID: "foo bar", Name: "Foo", MemoryMB: 512}, []string{"/id"}},
+	{"no name", Machine{ID: "foo", MemoryMB: 512}, []string{"/name"}},
+	{"no memory", Machine{ID: "foo", Name: "Foo"}, []string{"/memoryMB"}},
+	{"nothing", Machine{}, []string{"/id", "/name", "/memoryMB"}},
+}
+
+func TestMachineValidate(t *testing.T) {
+	for _, c := range machineValidateTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := c.machine.Validate()
+			if c.expectFields == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			detailed, ok := err.(errors.Detailer)
+			require.True(t, ok)
+			var fields []string
+			for _, v := range detailed.Details() {
+				fields = append(fields, v.Field)
+			}
+			require.Equal(t, c.expectFields, fields)
+		})
+	}
+}
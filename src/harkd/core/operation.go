@@ -0,0 +1,71 @@
+package core
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OperationStatus is the status of an asynchronous operation.
+type OperationStatus string
+
+// The statuses an operation can have.
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+	OperationCancelled OperationStatus = "cancelled"
+)
+
+// Finished reports whether an operation with this status has stopped running.
+func (s OperationStatus) Finished() bool {
+	return s == OperationSucceeded || s == OperationFailed || s == OperationCancelled
+}
+
+// Operation tracks long-running work, such as booting a machine, which is
+// done in the background rather than while a request waits.
+type Operation struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	MachineID string          `json:"machineID,omitempty"`
+	Status    OperationStatus `json:"status"`
+
+	// Progress is an estimate of how complete the operation is, in percent.
+	Progress int `json:"progress"`
+
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *OperationError `json:"error,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Revision is maintained by the Dal, and changes every time the
+	// operation is saved.
+	Revision uint64 `json:"revision"`
+}
+
+// Failure returns the error an operation failed with, or nil if it has not
+// failed.
+func (o Operation) Failure() error {
+	if o.Error == nil {
+		return nil
+	}
+	return o.Error
+}
+
+// OperationError is the error an operation failed with. It keeps the code of
+// the original error so that clients see the same code they would have if the
+// work had been done synchronously.
+type OperationError struct {
+	ErrorCode int    `json:"code"`
+	Message   string `json:"message"`
+}
+
+func (oe *OperationError) Error() string {
+	return oe.Message
+}
+
+// Code returns the error code of the original error.
+func (oe *OperationError) Code() int {
+	return oe.ErrorCode
+}
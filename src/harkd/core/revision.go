@@ -0,0 +1,21 @@
+package core
+
+import (
+	"harkd/errors"
+)
+
+// Precondition restricts a change to an entity to when the entity is at a
+// revision the client expects, as with an HTTP If-Match header. It reports
+// whether the entity's current revision is acceptable.
+//
+// A nil Precondition accepts any revision.
+type Precondition func(revision uint64) bool
+
+// CheckMachine returns an error if a machine's revision does not meet the
+// precondition.
+func (p Precondition) CheckMachine(m Machine) error {
+	if p == nil || p(m.Revision) {
+		return nil
+	}
+	return errors.ErrPreconditionFailed("machine", m.ID, m.Revision)
+}
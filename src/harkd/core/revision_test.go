@@ -0,0 +1,45 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func revisions(accepted ...uint64) Precondition {
+	return func(revision uint64) bool {
+		for _, r := range accepted {
+			if r == revision {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var preconditionTests = []struct {
+	name         string
+	precondition Precondition
+	revision     uint64
+	valid        bool
+}{
+	{"no precondition", nil, 3, true},
+	{"matching revision", revisions(3), 3, true},
+	{"one of several revisions", revisions(1, 3), 3, true},
+	{"stale revision", revisions(2), 3, false},
+	{"no acceptable revisions", revisions(), 3, false},
+}
+
+func TestPreconditionCheckMachine(t *testing.T) {
+	for _, c := range preconditionTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := c.precondition.CheckMachine(Machine{ID: "foo", Revision: c.revision})
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"harkd/errors"
+)
+
+// MachineState is the runtime state of the VM backing a machine, as reported
+// by its driver. Drivers normalize their backend's states to these values.
+type MachineState string
+
+// The states a machine can be in.
+const (
+	StatePoweroff MachineState = "poweroff"
+	StateStarting MachineState = "starting"
+	StateRunning  MachineState = "running"
+	StatePaused   MachineState = "paused"
+	StateSaved    MachineState = "saved"
+	StateAborted  MachineState = "aborted"
+	StateUnknown  MachineState = "unknown"
+)
+
+// ParseMachineState parses the name of a machine state.
+func ParseMachineState(s string) (MachineState, error) {
+	switch state := MachineState(s); state {
+	case StatePoweroff, StateStarting, StateRunning, StatePaused, StateSaved, StateAborted, StateUnknown:
+		return state, nil
+	}
+	return "", errors.ErrInvalidQueryParam("state", s)
+}
+
+// PoweredOff reports whether a machine in this state is switched off, so that
+// its hardware can be reconfigured.
+func (s MachineState) PoweredOff() bool {
+	return s == StatePoweroff || s == StateAborted
+}
+
+// Active reports whether a machine in this state has a live VM process.
+func (s MachineState) Active() bool {
+	return s == StateStarting || s == StateRunning || s == StatePaused
+}
+
+// RuntimeInfo is the live state and configuration of the VM backing a
+// machine, as reported by its driver.
+type RuntimeInfo struct {
+	State    MachineState `json:"state"`
+	MemoryMB uint         `json:"memoryMB"`
+	CPUs     uint         `json:"cpus"`
+
+	NICs            []NIC            `json:"nics"`
+	ForwardingRules []ForwardingRule `json:"forwardingRules"`
+}
+
+// NIC is a network adapter attached to a VM.
+type NIC struct {
+	Index      int    `json:"index"`
+	Type       string `json:"type"`
+	MACAddress string `json:"macAddress,omitempty"`
+}
+
+// ForwardingRule is a port forwarding rule on a NAT network adapter.
+type ForwardingRule struct {
+	NIC       int    `json:"nic"`
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	HostIP    string `json:"hostIP,omitempty"`
+	HostPort  int    `json:"hostPort"`
+	GuestIP   string `json:"guestIP,omitempty"`
+	GuestPort int    `json:"guestPort"`
+}
@@ -0,0 +1,85 @@
+package dal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"harkd/errors"
+	"harkd/util/fs"
+)
+
+const corruptFileSuffix = ".corrupt"
+
+// backupPath is the path of a generation of backup of a state file. The
+// newest backup is generation 1.
+func backupPath(filename string, generation int) string {
+	return fmt.Sprintf("%s.bak.%d", filename, generation)
+}
+
+// rotateBackups makes the current state file the newest backup, moving older
+// backups down a generation and dropping the oldest.
+//
+// The state file is hard linked rather than copied or moved, so that it is
+// never missing, even for a moment.
+func rotateBackups(fileSys fs.Filesystem, filename string, backups int) error {
+	if backups <= 0 {
+		return nil
+	}
+
+	if err := fileSys.Remove(backupPath(filename, backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for generation := backups - 1; generation >= 1; generation-- {
+		err := fileSys.Rename(backupPath(filename, generation), backupPath(filename, generation+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := fileSys.Link(filename, backupPath(filename, 1))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// recoverState replaces a corrupt state file with its newest valid backup,
+// returning the backup's contents. The corrupt file is kept alongside it.
+func (jfd *jsonFileDal) recoverState(cause error) ([]byte, error) {
+	for generation := 1; generation <= jfd.backups; generation++ {
+		path := backupPath(jfd.filename, generation)
+		b, err := readFile(jfd.fileSystem, path)
+		if err != nil {
+			continue
+		}
+		if _, err := decodeJSONFileState(b); err != nil {
+			continue
+		}
+
+		corruptPath := jfd.filename + corruptFileSuffix
+		if err := jfd.fileSystem.Rename(jfd.filename, corruptPath); err != nil {
+			return nil, errors.ErrStatePersist(err)
+		}
+		if err := fs.WriteFileAtomic(jfd.fileSystem, jfd.filename, b, jsonFileDalFileMode); err != nil {
+			return nil, errors.ErrStatePersist(err)
+		}
+
+		jfd.warnings = append(jfd.warnings, fmt.Sprintf(
+			"state file %s was corrupt (%s) and was recovered from backup %s: recent changes may have been lost; the corrupt file was kept at %s",
+			jfd.filename, cause, path, corruptPath))
+		return b, nil
+	}
+
+	return nil, errors.ErrStateCorrupt(jfd.filename, cause)
+}
+
+func readFile(fileSys fs.Filesystem, path string) ([]byte, error) {
+	f, err := fileSys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,120 @@
+package dal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"harkd/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveRotatesBackups(t *testing.T) {
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[]}`)
+	defer cleanup()
+
+	d, err := OpenJSONFileDal(filename, 2, 0)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, d.SaveMachine(core.Machine{ID: id}))
+	}
+
+	machineIDs := func(path string) []string {
+		s, err := decodeJSONFileState(mustReadFile(t, path))
+		require.NoError(t, err)
+		ids := []string{}
+		for _, m := range s.Machines {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	require.Equal(t, []string{"a", "b", "c"}, machineIDs(filename))
+	require.Equal(t, []string{"a", "b"}, machineIDs(backupPath(filename, 1)))
+	require.Equal(t, []string{"a"}, machineIDs(backupPath(filename, 2)))
+
+	_, err = os.Stat(backupPath(filename, 3))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filename + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSavingOperationsDoesNotRotateBackups(t *testing.T) {
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[]}`)
+	defer cleanup()
+
+	// Prepare
+	d, err := OpenJSONFileDal(filename, 2, 0)
+	require.NoError(t, err)
+	require.NoError(t, d.SaveMachine(core.Machine{ID: "a"}))
+	backup := mustReadFile(t, backupPath(filename, 1))
+
+	// Execute
+	for progress := 0; progress <= 100; progress += 50 {
+		require.NoError(t, d.PutOperation(core.Operation{ID: "op", Progress: progress}))
+	}
+
+	// Assert
+	require.Equal(t, backup, mustReadFile(t, backupPath(filename, 1)))
+	_, err = os.Stat(backupPath(filename, 2))
+	require.True(t, os.IsNotExist(err))
+	op, err := d.GetOperation("op")
+	require.NoError(t, err)
+	require.Equal(t, 100, op.Progress)
+}
+
+var recoverStateTests = []struct {
+	name          string
+	backups       []string
+	expectMachine string
+	valid         bool
+}{
+	{"no backups", nil, "", false},
+	{"newest backup is valid", []string{`{"schemaVersion":1,"machines":[{"id":"new"}]}`, `{"schemaVersion":1,"machines":[{"id":"old"}]}`}, "new", true},
+	{"newest backup is corrupt too", []string{`{"schemaVersion":1,"mach`, `{"schemaVersion":1,"machines":[{"id":"old"}]}`}, "old", true},
+	{"unversioned backup", []string{`{"machines":[{"id":"old"}]}`}, "old", true},
+	{"every backup is corrupt", []string{`{`, `[]`}, "", false},
+}
+
+func TestOpenJSONFileDalRecoversCorruptState(t *testing.T) {
+	const corrupt = `{"schemaVersion":1,"machines":[{"id":"trunc`
+	for _, c := range recoverStateTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			filename, cleanup := tempStateFile(t, corrupt)
+			defer cleanup()
+			for i, b := range c.backups {
+				require.NoError(t, ioutil.WriteFile(backupPath(filename, i+1), []byte(b), jsonFileDalFileMode))
+			}
+
+			// Execute
+			d, err := OpenJSONFileDal(filename, 3, 0)
+
+			// Assert
+			if !c.valid {
+				require.Error(t, err)
+				require.Equal(t, corrupt, string(mustReadFile(t, filename)))
+				return
+			}
+			require.NoError(t, err)
+
+			machines, err := d.GetMachines()
+			require.NoError(t, err)
+			require.Equal(t, []core.Machine{{ID: c.expectMachine}}, machines)
+
+			require.Equal(t, corrupt, string(mustReadFile(t, filename+corruptFileSuffix)))
+			require.Len(t, d.(Warner).Warnings(), 1)
+		})
+	}
+}
+
+func TestOpenJSONFileDalValidStateHasNoWarnings(t *testing.T) {
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[]}`)
+	defer cleanup()
+
+	d, err := OpenJSONFileDal(filename, 3, 0)
+	require.NoError(t, err)
+	require.Empty(t, d.(Warner).Warnings())
+}
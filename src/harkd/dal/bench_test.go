@@ -0,0 +1,122 @@
+package dal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"harkd/core"
+	"harkd/util/fs"
+)
+
+var benchmarkSizes = []int{10, 1000, 10000}
+
+// benchmarkBackend opens a dal which already holds some machines, in a
+// temporary directory.
+type benchmarkBackend struct {
+	name string
+	open func(b *testing.B, dir string, s jsonFileState) Dal
+}
+
+var benchmarkBackends = []benchmarkBackend{
+	{"json", func(b *testing.B, dir string, s jsonFileState) Dal {
+		filename := filepath.Join(dir, "hark-state.json")
+		if err := saveJSONFileState(s, fs.NewFilesystem(), filename, 0); err != nil {
+			b.Fatal(err)
+		}
+		d, err := OpenJSONFileDal(filename, 0, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return d
+	}},
+	{"journal", func(b *testing.B, dir string, s jsonFileState) Dal {
+		basename := filepath.Join(dir, "hark-state")
+		snapshot, err := json.Marshal(journalSnapshot{s, 0})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(basename+snapshotFileSuffix, snapshot, jsonFileDalFileMode); err != nil {
+			b.Fatal(err)
+		}
+		d, err := OpenJournalDal(basename, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return d
+	}},
+}
+
+func benchmarkState(machines int) jsonFileState {
+	s := jsonFileState{SchemaVersion: currentSchemaVersion}
+	for i := 0; i < machines; i++ {
+		s.Machines = append(s.Machines, core.Machine{
+			ID:       fmt.Sprintf("machine-%d", i),
+			Name:     fmt.Sprintf("Machine %d", i),
+			MemoryMB: 512,
+			Driver:   "virtualbox",
+		})
+	}
+	return s
+}
+
+func runDalBenchmarks(b *testing.B, fn func(b *testing.B, d Dal, machines int)) {
+	for _, backend := range benchmarkBackends {
+		for _, size := range benchmarkSizes {
+			backend, size := backend, size
+			b.Run(fmt.Sprintf("%s/%d", backend.name, size), func(b *testing.B) {
+				dir, err := ioutil.TempDir("", "hark-bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				d := backend.open(b, dir, benchmarkState(size))
+				if jd, ok := d.(*journalDal); ok {
+					defer jd.Close()
+				}
+
+				b.ResetTimer()
+				fn(b, d, size)
+			})
+		}
+	}
+}
+
+func BenchmarkSaveMachine(b *testing.B) {
+	runDalBenchmarks(b, func(b *testing.B, d Dal, machines int) {
+		for i := 0; i < b.N; i++ {
+			m := core.Machine{ID: fmt.Sprintf("new-%d", i), Name: "New", MemoryMB: 512}
+			if err := d.SaveMachine(m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdateMachine(b *testing.B) {
+	setMemory := func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB++
+		return m, nil
+	}
+	runDalBenchmarks(b, func(b *testing.B, d Dal, machines int) {
+		for i := 0; i < b.N; i++ {
+			if _, err := d.UpdateMachine(fmt.Sprintf("machine-%d", i%machines), setMemory); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetMachineByID(b *testing.B) {
+	runDalBenchmarks(b, func(b *testing.B, d Dal, machines int) {
+		for i := 0; i < b.N; i++ {
+			if _, err := d.GetMachineByID(fmt.Sprintf("machine-%d", i%machines)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package dal
+
+import (
+	"os"
+	"sync"
+
+	"harkd/util/fs"
+)
+
+// stateCache holds the state decoded from a state file, so that it is only
+// read and decoded again once the file has changed.
+//
+// The file is taken to have changed if it is a different file, or its
+// modification time or size has changed. Since the state is always saved by
+// renaming a new file over the old one, every save makes a different file.
+//
+// A cached state is never changed, so readers can share it without holding
+// the cache's mutex. Writers change a copy, and put it in the cache once it
+// has been saved.
+type stateCache struct {
+	mutex sync.Mutex
+	state *jsonFileState
+
+	// info describes the file the state was read from. The state is not
+	// reused without it.
+	info os.FileInfo
+
+	// known describes the file as it was last written through the cache, or
+	// last reported as changed by something else. modified is set when a
+	// different file is loaded, whoever loads it, and cleared once it has
+	// been reported.
+	known    os.FileInfo
+	modified bool
+}
+
+// get returns the cached state, loading it first if the file has changed.
+// The state must not be changed.
+func (c *stateCache) get(fileSys fs.Filesystem, filename string, load func() (jsonFileState, error)) (*jsonFileState, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.refresh(fileSys, filename, load); err != nil {
+		return nil, err
+	}
+	return c.state, nil
+}
+
+// cached returns the cached state if the file has not changed since it was
+// cached, or nil. Since the state is always saved by renaming a new file over
+// the old one, it needs no state lock. The state must not be changed.
+func (c *stateCache) cached(fileSys fs.Filesystem, filename string) *jsonFileState {
+	info, err := fileSys.Stat(filename)
+	if err != nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.fresh(info) {
+		return nil
+	}
+	return c.state
+}
+
+// put caches a state which has just been saved to the file. The caller must
+// hold the state lock, so that the file is as s was saved.
+func (c *stateCache) put(fileSys fs.Filesystem, filename string, s *jsonFileState) {
+	info, err := fileSys.Stat(filename)
+	if err != nil {
+		info = nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state, c.info, c.known = s, info, info
+}
+
+// drop drops the cached state, so that it is loaded again when next used.
+func (c *stateCache) drop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.invalidate()
+}
+
+// refresh loads the state if the file has changed since it was cached. If the
+// file is not the one last known, it was changed by something else, which is
+// noted for takeModified. The caller must hold the cache's mutex.
+func (c *stateCache) refresh(fileSys fs.Filesystem, filename string, load func() (jsonFileState, error)) error {
+	// The file is checked before it is read, so that if it changes in between
+	// the state is reloaded next time.
+	info, statErr := fileSys.Stat(filename)
+	if statErr == nil && c.fresh(info) {
+		return nil
+	}
+
+	s, err := load()
+	if statErr != nil {
+		// Loading makes the file if there is none, so it can only be
+		// described now.
+		if info, statErr = fileSys.Stat(filename); statErr != nil {
+			info = nil
+		}
+	}
+	c.notice(info)
+	if err != nil {
+		c.invalidate()
+		return err
+	}
+	c.state, c.info = &s, info
+	return nil
+}
+
+// notice notes that the file described by info has been loaded. The first
+// file loaded is where changes are counted from. The caller must hold the
+// cache's mutex.
+func (c *stateCache) notice(info os.FileInfo) {
+	if c.known == nil {
+		c.known = info
+	} else if !sameFile(info, c.known) {
+		c.known, c.modified = info, true
+	}
+}
+
+// takeModified reports whether the file has been changed by something else
+// since it was last reported, and forgets the change. The caller must hold
+// the cache's mutex.
+func (c *stateCache) takeModified() bool {
+	modified := c.modified
+	c.modified = false
+	return modified
+}
+
+// fresh reports whether the cached state was read from the file described by
+// info.
+func (c *stateCache) fresh(info os.FileInfo) bool {
+	return c.state != nil && sameFile(info, c.info)
+}
+
+// sameFile reports whether two descriptions are of the same version of a
+// file.
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil &&
+		os.SameFile(a, b) &&
+		a.ModTime().Equal(b.ModTime()) &&
+		a.Size() == b.Size()
+}
+
+// invalidate drops the cached state. The caller must hold the cache's mutex.
+func (c *stateCache) invalidate() {
+	c.state, c.info = nil, nil
+}
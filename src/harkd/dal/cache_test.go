@@ -0,0 +1,150 @@
+package dal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"harkd/core"
+	"harkd/util/fs"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingFilesystem counts the files opened.
+type countingFilesystem struct {
+	fs.Filesystem
+	opens int
+}
+
+func (cfs *countingFilesystem) Open(path string) (io.ReadCloser, error) {
+	cfs.opens++
+	return cfs.Filesystem.Open(path)
+}
+
+func openCountingDal(t *testing.T, filename string) (*jsonFileDal, *countingFilesystem) {
+	d, err := OpenJSONFileDal(filename, 0, 0)
+	require.NoError(t, err)
+
+	jfd := d.(*jsonFileDal)
+	cfs := &countingFilesystem{Filesystem: jfd.fileSystem}
+	jfd.fileSystem = cfs
+	return jfd, cfs
+}
+
+func TestJSONFileDalCachesState(t *testing.T) {
+	// Prepare
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[{"id":"foo"}]}`)
+	defer cleanup()
+	jfd, cfs := openCountingDal(t, filename)
+
+	// Execute
+	for i := 0; i < 10; i++ {
+		_, err := jfd.GetMachines()
+		require.NoError(t, err)
+	}
+	require.NoError(t, jfd.SaveMachine(core.Machine{ID: "bar"}))
+	machines, err := jfd.GetMachines()
+
+	// Assert
+	require.NoError(t, err)
+	require.Len(t, machines, 2)
+	require.Equal(t, 1, cfs.opens)
+}
+
+func TestJSONFileDalReloadsChangedState(t *testing.T) {
+	// Prepare
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[{"id":"foo"}]}`)
+	defer cleanup()
+	jfd, cfs := openCountingDal(t, filename)
+	_, err := jfd.GetMachines()
+	require.NoError(t, err)
+
+	// Execute: another process changes the file in place, with the same size.
+	require.NoError(t, ioutil.WriteFile(filename, []byte(`{"schemaVersion":1,"machines":[{"id":"bar"}]}`), jsonFileDalFileMode))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(filename, later, later))
+	machines, err := jfd.GetMachines()
+
+	// Assert
+	require.NoError(t, err)
+	require.Equal(t, []core.Machine{{ID: "bar"}}, machines)
+	require.Equal(t, 2, cfs.opens)
+}
+
+func TestJSONFileDalReload(t *testing.T) {
+	// Prepare
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[{"id":"foo"}]}`)
+	defer cleanup()
+	jfd, _ := openCountingDal(t, filename)
+
+	// Execute & Assert: the first load is not a change.
+	changed, err := jfd.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// Changes made through the dal are not reported.
+	require.NoError(t, jfd.SaveMachine(core.Machine{ID: "bar"}))
+	changed, err = jfd.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// Changes made by something else are.
+	require.NoError(t, saveJSONFileState(jsonFileState{Machines: []core.Machine{{ID: "baz"}}}, fs.NewFilesystem(), filename, 0))
+	changed, err = jfd.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	machines, err := jfd.GetMachines()
+	require.NoError(t, err)
+	require.Equal(t, []core.Machine{{ID: "baz"}}, machines)
+
+	// A change is reported once, even if a read reloads the state first.
+	require.NoError(t, saveJSONFileState(jsonFileState{Machines: []core.Machine{{ID: "qux"}}}, fs.NewFilesystem(), filename, 0))
+	machines, err = jfd.GetMachines()
+	require.NoError(t, err)
+	require.Equal(t, []core.Machine{{ID: "qux"}}, machines)
+	changed, err = jfd.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	changed, err = jfd.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+}
+
+func TestJSONFileDalViewDuringUpdate(t *testing.T) {
+	// Prepare
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":1,"machines":[{"id":"foo"}]}`)
+	defer cleanup()
+	jfd, _ := openCountingDal(t, filename)
+	_, err := jfd.GetMachines()
+	require.NoError(t, err)
+
+	updating, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- jfd.Update(func(tx WriteTx) error {
+			if err := tx.SaveMachine(core.Machine{ID: "bar"}); err != nil {
+				return err
+			}
+			close(updating)
+			<-release
+			return nil
+		})
+	}()
+	<-updating
+
+	// Execute: a read while the update is still running.
+	machines, err := jfd.GetMachines()
+	close(release)
+
+	// Assert: the read did not wait, and saw the state from before.
+	require.NoError(t, err)
+	require.Equal(t, []core.Machine{{ID: "foo"}}, machines)
+	require.NoError(t, <-done)
+	machines, err = jfd.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 2)
+}
@@ -2,6 +2,7 @@ package dal
 
 import (
 	"harkd/core"
+	"harkd/util"
 )
 
 // Dal is the interface for reading and persisting Hark state.
@@ -9,5 +10,53 @@ type Dal interface {
 	GetMachines() ([]core.Machine, error)
 	GetMachineByID(string) (core.Machine, error)
 
+	// GetMachineHistory lists the versions kept of a machine, oldest first.
+	// The last is the machine as it is now.
+	GetMachineHistory(string) ([]core.MachineVersion, error)
+
 	SaveMachine(core.Machine) error
+	UpdateMachine(string, func(core.Machine) (core.Machine, error)) (core.Machine, error)
+	DeleteMachine(string) error
+
+	GetOperations() ([]core.Operation, error)
+	GetOperation(string) (core.Operation, error)
+
+	// PutOperation saves an operation, replacing any existing operation with
+	// the same ID.
+	PutOperation(core.Operation) error
+
+	// View runs fn in a read-only transaction: every read fn makes sees the
+	// same state. fn must not use the Dal itself.
+	View(fn func(ReadTx) error) error
+
+	// Update runs fn in a transaction which can change the state. The state
+	// is locked for the whole of fn, and its changes are saved together once
+	// it returns. If fn returns an error, none of them are saved. fn must not
+	// use the Dal itself.
+	Update(fn func(WriteTx) error) error
+}
+
+// Warner is implemented by a Dal which can report problems it found with the
+// state, such as having had to recover it from a backup.
+type Warner interface {
+	Warnings() []string
+}
+
+// Reloader is implemented by a Dal whose state file can be changed by other
+// processes while it is in use.
+type Reloader interface {
+	// StateFile is the file the state is kept in.
+	StateFile() string
+
+	// Reload reloads the state if the file has been changed by something
+	// other than this Dal, and reports whether it has been since Reload last
+	// reported it, even if the state was reloaded by a read in between.
+	Reload() (bool, error)
+}
+
+// Locker is implemented by a Dal which guards the state with a lock file.
+type Locker interface {
+	// LockStats reports who holds the lock, and how long it has taken to
+	// take.
+	LockStats() util.LockStats
 }
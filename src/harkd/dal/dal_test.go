@@ -0,0 +1,51 @@
+package dal_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"harkd/dal"
+	"harkd/dal/daltest"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// tempDal opens a dal in a new temporary directory.
+func tempDal(t *testing.T, open func(dir string) (dal.Dal, error)) func() (dal.Dal, func()) {
+	return func() (dal.Dal, func()) {
+		dir, err := ioutil.TempDir("", "hark-dal")
+		require.NoError(t, err)
+
+		d, err := open(dir)
+		require.NoError(t, err)
+
+		return d, func() {
+			if c, ok := d.(io.Closer); ok {
+				c.Close()
+			}
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestMemoryDalConformance(t *testing.T) {
+	suite.Run(t, &daltest.Suite{NewDal: func() (dal.Dal, func()) {
+		return dal.NewMemoryDal(), func() {}
+	}})
+}
+
+func TestJSONFileDalConformance(t *testing.T) {
+	suite.Run(t, &daltest.Suite{NewDal: tempDal(t, func(dir string) (dal.Dal, error) {
+		return dal.OpenJSONFileDal(filepath.Join(dir, "hark-state.json"), 3, 0)
+	})})
+}
+
+func TestJournalDalConformance(t *testing.T) {
+	suite.Run(t, &daltest.Suite{NewDal: tempDal(t, func(dir string) (dal.Dal, error) {
+		return dal.OpenJournalDal(filepath.Join(dir, "hark-state"), 0)
+	})})
+}
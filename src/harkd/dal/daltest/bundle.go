@@ -0,0 +1,19 @@
+package daltest
+
+import (
+	"bytes"
+	"testing"
+
+	"harkd/core"
+	"harkd/dal"
+
+	"github.com/stretchr/testify/require"
+)
+
+// StateBundle writes machines to a state bundle, as exported by a hark
+// holding them.
+func StateBundle(t *testing.T, machines ...core.Machine) *bytes.Buffer {
+	var buf bytes.Buffer
+	require.NoError(t, dal.WriteStateBundle(&buf, machines))
+	return &buf
+}
@@ -0,0 +1,472 @@
+// Package daltest provides a conformance test suite for implementations of
+// dal.Dal, and fixtures for tests of the code which uses them.
+package daltest
+
+import (
+	"fmt"
+	"sync"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/errors"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// concurrentWriters is the number of goroutines used by the concurrency
+// tests.
+const concurrentWriters = 10
+
+// Suite checks that a Dal behaves the way hark expects. Run it with
+// suite.Run, setting NewDal:
+//
+//	suite.Run(t, &daltest.Suite{NewDal: func() (dal.Dal, func()) {
+//		return dal.NewMemoryDal(), func() {}
+//	}})
+type Suite struct {
+	suite.Suite
+
+	// NewDal returns a new Dal with empty state for each test, and a func to
+	// clean up after it.
+	NewDal func() (dal.Dal, func())
+
+	dal     dal.Dal
+	cleanup func()
+}
+
+// SetupTest gives each test a new Dal.
+func (s *Suite) SetupTest() {
+	s.dal, s.cleanup = s.NewDal()
+}
+
+// TearDownTest cleans up after the test's Dal.
+func (s *Suite) TearDownTest() {
+	s.cleanup()
+}
+
+// requireStatus checks that err is a hark error for the given HTTP status.
+func (s *Suite) requireStatus(status int, err error) {
+	s.Require().Error(err)
+	s.Require().Equal(status, errors.NewErrorHandlerService().GetHTTPStatusCode(err), "unexpected error: %s", err)
+}
+
+func (s *Suite) saveMachines(ids ...string) {
+	for _, id := range ids {
+		s.Require().NoError(s.dal.SaveMachine(core.Machine{ID: id, Name: id, MemoryMB: 512}))
+	}
+}
+
+func (s *Suite) machineIDs() []string {
+	machines, err := s.dal.GetMachines()
+	s.Require().NoError(err)
+
+	ids := []string{}
+	for _, m := range machines {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// TestEmpty checks that a new Dal has no machines or operations.
+func (s *Suite) TestEmpty() {
+	machines, err := s.dal.GetMachines()
+	s.Require().NoError(err)
+	s.Require().Empty(machines)
+
+	operations, err := s.dal.GetOperations()
+	s.Require().NoError(err)
+	s.Require().Empty(operations)
+}
+
+// TestSaveAndGetMachine checks that a saved machine can be read back.
+func (s *Suite) TestSaveAndGetMachine() {
+	m := core.Machine{ID: "foo", Name: "Foo", MemoryMB: 512, Driver: "virtualbox"}
+	s.Require().NoError(s.dal.SaveMachine(m))
+
+	got, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	m.Revision = 1
+	s.Require().Equal(m, got)
+}
+
+// TestRevisions checks that every save gives a new revision, and that
+// revisions are never reused, even after a machine is deleted.
+func (s *Suite) TestRevisions() {
+	s.Require().NoError(s.dal.SaveMachine(core.Machine{ID: "foo", Revision: 42}))
+	got, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(1), got.Revision)
+
+	updated, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = 1024
+		return m, nil
+	})
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(2), updated.Revision)
+
+	s.Require().NoError(s.dal.PutOperation(core.Operation{ID: "op", MachineID: "foo"}))
+	op, err := s.dal.GetOperation("op")
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(3), op.Revision)
+
+	s.Require().NoError(s.dal.DeleteMachine("foo"))
+	s.Require().NoError(s.dal.SaveMachine(core.Machine{ID: "foo"}))
+	got, err = s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(4), got.Revision)
+}
+
+// TestMachineHistory checks that each version of a machine is kept, with how
+// it differs from the last.
+func (s *Suite) TestMachineHistory() {
+	s.saveMachines("foo")
+	updated, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = 1024
+		return m, nil
+	})
+	s.Require().NoError(err)
+
+	history, err := s.dal.GetMachineHistory("foo")
+	s.Require().NoError(err)
+	s.Require().Len(history, 2)
+	s.Require().Equal(uint64(1), history[0].Revision)
+	s.Require().Equal(uint(512), history[0].Machine.MemoryMB)
+	s.Require().Empty(history[0].Changes)
+	s.Require().Equal(updated, history[1].Machine)
+	s.Require().Len(history[1].Changes, 1)
+	s.Require().Equal("memoryMB", history[1].Changes[0].Field)
+	s.Require().False(history[1].SavedAt.IsZero())
+}
+
+// TestMachineHistoryIsBounded checks that only the latest versions of a
+// machine are kept.
+func (s *Suite) TestMachineHistoryIsBounded() {
+	s.saveMachines("foo")
+	for i := 0; i < 100; i++ {
+		_, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+			m.MemoryMB++
+			return m, nil
+		})
+		s.Require().NoError(err)
+	}
+
+	history, err := s.dal.GetMachineHistory("foo")
+	s.Require().NoError(err)
+	s.Require().NotEmpty(history)
+	s.Require().True(len(history) < 100, "kept %d versions", len(history))
+
+	current, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(current, history[len(history)-1].Machine)
+}
+
+// TestMachineHistoryDeleted checks that a machine's history goes with it.
+func (s *Suite) TestMachineHistoryDeleted() {
+	s.saveMachines("foo")
+	s.Require().NoError(s.dal.DeleteMachine("foo"))
+
+	_, err := s.dal.GetMachineHistory("foo")
+	s.requireStatus(404, err)
+
+	s.saveMachines("foo")
+	history, err := s.dal.GetMachineHistory("foo")
+	s.Require().NoError(err)
+	s.Require().Len(history, 1)
+}
+
+// TestGetMachinesInOrder checks that machines are listed in the order they
+// were created.
+func (s *Suite) TestGetMachinesInOrder() {
+	s.saveMachines("c", "a", "b")
+	s.Require().Equal([]string{"c", "a", "b"}, s.machineIDs())
+}
+
+// TestSaveMachineConflict checks that a machine cannot be saved over another
+// with the same ID.
+func (s *Suite) TestSaveMachineConflict() {
+	s.saveMachines("foo")
+
+	err := s.dal.SaveMachine(core.Machine{ID: "foo", Name: "Other"})
+	s.requireStatus(409, err)
+
+	got, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal("foo", got.Name)
+}
+
+// TestGetMachineNotFound checks looking up a machine which does not exist.
+func (s *Suite) TestGetMachineNotFound() {
+	s.saveMachines("foo")
+
+	_, err := s.dal.GetMachineByID("bar")
+	s.requireStatus(404, err)
+}
+
+// TestUpdateMachine checks that an update is saved and returned.
+func (s *Suite) TestUpdateMachine() {
+	s.saveMachines("foo", "bar")
+
+	updated, err := s.dal.UpdateMachine("bar", func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = 1024
+		return m, nil
+	})
+	s.Require().NoError(err)
+	s.Require().Equal(uint(1024), updated.MemoryMB)
+
+	got, err := s.dal.GetMachineByID("bar")
+	s.Require().NoError(err)
+	s.Require().Equal(updated, got)
+	s.Require().Equal([]string{"foo", "bar"}, s.machineIDs())
+}
+
+// TestUpdateMachineNotFound checks updating a machine which does not exist.
+func (s *Suite) TestUpdateMachineNotFound() {
+	_, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		s.Fail("update func called for a missing machine")
+		return m, nil
+	})
+	s.requireStatus(404, err)
+}
+
+// TestUpdateMachineRejected checks that an update func can veto the update.
+func (s *Suite) TestUpdateMachineRejected() {
+	s.saveMachines("foo")
+
+	_, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = 1024
+		return m, errors.ErrEntityInvalid("rejected")
+	})
+	s.requireStatus(400, err)
+
+	got, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(uint(512), got.MemoryMB)
+}
+
+// TestUpdateMachineID checks that an update cannot change a machine's ID.
+func (s *Suite) TestUpdateMachineID() {
+	s.saveMachines("foo")
+
+	_, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		m.ID = "bar"
+		return m, nil
+	})
+	s.requireStatus(400, err)
+	s.Require().Equal([]string{"foo"}, s.machineIDs())
+}
+
+// TestDeleteMachine checks that a deleted machine is gone, and the others are
+// left alone.
+func (s *Suite) TestDeleteMachine() {
+	s.saveMachines("foo", "bar", "baz")
+
+	s.Require().NoError(s.dal.DeleteMachine("bar"))
+
+	_, err := s.dal.GetMachineByID("bar")
+	s.requireStatus(404, err)
+	s.Require().Equal([]string{"foo", "baz"}, s.machineIDs())
+}
+
+// TestDeleteMachineNotFound checks deleting a machine which does not exist.
+func (s *Suite) TestDeleteMachineNotFound() {
+	s.saveMachines("foo")
+
+	s.requireStatus(404, s.dal.DeleteMachine("bar"))
+	s.Require().Equal([]string{"foo"}, s.machineIDs())
+}
+
+// TestPutOperation checks that operations are created and then replaced.
+func (s *Suite) TestPutOperation() {
+	op := core.Operation{ID: "op", Type: "machine.start", MachineID: "foo", Status: core.OperationPending}
+	s.Require().NoError(s.dal.PutOperation(op))
+
+	op.Status = core.OperationSucceeded
+	op.Progress = 100
+	s.Require().NoError(s.dal.PutOperation(op))
+
+	got, err := s.dal.GetOperation("op")
+	s.Require().NoError(err)
+	s.Require().Equal(op.Status, got.Status)
+	s.Require().Equal(100, got.Progress)
+
+	operations, err := s.dal.GetOperations()
+	s.Require().NoError(err)
+	s.Require().Len(operations, 1)
+}
+
+// TestGetOperationNotFound checks looking up an operation which does not
+// exist.
+func (s *Suite) TestGetOperationNotFound() {
+	_, err := s.dal.GetOperation("op")
+	s.requireStatus(404, err)
+}
+
+// TestUpdate checks that the changes made in a transaction are all saved, and
+// that the transaction sees its own changes.
+func (s *Suite) TestUpdate() {
+	s.saveMachines("foo")
+
+	err := s.dal.Update(func(tx dal.WriteTx) error {
+		if err := tx.SaveMachine(core.Machine{ID: "bar"}); err != nil {
+			return err
+		}
+		if _, err := tx.GetMachineByID("bar"); err != nil {
+			return err
+		}
+		return tx.DeleteMachine("foo")
+	})
+	s.Require().NoError(err)
+	s.Require().Equal([]string{"bar"}, s.machineIDs())
+}
+
+// TestUpdateRollsBack checks that none of the changes made in a transaction
+// are kept if it fails.
+func (s *Suite) TestUpdateRollsBack() {
+	s.saveMachines("foo", "bar")
+
+	err := s.dal.Update(func(tx dal.WriteTx) error {
+		s.Require().NoError(tx.SaveMachine(core.Machine{ID: "baz"}))
+		s.Require().NoError(tx.DeleteMachine("foo"))
+		_, err := tx.UpdateMachine("bar", func(m core.Machine) (core.Machine, error) {
+			m.MemoryMB = 1024
+			return m, nil
+		})
+		s.Require().NoError(err)
+		s.Require().NoError(tx.PutOperation(core.Operation{ID: "op"}))
+		return errors.ErrEntityInvalid("rejected")
+	})
+	s.requireStatus(400, err)
+
+	s.Require().Equal([]string{"foo", "bar"}, s.machineIDs())
+	bar, err := s.dal.GetMachineByID("bar")
+	s.Require().NoError(err)
+	s.Require().Equal(uint(512), bar.MemoryMB)
+	_, err = s.dal.GetOperation("op")
+	s.requireStatus(404, err)
+	history, err := s.dal.GetMachineHistory("foo")
+	s.Require().NoError(err)
+	s.Require().Len(history, 1)
+
+	// Revisions used by the failed transaction are given out again.
+	s.saveMachines("baz")
+	baz, err := s.dal.GetMachineByID("baz")
+	s.Require().NoError(err)
+	s.Require().Equal(uint64(3), baz.Revision)
+}
+
+// TestUpdateRollsBackOnPanic checks that none of the changes made in a
+// transaction are kept if it panics.
+func (s *Suite) TestUpdateRollsBackOnPanic() {
+	s.saveMachines("foo")
+
+	s.Require().Panics(func() {
+		s.dal.Update(func(tx dal.WriteTx) error {
+			s.Require().NoError(tx.SaveMachine(core.Machine{ID: "bar"}))
+			_, err := tx.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+				m.MemoryMB = 1024
+				return m, nil
+			})
+			s.Require().NoError(err)
+			panic("oops")
+		})
+	})
+
+	s.Require().Equal([]string{"foo"}, s.machineIDs())
+	foo, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(uint(512), foo.MemoryMB)
+}
+
+// TestView checks that a read-only transaction sees the state.
+func (s *Suite) TestView() {
+	s.saveMachines("foo", "bar")
+
+	err := s.dal.View(func(tx dal.ReadTx) error {
+		machines, err := tx.GetMachines()
+		s.Require().NoError(err)
+		s.Require().Len(machines, 2)
+
+		m, err := tx.GetMachineByID("bar")
+		s.Require().NoError(err)
+		s.Require().Equal("bar", m.Name)
+		return nil
+	})
+	s.Require().NoError(err)
+}
+
+// TestConcurrentSaves checks that no machine is lost when several writers
+// save machines at once.
+func (s *Suite) TestConcurrentSaves() {
+	errs := make(chan error, concurrentWriters)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.dal.SaveMachine(core.Machine{ID: fmt.Sprintf("machine-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		s.Require().NoError(err)
+	}
+	s.Require().Len(s.machineIDs(), concurrentWriters)
+}
+
+// TestConcurrentSavesOfOneID checks that only one of several writers saving
+// the same machine at once succeeds.
+func (s *Suite) TestConcurrentSavesOfOneID() {
+	errs := make(chan error, concurrentWriters)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.dal.SaveMachine(core.Machine{ID: "foo"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	saved := 0
+	for err := range errs {
+		if err == nil {
+			saved++
+		} else {
+			s.requireStatus(409, err)
+		}
+	}
+	s.Require().Equal(1, saved)
+	s.Require().Equal([]string{"foo"}, s.machineIDs())
+}
+
+// TestConcurrentUpdates checks that updates are atomic: concurrent
+// read-modify-writes of the same machine must not overwrite each other.
+func (s *Suite) TestConcurrentUpdates() {
+	s.Require().NoError(s.dal.SaveMachine(core.Machine{ID: "foo"}))
+
+	errs := make(chan error, concurrentWriters)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+				m.MemoryMB++
+				return m, nil
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		s.Require().NoError(err)
+	}
+	got, err := s.dal.GetMachineByID("foo")
+	s.Require().NoError(err)
+	s.Require().Equal(uint(concurrentWriters), got.MemoryMB)
+}
@@ -0,0 +1,95 @@
+package dal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"harkd/core"
+	"harkd/errors"
+	"harkd/util/bundle"
+)
+
+// stateBundleFormat identifies a bundle of exported hark state.
+const stateBundleFormat = "hark-state"
+
+// stateBundleFile is the name of the state JSON within a bundle.
+const stateBundleFile = "state.json"
+
+// SchemaVersion is the version of the state schema this harkd reads and
+// writes.
+func SchemaVersion() int {
+	return currentSchemaVersion
+}
+
+// EncodeState encodes machines as state JSON, in the same format as the
+// state file, so that they can be moved to another hark.
+func EncodeState(machines []core.Machine) ([]byte, error) {
+	if machines == nil {
+		machines = []core.Machine{}
+	}
+	b, err := json.Marshal(jsonFileState{SchemaVersion: currentSchemaVersion, Machines: machines})
+	if err != nil {
+		return nil, errors.ErrSerialization("serializing state", err)
+	}
+	return b, nil
+}
+
+// DecodeState decodes the machines from state JSON, migrating it from an
+// older schema version if need be.
+func DecodeState(b []byte) ([]core.Machine, error) {
+	s, err := decodeJSONFileState(b)
+	if err != nil {
+		return nil, err
+	}
+	return s.Machines, nil
+}
+
+// WriteStateBundle writes machines to a bundle which can be read by
+// ReadStateBundle, so that they can be moved to another hark. The bundle is
+// built in memory, so nothing is written if it cannot be built.
+func WriteStateBundle(w io.Writer, machines []core.Machine) error {
+	state, err := EncodeState(machines)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	manifest := bundle.Manifest{
+		Format:        stateBundleFormat,
+		SchemaVersion: currentSchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := bundle.Write(&buf, manifest, map[string][]byte{stateBundleFile: state}); err != nil {
+		return errors.ErrSerialization("writing state bundle", err)
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// ReadStateBundle reads the machines from a bundle written by
+// WriteStateBundle.
+func ReadStateBundle(r io.Reader) ([]core.Machine, error) {
+	manifest, files, err := bundle.Read(r)
+	if err != nil {
+		return nil, errors.ErrInvalidBundle(err)
+	}
+	if manifest.Format != stateBundleFormat {
+		return nil, errors.ErrInvalidBundle(fmt.Errorf("format is %q, not %q", manifest.Format, stateBundleFormat))
+	}
+	if manifest.SchemaVersion > currentSchemaVersion {
+		return nil, errors.ErrInvalidBundle(fmt.Errorf("schema version %d is newer than this harkd supports (%d)", manifest.SchemaVersion, currentSchemaVersion))
+	}
+
+	state, ok := files[stateBundleFile]
+	if !ok {
+		return nil, errors.ErrInvalidBundle(fmt.Errorf("no %s", stateBundleFile))
+	}
+	machines, err := DecodeState(state)
+	if err != nil {
+		return nil, errors.ErrInvalidBundle(err)
+	}
+	return machines, nil
+}
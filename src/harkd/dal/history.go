@@ -0,0 +1,98 @@
+package dal
+
+import (
+	"fmt"
+	"time"
+
+	"harkd/core"
+)
+
+// maxMachineHistory is the number of versions of each machine kept in the
+// state, including the current one. Older versions are dropped when new ones
+// are saved.
+const maxMachineHistory = 20
+
+// systemClock gives the time at which changes to the state are saved.
+func systemClock() time.Time {
+	return time.Now().UTC()
+}
+
+// recordVersion adds a version of a machine to its history. previous is the
+// version it replaces, if any.
+func (s *jsonFileState) recordVersion(machine core.Machine, previous *core.Machine, savedAt time.Time) {
+	changes := []core.FieldChange{}
+	if previous != nil {
+		changes = core.DiffMachines(*previous, machine)
+	}
+
+	if s.History == nil {
+		s.History = make(map[string][]core.MachineVersion)
+	}
+	history := append(s.History[machine.ID], core.MachineVersion{
+		Revision: machine.Revision,
+		SavedAt:  savedAt,
+		Machine:  machine,
+		Changes:  changes,
+	})
+	if len(history) > maxMachineHistory {
+		history = history[len(history)-maxMachineHistory:]
+	}
+	s.History[machine.ID] = history
+}
+
+// seedMachineHistory migrates the state to keep machine history, by giving
+// every machine with no history a first version: the machine as it is, saved
+// as the state is migrated. Without it, a machine's definition from before
+// history was kept could never be restored.
+func seedMachineHistory(s rawState) error {
+	machines, _ := s["machines"].([]interface{})
+	history, _ := s["history"].(map[string]interface{})
+	if history == nil {
+		history = make(map[string]interface{})
+	}
+
+	savedAt := systemClock()
+	for _, raw := range machines {
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("machine is not an object")
+		}
+		id, ok := m["id"].(string)
+		if !ok {
+			return fmt.Errorf("machine has no id")
+		}
+		if versions, _ := history[id].([]interface{}); len(versions) > 0 {
+			continue
+		}
+
+		version := map[string]interface{}{"savedAt": savedAt, "machine": m, "changes": []interface{}{}}
+		if revision, ok := m["revision"]; ok {
+			version["revision"] = revision
+		}
+		history[id] = []interface{}{version}
+	}
+
+	if len(history) > 0 {
+		s["history"] = history
+	}
+	return nil
+}
+
+// machineHistory returns a copy of the versions kept of a machine, oldest
+// first.
+func (s *jsonFileState) machineHistory(machineID string) []core.MachineVersion {
+	return append([]core.MachineVersion{}, s.History[machineID]...)
+}
+
+// saveHistory returns a func which restores a machine's history to how it is
+// now.
+func (s *jsonFileState) saveHistory(machineID string) func() {
+	history, ok := s.History[machineID]
+	return func() {
+		if ok {
+			s.History[machineID] = history
+		} else {
+			delete(s.History, machineID)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+package dal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"harkd/core"
+	"harkd/errors"
+	"harkd/util"
+	"harkd/util/fs"
+)
+
+const snapshotFileSuffix = ".snapshot"
+const journalFileSuffix = ".journal"
+
+// journalCompactThreshold is the number of journal entries after which the
+// journal is compacted into a new snapshot.
+const journalCompactThreshold = 1000
+
+// The mutations which can be recorded in the journal.
+const (
+	journalPutMachine    = "putMachine"
+	journalDeleteMachine = "deleteMachine"
+	journalPutOperation  = "putOperation"
+
+	// journalBatch is the mutations made by a transaction, which are applied
+	// together.
+	journalBatch = "batch"
+)
+
+// journalEntry is a single mutation of the state, as recorded in the journal.
+type journalEntry struct {
+	Seq       uint64          `json:"seq,omitempty"`
+	Time      time.Time       `json:"time"`
+	Op        string          `json:"op"`
+	Machine   *core.Machine   `json:"machine,omitempty"`
+	MachineID string          `json:"machineID,omitempty"`
+	Operation *core.Operation `json:"operation,omitempty"`
+	Entries   []journalEntry  `json:"entries,omitempty"`
+}
+
+// journalSnapshot is the state as of a particular journal entry.
+type journalSnapshot struct {
+	jsonFileState
+	Seq uint64 `json:"seq"`
+}
+
+// OpenJournalDal returns a DAL which keeps the state in memory and records
+// each mutation by appending it to a write-ahead journal, rather than
+// rewriting the whole state.
+//
+// The state is kept in two files next to basename: a snapshot, and a journal
+// of the mutations made since it was taken. Opening the dal replays the
+// journal over the snapshot. Once the journal grows long enough it is
+// compacted into a new snapshot.
+//
+// The state lock is taken for each transaction which changes the state, and
+// for compaction, so several processes can use the state at once. Each keeps
+// the state in memory, and catches up with the changes the others have
+// appended to the journal before it reads or changes it. Taking the lock
+// waits for lockTimeout at most, or util.DefaultLockTimeout if it is zero.
+func OpenJournalDal(basename string, lockTimeout time.Duration) (Dal, error) {
+	lock, err := util.NewLock(basename+lockFileSuffix, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	jd := &journalDal{
+		memoryDal:        newMemoryDal(),
+		snapshotFile:     basename + snapshotFileSuffix,
+		journalFile:      basename + journalFileSuffix,
+		fileSystem:       fs.NewFilesystem(),
+		lock:             lock,
+		compactThreshold: journalCompactThreshold,
+	}
+	jd.memoryDal.commit = jd.commit
+	jd.memoryDal.singleTx = singleTx{jd}
+	if err := jd.open(); err != nil {
+		return nil, err
+	}
+	return jd, nil
+}
+
+type journalDal struct {
+	// Reads and mutations are handled by the memoryDal, which passes the
+	// mutations made by each transaction to commit.
+	*memoryDal
+
+	snapshotFile string
+	journalFile  string
+	fileSystem   fs.Filesystem
+	lock         util.Lock
+
+	compactThreshold int
+
+	// These are guarded by the memoryDal's mutex.
+	journal fs.File
+	seq     uint64
+	entries int
+
+	// offset is how much of the journal has been applied to the state, and
+	// snapshot describes the snapshot file it was loaded from. If either file
+	// has changed, another process has changed the state.
+	offset   int64
+	snapshot os.FileInfo
+
+	// torn is set if an entry could not be appended to the journal, nor the
+	// part of it which was written removed again. Nothing more is appended
+	// after it, since the journal could not be replayed past it.
+	torn error
+
+	// compactErr is why the journal could not be compacted the last time it
+	// was tried, if it could not be.
+	compactErr error
+}
+
+// open loads the snapshot and replays the journal over it.
+func (jd *journalDal) open() error {
+	journal, err := jd.fileSystem.OpenFile(jd.journalFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, jsonFileDalFileMode)
+	if err != nil {
+		return errors.ErrStateInitialization(err)
+	}
+	jd.journal = journal
+
+	if err := jd.withLock(jd.load); err != nil {
+		journal.Close()
+		return err
+	}
+	return nil
+}
+
+// load loads the state from the snapshot and replays the whole journal over
+// it. The caller must hold the state lock, and the write lock unless the dal
+// is being opened.
+func (jd *journalDal) load() error {
+	info, err := jd.fileSystem.Stat(jd.snapshotFile)
+	if os.IsNotExist(err) {
+		info = nil
+	} else if err != nil {
+		return errors.ErrStateInitialization(err)
+	}
+
+	snapshot, err := jd.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	jd.state = snapshot.jsonFileState
+	jd.seq = snapshot.Seq
+	jd.entries = 0
+	jd.snapshot = info
+	return jd.replay(0)
+}
+
+// changed reports whether another process may have changed the state since
+// it was last read. The caller must hold the read or write lock.
+func (jd *journalDal) changed() bool {
+	if jd.torn != nil {
+		return false
+	}
+	journal, err := jd.fileSystem.Stat(jd.journalFile)
+	if err != nil || journal.Size() != jd.offset {
+		return true
+	}
+	snapshot, err := jd.fileSystem.Stat(jd.snapshotFile)
+	if os.IsNotExist(err) {
+		return jd.snapshot != nil
+	}
+	return !sameFile(snapshot, jd.snapshot)
+}
+
+// catchUp applies the changes other processes have made to the state since it
+// was last read. If one has compacted the journal, the state is loaded again
+// from the new snapshot. The caller must hold the state lock and the write
+// lock.
+//
+// Once the journal is torn, no more changes are saved, so the state is no
+// longer kept in step with the files.
+func (jd *journalDal) catchUp() error {
+	if !jd.changed() {
+		return nil
+	}
+
+	snapshot, err := jd.fileSystem.Stat(jd.snapshotFile)
+	if os.IsNotExist(err) {
+		snapshot = nil
+	} else if err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	if snapshot != nil && !sameFile(snapshot, jd.snapshot) {
+		return jd.load()
+	}
+	return jd.replay(jd.offset)
+}
+
+func (jd *journalDal) withLock(fn func() error) error {
+	if err := jd.lock.Lock(); err != nil {
+		return err
+	}
+	defer jd.lock.Unlock()
+
+	return fn()
+}
+
+func (jd *journalDal) withReadLock(fn func() error) error {
+	if err := jd.lock.RLock(); err != nil {
+		return err
+	}
+	defer jd.lock.RUnlock()
+
+	return fn()
+}
+
+// View runs fn with the read lock held, once the state has caught up with any
+// changes made by other processes. The state lock is only taken if the
+// journal or snapshot has changed.
+func (jd *journalDal) View(fn func(ReadTx) error) error {
+	jd.mutex.RLock()
+	changed := jd.changed()
+	jd.mutex.RUnlock()
+
+	if changed {
+		err := jd.withReadLock(func() error {
+			jd.mutex.Lock()
+			defer jd.mutex.Unlock()
+			return jd.catchUp()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return jd.memoryDal.View(fn)
+}
+
+// Update runs fn with the state lock and the write lock held, once the state
+// has caught up with any changes made by other processes. Its changes are
+// appended to the journal by commit.
+func (jd *journalDal) Update(fn func(WriteTx) error) error {
+	return jd.withLock(func() error {
+		jd.mutex.Lock()
+		err := jd.catchUp()
+		jd.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+
+		// Other processes cannot change the state while the state lock is
+		// held, so it is still caught up once the write lock is taken again.
+		return jd.memoryDal.Update(fn)
+	})
+}
+
+func (jd *journalDal) loadSnapshot() (journalSnapshot, error) {
+	var snapshot journalSnapshot
+
+	b, err := readFile(jd.fileSystem, jd.snapshotFile)
+	if os.IsNotExist(err) {
+		snapshot.SchemaVersion = currentSchemaVersion
+		return snapshot, nil
+	} else if err != nil {
+		return snapshot, errors.ErrStateInitialization(err)
+	}
+
+	b, err = migrateState(b, migrations)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return snapshot, errors.ErrStateCorrupt(jd.snapshotFile, err)
+	}
+	return snapshot, nil
+}
+
+// replay applies the journal entries from offset on to the state, skipping
+// any which it already has.
+//
+// A crash while appending to the journal can leave a partly written entry at
+// the end of it. That entry was never acknowledged, so it is dropped; a bad
+// entry anywhere else means the journal is corrupt.
+func (jd *journalDal) replay(offset int64) error {
+	if _, err := jd.journal.Seek(offset, io.SeekStart); err != nil {
+		return errors.ErrStateInitialization(err)
+	}
+
+	r := bufio.NewReader(jd.journal)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return jd.truncateJournal(offset)
+			}
+			return nil
+		} else if err != nil {
+			return errors.ErrStateInitialization(err)
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return errors.ErrStateCorrupt(jd.journalFile, fmt.Errorf("entry at offset %d: %s", offset, err))
+		}
+		offset += int64(len(line))
+
+		// Entries from before the snapshot are left behind if compaction is
+		// interrupted before the journal is truncated.
+		if entry.Seq > jd.seq {
+			if _, err := applyJournalEntry(&jd.state, entry); err != nil {
+				return errors.ErrStateCorrupt(jd.journalFile, err)
+			}
+			jd.seq = entry.Seq
+			jd.entries++
+		}
+		jd.offset = offset
+	}
+}
+
+// applyJournalEntry applies a mutation to the state, returning a func which
+// undoes it.
+func applyJournalEntry(s *jsonFileState, entry journalEntry) (undo func(), err error) {
+	revision := s.Revision
+	switch entry.Op {
+	case journalPutMachine:
+		if entry.Machine == nil {
+			return nil, fmt.Errorf("entry %d has no machine", entry.Seq)
+		}
+		id := entry.Machine.ID
+		i := s.machineIndex(id)
+		var previous core.Machine
+		if i >= 0 {
+			previous = s.Machines[i]
+		}
+		restoreHistory := s.saveHistory(id)
+
+		s.putMachine(*entry.Machine, entry.Time)
+		return func() {
+			if i >= 0 {
+				s.Machines[i] = previous
+			} else {
+				s.Machines = s.Machines[:len(s.Machines)-1]
+			}
+			restoreHistory()
+			s.Revision = revision
+		}, nil
+
+	case journalDeleteMachine:
+		i := s.machineIndex(entry.MachineID)
+		var previous core.Machine
+		if i >= 0 {
+			previous = s.Machines[i]
+		}
+		restoreHistory := s.saveHistory(entry.MachineID)
+
+		s.deleteMachine(entry.MachineID)
+		return func() {
+			if i >= 0 {
+				s.Machines = append(s.Machines[:i], append([]core.Machine{previous}, s.Machines[i:]...)...)
+			}
+			restoreHistory()
+		}, nil
+
+	case journalPutOperation:
+		if entry.Operation == nil {
+			return nil, fmt.Errorf("entry %d has no operation", entry.Seq)
+		}
+		// Pruning rearranges the operations in place, so they are copied.
+		operations := append([]core.Operation(nil), s.Operations...)
+
+		s.putOperation(*entry.Operation)
+		return func() {
+			s.Operations = operations
+			s.Revision = revision
+		}, nil
+
+	case journalBatch:
+		var undos []func()
+		undoAll := func() {
+			for i := len(undos) - 1; i >= 0; i-- {
+				undos[i]()
+			}
+		}
+		for _, e := range entry.Entries {
+			undo, err := applyJournalEntry(s, e)
+			if err != nil {
+				undoAll()
+				return nil, fmt.Errorf("entry %d: %s", entry.Seq, err)
+			}
+			undos = append(undos, undo)
+		}
+		return undoAll, nil
+	}
+	return nil, fmt.Errorf("entry %d has unknown op %q", entry.Seq, entry.Op)
+}
+
+// commit appends the mutations made by a transaction to the journal, and
+// flushes it to disk. The caller must hold the write lock, and the mutations
+// must already have been applied to the state.
+//
+// A transaction is written as a single line of the journal, so that it is
+// replayed either completely or not at all. If the line cannot be written and
+// flushed, the journal is truncated back to where it ended before, so that no
+// part of the line is left behind.
+func (jd *journalDal) commit(entries []journalEntry) error {
+	if jd.torn != nil {
+		return errors.ErrStatePersist(jd.torn)
+	}
+
+	entry := entries[0]
+	if len(entries) > 1 {
+		entry = journalEntry{Time: entries[0].Time, Op: journalBatch, Entries: entries}
+	}
+	entry.Seq = jd.seq + 1
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.ErrSerialization("serializing journal entry", err)
+	}
+	b = append(b, '\n')
+
+	end, err := jd.journal.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	if _, err := jd.journal.Write(b); err != nil {
+		return jd.abandon(end, err)
+	}
+	if err := jd.journal.Sync(); err != nil {
+		return jd.abandon(end, err)
+	}
+	jd.seq = entry.Seq
+	jd.entries++
+	jd.offset = end + int64(len(b))
+
+	// The transaction is durable now, so it has succeeded even if the journal
+	// cannot be compacted. Compaction is tried again on the next commit, and
+	// until it succeeds the failure is reported through Warnings.
+	if jd.entries >= jd.compactThreshold {
+		jd.compactErr = jd.compact()
+		if jd.compactErr != nil {
+			fmt.Fprintf(os.Stderr, "harkd: warning: failed to compact state journal: %s\n", jd.compactErr)
+		}
+	}
+	return nil
+}
+
+// abandon removes an entry which failed to be appended to the journal, by
+// truncating the journal back to the size it had before, and returns the
+// error the entry failed with. The truncation is flushed to disk along with
+// the next entry.
+func (jd *journalDal) abandon(size int64, err error) error {
+	if truncErr := jd.journal.Truncate(size); truncErr != nil {
+		jd.torn = fmt.Errorf("journal could not be truncated after a failed write: %s", truncErr)
+		fmt.Fprintf(os.Stderr, "harkd: error: %s; no more changes will be saved\n", jd.torn)
+	}
+	return errors.ErrStatePersist(err)
+}
+
+// compact writes the state to a new snapshot, then empties the journal. The
+// caller must hold the state lock and the write lock.
+func (jd *journalDal) compact() error {
+	snapshot := journalSnapshot{jd.state, jd.seq}
+	snapshot.SchemaVersion = currentSchemaVersion
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.ErrSerialization("serializing snapshot", err)
+	}
+	if err := fs.WriteFileAtomic(jd.fileSystem, jd.snapshotFile, b, jsonFileDalFileMode); err != nil {
+		return errors.ErrStatePersist(err)
+	}
+
+	// Other processes notice the new snapshot, and load the state from it.
+	info, err := jd.fileSystem.Stat(jd.snapshotFile)
+	if err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	jd.snapshot = info
+
+	if err := jd.truncateJournal(0); err != nil {
+		return err
+	}
+	jd.entries = 0
+	return nil
+}
+
+func (jd *journalDal) truncateJournal(size int64) error {
+	if err := jd.journal.Truncate(size); err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	if err := jd.journal.Sync(); err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	jd.offset = size
+	return nil
+}
+
+// Warnings reports a journal which could not be compacted, so that it keeps
+// growing, or which can no longer be appended to.
+func (jd *journalDal) Warnings() []string {
+	jd.mutex.RLock()
+	defer jd.mutex.RUnlock()
+
+	var warnings []string
+	if jd.compactErr != nil {
+		warnings = append(warnings, fmt.Sprintf("the state journal could not be compacted: %s", jd.compactErr))
+	}
+	if jd.torn != nil {
+		warnings = append(warnings, fmt.Sprintf("no more changes to the state can be saved: %s", jd.torn))
+	}
+	return warnings
+}
+
+// LockStats reports who holds the state lock, and how long it has taken to
+// take.
+func (jd *journalDal) LockStats() util.LockStats {
+	return jd.lock.Stats()
+}
+
+// Close closes the journal.
+func (jd *journalDal) Close() error {
+	jd.mutex.Lock()
+	defer jd.mutex.Unlock()
+
+	return jd.journal.Close()
+}
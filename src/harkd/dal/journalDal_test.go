@@ -0,0 +1,376 @@
+package dal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"harkd/core"
+	"harkd/util/fs"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tempJournalBase(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hark-journal")
+	require.NoError(t, err)
+	return filepath.Join(dir, "hark-state"), func() { os.RemoveAll(dir) }
+}
+
+func openJournalDal(t *testing.T, basename string) *journalDal {
+	d, err := OpenJournalDal(basename, 0)
+	require.NoError(t, err)
+	jd := d.(*journalDal)
+	jd.now = fixedClock
+	return jd
+}
+
+func TestJournalDalReplaysOnOpen(t *testing.T) {
+	basename, cleanup := tempJournalBase(t)
+	defer cleanup()
+
+	jd := openJournalDal(t, basename)
+	require.NoError(t, jd.SaveMachine(core.Machine{ID: "foo", MemoryMB: 512}))
+	require.NoError(t, jd.SaveMachine(core.Machine{ID: "bar"}))
+	_, err := jd.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = 1024
+		return m, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, jd.DeleteMachine("bar"))
+	require.NoError(t, jd.PutOperation(core.Operation{ID: "op", Status: core.OperationRunning}))
+	require.NoError(t, jd.Close())
+
+	jd = openJournalDal(t, basename)
+	defer jd.Close()
+
+	machines, err := jd.GetMachines()
+	require.NoError(t, err)
+	require.Equal(t, []core.Machine{{ID: "foo", MemoryMB: 1024, Revision: 3}}, machines)
+
+	op, err := jd.GetOperation("op")
+	require.NoError(t, err)
+	require.Equal(t, core.OperationRunning, op.Status)
+}
+
+func TestJournalDalWritesTransactionsWhole(t *testing.T) {
+	basename, cleanup := tempJournalBase(t)
+	defer cleanup()
+
+	jd := openJournalDal(t, basename)
+	err := jd.Update(func(tx WriteTx) error {
+		if err := tx.SaveMachine(core.Machine{ID: "a"}); err != nil {
+			return err
+		}
+		return tx.SaveMachine(core.Machine{ID: "b"})
+	})
+	require.NoError(t, err)
+	require.Error(t, jd.Update(func(tx WriteTx) error {
+		require.NoError(t, tx.SaveMachine(core.Machine{ID: "c"}))
+		return errors.New("rejected")
+	}))
+	require.NoError(t, jd.Close())
+
+	// Only the transaction which succeeded was written, as one entry.
+	journal := string(mustReadFile(t, basename+journalFileSuffix))
+	require.Equal(t, 1, strings.Count(journal, "\n"))
+	require.Contains(t, journal, `"op":"batch"`)
+
+	jd = openJournalDal(t, basename)
+	defer jd.Close()
+	machines, err := jd.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 2)
+}
+
+func TestJournalDalCompacts(t *testing.T) {
+	basename, cleanup := tempJournalBase(t)
+	defer cleanup()
+
+	jd := openJournalDal(t, basename)
+	jd.compactThreshold = 3
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, jd.SaveMachine(core.Machine{ID: id}))
+	}
+	require.NoError(t, jd.Close())
+
+	// The first three entries went into the snapshot; only the last is left
+	// in the journal.
+	snapshot := string(mustReadFile(t, basename+snapshotFileSuffix))
+	require.Equal(t, `{"schemaVersion":2,"revision":3,"machines":[{"id":"a","name":"","memoryMB":0,"driver":"","revision":1},{"id":"b","name":"","memoryMB":0,"driver":"","revision":2},{"id":"c","name":"","memoryMB":0,"driver":"","revision":3}],"history":{"a":[{"revision":1,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"a","name":"","memoryMB":0,"driver":"","revision":1},"changes":[]}],"b":[{"revision":2,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"b","name":"","memoryMB":0,"driver":"","revision":2},"changes":[]}],"c":[{"revision":3,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"c","name":"","memoryMB":0,"driver":"","revision":3},"changes":[]}]},"seq":3}`, snapshot)
+	journal := string(mustReadFile(t, basename+journalFileSuffix))
+	require.Equal(t, `{"seq":4,"time":"2017-01-02T03:04:05Z","op":"putMachine","machine":{"id":"d","name":"","memoryMB":0,"driver":"","revision":4}}`+"\n", journal)
+
+	jd = openJournalDal(t, basename)
+	defer jd.Close()
+	machines, err := jd.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 4)
+}
+
+var journalReplayTests = []struct {
+	name           string
+	snapshot       string
+	journal        string
+	expectMachines []string
+	expectJournal  string
+	valid          bool
+}{
+	{
+		"empty",
+		"", "",
+		nil, "", true,
+	},
+	{
+		"truncated last entry",
+		"",
+		`{"seq":1,"op":"putMachine","machine":{"id":"a"}}` + "\n" + `{"seq":2,"op":"putMa`,
+		[]string{"a"}, `{"seq":1,"op":"putMachine","machine":{"id":"a"}}` + "\n", true,
+	},
+	{
+		"corrupt entry before the end",
+		"",
+		`{"seq":1,"op":"putMa` + "\n" + `{"seq":2,"op":"putMachine","machine":{"id":"a"}}` + "\n",
+		nil, "", false,
+	},
+	{
+		"unknown op",
+		"",
+		`{"seq":1,"op":"explode"}` + "\n",
+		nil, "", false,
+	},
+	{
+		"entries already in the snapshot",
+		`{"schemaVersion":1,"machines":[{"id":"a"}],"seq":1}`,
+		`{"seq":1,"op":"putMachine","machine":{"id":"a"}}` + "\n" + `{"seq":2,"op":"putMachine","machine":{"id":"b"}}` + "\n",
+		[]string{"a", "b"}, "", true,
+	},
+	{
+		"transaction",
+		"",
+		`{"seq":1,"op":"batch","entries":[{"op":"putMachine","machine":{"id":"a"}},{"op":"putMachine","machine":{"id":"b"}}]}` + "\n",
+		[]string{"a", "b"}, "", true,
+	},
+	{
+		"truncated transaction",
+		"",
+		`{"seq":1,"op":"putMachine","machine":{"id":"a"}}` + "\n" + `{"seq":2,"op":"batch","entries":[{"op":"putMachine","machine":{"id":"b"}},{"op":"putMa`,
+		[]string{"a"}, `{"seq":1,"op":"putMachine","machine":{"id":"a"}}` + "\n", true,
+	},
+	{
+		"invalid entry in a transaction",
+		"",
+		`{"seq":1,"op":"batch","entries":[{"op":"putMachine","machine":{"id":"a"}},{"op":"explode"}]}` + "\n",
+		nil, "", false,
+	},
+	{
+		"unversioned snapshot",
+		`{"machines":[{"id":"a"}]}`,
+		"",
+		[]string{"a"}, "", true,
+	},
+	{
+		"snapshot from a newer harkd",
+		`{"schemaVersion":1000,"machines":[{"id":"a"}]}`,
+		"",
+		nil, "", false,
+	},
+}
+
+func TestJournalDalReplay(t *testing.T) {
+	for _, c := range journalReplayTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			basename, cleanup := tempJournalBase(t)
+			defer cleanup()
+			if c.snapshot != "" {
+				require.NoError(t, ioutil.WriteFile(basename+snapshotFileSuffix, []byte(c.snapshot), jsonFileDalFileMode))
+			}
+			require.NoError(t, ioutil.WriteFile(basename+journalFileSuffix, []byte(c.journal), jsonFileDalFileMode))
+
+			// Execute
+			d, err := OpenJournalDal(basename, 0)
+
+			// Assert
+			if !c.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer d.(*journalDal).Close()
+
+			machines, err := d.GetMachines()
+			require.NoError(t, err)
+			var ids []string
+			for _, m := range machines {
+				ids = append(ids, m.ID)
+			}
+			require.Equal(t, c.expectMachines, ids)
+
+			if c.expectJournal != "" {
+				require.Equal(t, c.expectJournal, string(mustReadFile(t, basename+journalFileSuffix)))
+			}
+		})
+	}
+}
+
+// failingFile fails to write or flush a file, after writing half of what it
+// was given.
+type failingFile struct {
+	fs.File
+	failWrite bool
+	failSync  bool
+	failTrunc bool
+}
+
+func (ff *failingFile) Write(b []byte) (int, error) {
+	if !ff.failWrite {
+		return ff.File.Write(b)
+	}
+	n, _ := ff.File.Write(b[:len(b)/2])
+	return n, errors.New("disk full")
+}
+
+func (ff *failingFile) Sync() error {
+	if ff.failSync {
+		return errors.New("i/o error")
+	}
+	return ff.File.Sync()
+}
+
+func (ff *failingFile) Truncate(size int64) error {
+	if ff.failTrunc {
+		return errors.New("i/o error")
+	}
+	return ff.File.Truncate(size)
+}
+
+func TestJournalDalFailedCommit(t *testing.T) {
+	cases := []struct {
+		name          string
+		file          failingFile
+		expectLaterOK bool
+	}{
+		{"partial write", failingFile{failWrite: true}, true},
+		{"failed sync", failingFile{failSync: true}, true},
+		{"failed truncate", failingFile{failWrite: true, failTrunc: true}, false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			basename, cleanup := tempJournalBase(t)
+			defer cleanup()
+			jd := openJournalDal(t, basename)
+			require.NoError(t, jd.SaveMachine(core.Machine{ID: "a"}))
+
+			ff := c.file
+			ff.File = jd.journal
+			jd.journal = &ff
+
+			// Execute
+			err := jd.SaveMachine(core.Machine{ID: "b"})
+			ff.failWrite, ff.failSync = false, false
+			laterErr := jd.SaveMachine(core.Machine{ID: "c"})
+			require.NoError(t, jd.Close())
+
+			// Assert: the failed entry left nothing behind in the journal, so
+			// it can still be replayed.
+			require.Error(t, err)
+			expectMachines := 1
+			if c.expectLaterOK {
+				require.NoError(t, laterErr)
+				expectMachines = 2
+			} else {
+				require.Error(t, laterErr)
+			}
+
+			jd = openJournalDal(t, basename)
+			defer jd.Close()
+			machines, err := jd.GetMachines()
+			require.NoError(t, err)
+			require.Len(t, machines, expectMachines)
+			_, err = jd.GetMachineByID("b")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestJournalDalSharedBetweenProcesses(t *testing.T) {
+	basename, cleanup := tempJournalBase(t)
+	defer cleanup()
+
+	// Prepare: two dals on the same state, as two processes would have.
+	a := openJournalDal(t, basename)
+	defer a.Close()
+	b := openJournalDal(t, basename)
+	defer b.Close()
+	b.compactThreshold = 3
+
+	// Execute & Assert: each sees what the other appends to the journal.
+	require.NoError(t, a.SaveMachine(core.Machine{ID: "a"}))
+	_, err := b.GetMachineByID("a")
+	require.NoError(t, err)
+	require.NoError(t, b.SaveMachine(core.Machine{ID: "b"}))
+	_, err = a.GetMachineByID("b")
+	require.NoError(t, err)
+
+	// b compacts the journal, so a must load the state from the snapshot.
+	require.NoError(t, b.SaveMachine(core.Machine{ID: "c"}))
+	require.Equal(t, 0, b.entries)
+	require.NoError(t, a.SaveMachine(core.Machine{ID: "d"}))
+
+	for _, d := range []*journalDal{a, b, openJournalDal(t, basename)} {
+		machines, err := d.GetMachines()
+		require.NoError(t, err)
+		require.Equal(t, []core.Machine{
+			{ID: "a", Revision: 1}, {ID: "b", Revision: 2}, {ID: "c", Revision: 3}, {ID: "d", Revision: 4},
+		}, machines)
+	}
+
+	// Neither holds the state lock between transactions.
+	require.False(t, a.LockStats().Exclusive)
+	require.False(t, b.LockStats().Exclusive)
+}
+
+// failingRenameFs fails to rename files, so that nothing can be written
+// atomically.
+type failingRenameFs struct {
+	fs.Filesystem
+	fail bool
+}
+
+func (f *failingRenameFs) Rename(oldPath, newPath string) error {
+	if f.fail {
+		return errors.New("read-only file system")
+	}
+	return f.Filesystem.Rename(oldPath, newPath)
+}
+
+func TestJournalDalReportsFailedCompaction(t *testing.T) {
+	basename, cleanup := tempJournalBase(t)
+	defer cleanup()
+
+	// Prepare
+	jd := openJournalDal(t, basename)
+	defer jd.Close()
+	jd.compactThreshold = 1
+	fileSystem := &failingRenameFs{jd.fileSystem, true}
+	jd.fileSystem = fileSystem
+
+	// Execute & Assert: the change is saved, but the failure is reported
+	// until compaction succeeds.
+	require.NoError(t, jd.SaveMachine(core.Machine{ID: "a"}))
+	warnings := jd.Warnings()
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "read-only file system")
+
+	fileSystem.fail = false
+	require.NoError(t, jd.SaveMachine(core.Machine{ID: "b"}))
+	require.Empty(t, jd.Warnings())
+}
@@ -2,8 +2,8 @@ package dal
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
+	"time"
 
 	"harkd/core"
 	"harkd/errors"
@@ -14,30 +14,88 @@ import (
 const jsonFileDalFileMode = 0644
 const lockFileSuffix = ".lock"
 
+// maxFinishedOperations is the number of finished operations kept in the
+// state. Older ones are pruned when new operations are saved.
+const maxFinishedOperations = 100
+
 // NewJSONFileDal returns a DAL which is backed by state in a simple flat JSON
-// file.
-func NewJSONFileDal(filename string) (Dal, error) {
+// file. Reads and writes wait for the state lock for lockTimeout at most, or
+// util.DefaultLockTimeout if it is zero.
+func NewJSONFileDal(filename string, lockTimeout time.Duration) (Dal, error) {
 	lockFileName := filename + lockFileSuffix
-	lock, err := util.NewLock(lockFileName)
+	lock, err := util.NewLock(lockFileName, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	jfd := &jsonFileDal{
+		filename:   filename,
+		fileSystem: fs.NewFilesystem(),
+		Lock:       lock,
+		cache:      new(stateCache),
+		now:        systemClock,
+	}
+	jfd.singleTx = singleTx{jfd}
+	return jfd, nil
+}
+
+// OpenJSONFileDal returns a DAL backed by a flat JSON file, first recovering
+// the file if it is corrupt and upgrading it to the current schema version.
+//
+// Each time the state is saved, the previous version is kept as a backup, up
+// to the given number of generations. A corrupt file is replaced with the
+// newest valid backup, and a warning is reported through Warnings.
+//
+// The file is copied to a backup before it is migrated. A file written by a
+// newer harkd, with a schema version this one does not understand, is an
+// error.
+func OpenJSONFileDal(filename string, backups int, lockTimeout time.Duration) (Dal, error) {
+	d, err := NewJSONFileDal(filename, lockTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	return &jsonFileDal{
-		filename,
-		fs.NewFilesystem(),
-		lock,
-	}, nil
+	jfd := d.(*jsonFileDal)
+	jfd.backups = backups
+	if err := jfd.open(); err != nil {
+		return nil, err
+	}
+	return jfd, nil
 }
 
 type jsonFileDal struct {
+	singleTx
+
 	filename   string
 	fileSystem fs.Filesystem
 	util.Lock
+
+	// backups is the number of backup generations kept of the state file.
+	backups int
+
+	// warnings are problems found with the state when it was opened.
+	warnings []string
+
+	// cache holds the state last read from or written to the file.
+	cache *stateCache
+
+	// now gives the time at which machines are saved, for their history.
+	now func() time.Time
 }
 
 type jsonFileState struct {
-	Machines []core.Machine `json:"machines"`
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Revision is the last revision given to an entity. Revisions are
+	// global, so that an entity never has the same revision twice, even if it
+	// is deleted and created again.
+	Revision uint64 `json:"revision,omitempty"`
+
+	Machines   []core.Machine   `json:"machines"`
+	Operations []core.Operation `json:"operations,omitempty"`
+
+	// History holds the versions kept of each machine, by machine ID.
+	History map[string][]core.MachineVersion `json:"history,omitempty"`
 }
 
 func initializeJSONFileState(fileSys fs.Filesystem, filename string) error {
@@ -52,62 +110,141 @@ func initializeJSONFileState(fileSys fs.Filesystem, filename string) error {
 	// Set up our empty state
 	var jfs jsonFileState
 
-	// Persist it
-	return saveJSONFileState(jfs, fileSys, filename)
+	// Persist it; there is nothing to back up yet.
+	return saveJSONFileState(jfs, fileSys, filename, 0)
+}
+
+func readJSONFileState(fileSys fs.Filesystem, filename string) ([]byte, error) {
+	// Make sure the state has been initialized
+	err := initializeJSONFileState(fileSys, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO(cera) - wrap this error
+	return readFile(fileSys, filename)
 }
 
 func loadJSONFileState(fileSys fs.Filesystem, filename string) (jsonFileState, error) {
 	var jfs jsonFileState
 
-	// Make sure the state has been initialized
-	err := initializeJSONFileState(fileSys, filename)
+	b, err := readJSONFileState(fileSys, filename)
 	if err != nil {
 		return jfs, err
 	}
+	return decodeJSONFileState(b)
+}
+
+// decodeJSONFileState decodes the contents of a state file. The state is
+// normally migrated when the dal is opened, but an older harkd may have
+// written it since, so it is migrated here too.
+func decodeJSONFileState(b []byte) (jsonFileState, error) {
+	var jfs jsonFileState
 
-	f, err := fileSys.Open(filename)
+	b, err := migrateState(b, migrations)
 	if err != nil {
-		// TODO(cera) - wrap this error
 		return jfs, err
 	}
-	defer f.Close()
 
-	dec := json.NewDecoder(f)
-	return jfs, dec.Decode(&jfs)
+	return jfs, json.Unmarshal(b, &jfs)
 }
 
-func saveJSONFileState(jfs jsonFileState, fileSys fs.Filesystem, filename string) error {
+// saveJSONFileState replaces the state file, keeping the given number of
+// backups of it.
+func saveJSONFileState(jfs jsonFileState, fileSys fs.Filesystem, filename string, backups int) error {
+	jfs.SchemaVersion = currentSchemaVersion
+
 	b, err := json.Marshal(jfs)
 	if err != nil {
 		return errors.ErrSerialization("serializing state", err)
 	}
 
-	if err := fileSys.WriteFile(filename, b, 0644); err != nil {
+	if err := rotateBackups(fileSys, filename, backups); err != nil {
+		return errors.ErrStatePersist(err)
+	}
+	if err := fs.WriteFileAtomic(fileSys, filename, b, jsonFileDalFileMode); err != nil {
 		return errors.ErrStatePersist(err)
 	}
 
 	return nil
 }
 
-func (jfd jsonFileDal) loadState() (jsonFileState, error) {
-	return loadJSONFileState(jfd.fileSystem, jfd.filename)
+// saveState saves the state after a transaction made the given changes. The
+// backups are only rotated by changes to machines: operations are saved
+// every time they make progress, and would soon push every backup worth
+// keeping out.
+func (jfd jsonFileDal) saveState(s jsonFileState, entries []journalEntry) error {
+	backups := 0
+	if changesMachines(entries) {
+		backups = jfd.backups
+	}
+	return saveJSONFileState(s, jfd.fileSystem, jfd.filename, backups)
 }
 
-func (jfd jsonFileDal) withState(fn func(s jsonFileState) error) error {
-	s, err := jfd.loadState()
-	if err != nil {
-		return err
+func changesMachines(entries []journalEntry) bool {
+	for _, entry := range entries {
+		if entry.Op != journalPutOperation {
+			return true
+		}
 	}
-
-	return fn(s)
+	return false
 }
 
-func (jfd jsonFileDal) withStateLock(fn func(s jsonFileState) error) error {
+// open checks the state file when the dal is opened. A corrupt file is
+// recovered from its backups, then the file is migrated to the current schema
+// version, keeping a copy of it as it was.
+func (jfd *jsonFileDal) open() error {
 	return jfd.withLock(func() error {
-		return jfd.withState(fn)
+		b, err := readJSONFileState(jfd.fileSystem, jfd.filename)
+		if err != nil {
+			return err
+		}
+
+		// A file from a newer harkd is not corrupt, and must not be replaced
+		// with an older backup.
+		version, err := schemaVersionOf(b)
+		if err == nil && version > currentSchemaVersion {
+			return errors.ErrStateVersionUnsupported(version, currentSchemaVersion)
+		}
+
+		if _, err := decodeJSONFileState(b); err != nil {
+			b, err = jfd.recoverState(err)
+			if err != nil {
+				return err
+			}
+			if version, err = schemaVersionOf(b); err != nil {
+				return errors.ErrStateInitialization(err)
+			}
+		}
+
+		if version == currentSchemaVersion {
+			return nil
+		}
+
+		migrated, err := migrateState(b, migrations)
+		if err != nil {
+			return err
+		}
+
+		if err := jfd.fileSystem.WriteFile(preMigrationBackupPath(jfd.filename, version), b, jsonFileDalFileMode); err != nil {
+			return errors.ErrStatePersist(err)
+		}
+		if err := fs.WriteFileAtomic(jfd.fileSystem, jfd.filename, migrated, jsonFileDalFileMode); err != nil {
+			return errors.ErrStatePersist(err)
+		}
+		return nil
 	})
 }
 
+// Warnings reports problems found with the state when the dal was opened.
+func (jfd jsonFileDal) Warnings() []string {
+	return jfd.warnings
+}
+
+func (jfd jsonFileDal) loadState() (jsonFileState, error) {
+	return loadJSONFileState(jfd.fileSystem, jfd.filename)
+}
+
 func (jfd jsonFileDal) withLock(fn func() error) error {
 	err := jfd.Lock.Lock()
 	if err != nil {
@@ -118,41 +255,196 @@ func (jfd jsonFileDal) withLock(fn func() error) error {
 	return fn()
 }
 
-func (jfd jsonFileDal) GetMachines() (machines []core.Machine, err error) {
-	err = jfd.withState(func(s jsonFileState) error {
-		machines = s.Machines
+func (jfd jsonFileDal) withReadLock(fn func() error) error {
+	err := jfd.Lock.RLock()
+	if err != nil {
+		return err
+	}
+	defer jfd.Lock.RUnlock()
+
+	return fn()
+}
+
+// View runs fn on the state as it was last saved. The state is only read from
+// the file, with the state lock shared, if it has changed since it was cached.
+// fn reads a state which is never changed, so no lock is held while it runs: a
+// View alongside an Update sees the state from before the Update.
+func (jfd jsonFileDal) View(fn func(ReadTx) error) error {
+	s := jfd.cache.cached(jfd.fileSystem, jfd.filename)
+	if s == nil {
+		err := jfd.withReadLock(func() (err error) {
+			s, err = jfd.cache.get(jfd.fileSystem, jfd.filename, jfd.loadState)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return fn(readTx{s})
+}
+
+// StateFile is the file the state is kept in.
+func (jfd jsonFileDal) StateFile() string {
+	return jfd.filename
+}
+
+// Reload reloads the state if the file has been changed other than through
+// this dal, and reports whether it has been since Reload last reported it.
+// Changes made through the dal are saved to the cache as well as to the file,
+// so they are not reported. A change is reported even if a read or write
+// through the dal reloaded the state first.
+func (jfd jsonFileDal) Reload() (changed bool, err error) {
+	err = jfd.withReadLock(func() error {
+		jfd.cache.mutex.Lock()
+		defer jfd.cache.mutex.Unlock()
+
+		if err := jfd.cache.refresh(jfd.fileSystem, jfd.filename, jfd.loadState); err != nil {
+			return err
+		}
+		changed = jfd.cache.takeModified()
 		return nil
 	})
-	return machines, err
+	return changed, err
 }
 
-func (jfd jsonFileDal) GetMachineByID(machineID string) (core.Machine, error) {
-	machines, err := jfd.GetMachines()
-	if err != nil {
-		return core.Machine{}, err
+// LockStats reports who holds the state lock, and how long it has taken to
+// take.
+func (jfd jsonFileDal) LockStats() util.LockStats {
+	return jfd.Lock.Stats()
+}
+
+// Update runs fn on a copy of the state with the state lock held, then saves
+// the copy back to the file if fn changed it. If fn fails, or panics, the
+// copy is dropped, so none of its changes are seen.
+func (jfd jsonFileDal) Update(fn func(WriteTx) error) error {
+	// get a file lock so that we do not race with other processes or goroutines
+	return jfd.withLock(func() error {
+		current, err := jfd.cache.get(jfd.fileSystem, jfd.filename, jfd.loadState)
+		if err != nil {
+			return err
+		}
+
+		s := current.clone()
+		tx := newWriteTx(s, jfd.now)
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if len(tx.entries) == 0 {
+			return nil
+		}
+
+		// Save the state back to the file
+		if err := jfd.saveState(*s, tx.entries); err != nil {
+			jfd.cache.drop()
+			return err
+		}
+		jfd.cache.put(jfd.fileSystem, jfd.filename, s)
+		return nil
+	})
+}
+
+// clone copies the state, so that the copy can be changed without changing
+// the original.
+func (s *jsonFileState) clone() *jsonFileState {
+	c := *s
+	if s.Machines != nil {
+		c.Machines = append([]core.Machine{}, s.Machines...)
 	}
-	for _, m := range machines {
-		if m.ID == machineID {
-			return m, nil
+	if s.Operations != nil {
+		c.Operations = append([]core.Operation{}, s.Operations...)
+	}
+	if s.History != nil {
+		c.History = make(map[string][]core.MachineVersion, len(s.History))
+		for id, versions := range s.History {
+			c.History[id] = append([]core.MachineVersion{}, versions...)
 		}
 	}
-	return core.Machine{}, errors.ErrMachineNotFound(machineID)
+	return &c
 }
 
-func (jfd jsonFileDal) SaveMachine(machine core.Machine) error {
-	// get a file lock so that we do not race with other processes or goroutines
-	return jfd.withStateLock(func(s jsonFileState) error {
-		// First, make sure this ID does not exist already
-		for _, m := range s.Machines {
-			if m.ID == machine.ID {
-				return errors.ErrEntityConflict(fmt.Sprintf("already have machine with id %q", m.ID))
-			}
+// machineIndex finds the index of the machine with the given ID, or -1 if
+// there is none.
+func (s *jsonFileState) machineIndex(machineID string) int {
+	for i, m := range s.Machines {
+		if m.ID == machineID {
+			return i
 		}
+	}
+	return -1
+}
 
-		// Add this machine to the state
+// nextRevision is the revision to give the next entity saved.
+func (s *jsonFileState) nextRevision() uint64 {
+	return s.Revision + 1
+}
+
+// observeRevision records that an entity has been given a revision.
+func (s *jsonFileState) observeRevision(revision uint64) {
+	if revision > s.Revision {
+		s.Revision = revision
+	}
+}
+
+// putMachine adds a machine to the state, or replaces the existing one with
+// the same ID, and adds it to the machine's history.
+func (s *jsonFileState) putMachine(machine core.Machine, savedAt time.Time) {
+	if i := s.machineIndex(machine.ID); i >= 0 {
+		previous := s.Machines[i]
+		s.Machines[i] = machine
+		s.recordVersion(machine, &previous, savedAt)
+	} else {
 		s.Machines = append(s.Machines, machine)
+		s.recordVersion(machine, nil, savedAt)
+	}
+	s.observeRevision(machine.Revision)
+}
 
-		// Save the state back to the file
-		return saveJSONFileState(s, jfd.fileSystem, jfd.filename)
-	})
+// deleteMachine removes the machine with the given ID, and its history, from
+// the state, if there is one.
+func (s *jsonFileState) deleteMachine(machineID string) {
+	if i := s.machineIndex(machineID); i >= 0 {
+		s.Machines = append(s.Machines[:i], s.Machines[i+1:]...)
+	}
+	delete(s.History, machineID)
+}
+
+// putOperation adds an operation to the state, or replaces the existing one
+// with the same ID, then prunes old operations.
+func (s *jsonFileState) putOperation(operation core.Operation) {
+	replaced := false
+	for i, o := range s.Operations {
+		if o.ID == operation.ID {
+			s.Operations[i] = operation
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.Operations = append(s.Operations, operation)
+	}
+	s.observeRevision(operation.Revision)
+
+	s.Operations = pruneOperations(s.Operations)
+}
+
+// pruneOperations drops the oldest finished operations so that at most
+// maxFinishedOperations remain. Operations are kept in the order they were
+// created, so the oldest are first.
+func pruneOperations(operations []core.Operation) []core.Operation {
+	finished := 0
+	for _, o := range operations {
+		if o.Status.Finished() {
+			finished++
+		}
+	}
+
+	pruned := operations[:0]
+	for _, o := range operations {
+		if o.Status.Finished() && finished > maxFinishedOperations {
+			finished--
+			continue
+		}
+		pruned = append(pruned, o)
+	}
+	return pruned
 }
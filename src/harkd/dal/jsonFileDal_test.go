@@ -2,7 +2,10 @@ package dal
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"harkd/core"
 	"harkd/test/fixtures"
@@ -12,14 +15,19 @@ import (
 
 const fakeDalPath = "/tmp/hark"
 
+func fixedClock() time.Time {
+	return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+}
+
 func getMockDal(t *testing.T) (Dal, *fixtures.FsFixture) {
 	// Construct a DAL
-	dal, err := NewJSONFileDal(fakeDalPath)
+	dal, err := NewJSONFileDal(fakeDalPath, 0)
 	require.NoError(t, err)
 
-	// Inject a mock filesystem
+	// Inject a mock filesystem and a fixed clock
 	fs := fixtures.NewFsFixture()
 	dal.(*jsonFileDal).fileSystem = fs
+	dal.(*jsonFileDal).now = fixedClock
 
 	return dal, fs
 }
@@ -107,7 +115,7 @@ var saveMachineTests = []struct {
 	stateAfter  string
 	valid       bool
 }{
-	{"adding the first machine", "{}", core.Machine{ID: "foo"}, `{"machines":[{"id":"foo","name":"","memoryMB":0}]}`, true},
+	{"adding the first machine", "{}", core.Machine{ID: "foo"}, `{"schemaVersion":2,"revision":1,"machines":[{"id":"foo","name":"","memoryMB":0,"driver":"","revision":1}],"history":{"foo":[{"revision":1,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"foo","name":"","memoryMB":0,"driver":"","revision":1},"changes":[]}]}}`, true},
 	{"adding machine with invalid existing state: 1", "[]", core.Machine{ID: "foo"}, "", false},
 	{"adding machine with invalid existing state: 2", "abcd", core.Machine{ID: "foo"}, "", false},
 	{"duplicate machine", `{"machines":[{"id":"foo"}]}`, core.Machine{ID: "foo"}, "", false},
@@ -136,3 +144,108 @@ func TestJSONFileDalSaveMachine(t *testing.T) {
 		})
 	}
 }
+
+var deleteMachineTests = []struct {
+	name        string
+	stateBefore string
+	machineId   string
+	stateAfter  string
+	valid       bool
+}{
+	{"deleting the only machine", `{"schemaVersion":2,"machines":[{"id":"foo"}]}`, "foo", `{"schemaVersion":2,"machines":[]}`, true},
+	{"deleting one of several machines", `{"schemaVersion":2,"machines":[{"id":"foo"},{"id":"bar"}]}`, "foo", `{"schemaVersion":2,"machines":[{"id":"bar","name":"","memoryMB":0,"driver":"","revision":0}]}`, true},
+	{"machine does not exist", `{"machines":[{"id":"foo"}]}`, "bar", "", false},
+	{"empty state", "{}", "foo", "", false},
+	{"invalid existing state", "abcd", "foo", "", false},
+}
+
+func TestJSONFileDalDeleteMachine(t *testing.T) {
+	for _, c := range deleteMachineTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			dal, fs := getMockDal(t)
+			buf := bytes.NewBuffer([]byte(c.stateBefore))
+			fs.MockOpen.WillReturn = fixtures.NewNopCloser(buf)
+
+			// Execute
+			err := dal.DeleteMachine(c.machineId)
+
+			// Assert
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			require.Equal(t, c.stateAfter, string(fs.MockWriteFile.CalledWithData))
+		})
+	}
+}
+
+func setMemory(memoryMB uint) func(core.Machine) (core.Machine, error) {
+	return func(m core.Machine) (core.Machine, error) {
+		m.MemoryMB = memoryMB
+		return m, nil
+	}
+}
+
+func failUpdate(m core.Machine) (core.Machine, error) {
+	return m, errors.New("update rejected")
+}
+
+var updateMachineTests = []struct {
+	name          string
+	stateBefore   string
+	machineId     string
+	update        func(core.Machine) (core.Machine, error)
+	expectMachine core.Machine
+	stateAfter    string
+	valid         bool
+}{
+	{"updating the only machine", `{"schemaVersion":2,"machines":[{"id":"foo"}]}`, "foo", setMemory(512), core.Machine{ID: "foo", MemoryMB: 512, Revision: 1}, `{"schemaVersion":2,"revision":1,"machines":[{"id":"foo","name":"","memoryMB":512,"driver":"","revision":1}],"history":{"foo":[{"revision":1,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"foo","name":"","memoryMB":512,"driver":"","revision":1},"changes":[{"field":"memoryMB","from":0,"to":512}]}]}}`, true},
+	{"updating one of several machines", `{"schemaVersion":2,"machines":[{"id":"foo"},{"id":"bar"}]}`, "bar", setMemory(256), core.Machine{ID: "bar", MemoryMB: 256, Revision: 1}, `{"schemaVersion":2,"revision":1,"machines":[{"id":"foo","name":"","memoryMB":0,"driver":"","revision":0},{"id":"bar","name":"","memoryMB":256,"driver":"","revision":1}],"history":{"bar":[{"revision":1,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"bar","name":"","memoryMB":256,"driver":"","revision":1},"changes":[{"field":"memoryMB","from":0,"to":256}]}]}}`, true},
+	{"machine does not exist", `{"machines":[{"id":"foo"}]}`, "bar", setMemory(512), core.Machine{}, "", false},
+	{"update rejected", `{"machines":[{"id":"foo"}]}`, "foo", failUpdate, core.Machine{ID: "foo"}, "", false},
+	{"invalid existing state", "abcd", "foo", setMemory(512), core.Machine{}, "", false},
+}
+
+func TestJSONFileDalUpdateMachine(t *testing.T) {
+	for _, c := range updateMachineTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			dal, fs := getMockDal(t)
+			buf := bytes.NewBuffer([]byte(c.stateBefore))
+			fs.MockOpen.WillReturn = fixtures.NewNopCloser(buf)
+
+			// Execute
+			machine, err := dal.UpdateMachine(c.machineId, c.update)
+
+			// Assert
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			require.Equal(t, c.expectMachine, machine)
+			require.Equal(t, c.stateAfter, string(fs.MockWriteFile.CalledWithData))
+		})
+	}
+}
+
+func TestPruneOperations(t *testing.T) {
+	var operations []core.Operation
+	for i := 0; i < maxFinishedOperations+10; i++ {
+		operations = append(operations, core.Operation{ID: fmt.Sprintf("finished-%d", i), Status: core.OperationSucceeded})
+	}
+	operations = append(operations[:5], append([]core.Operation{{ID: "running", Status: core.OperationRunning}}, operations[5:]...)...)
+
+	pruned := pruneOperations(operations)
+
+	require.Len(t, pruned, maxFinishedOperations+1)
+	require.Equal(t, "running", pruned[0].ID)
+	require.Equal(t, "finished-10", pruned[1].ID)
+	require.Equal(t, fmt.Sprintf("finished-%d", maxFinishedOperations+9), pruned[len(pruned)-1].ID)
+}
@@ -0,0 +1,71 @@
+package dal
+
+import (
+	"sync"
+	"time"
+)
+
+// NewMemoryDal returns a DAL which only keeps the state in memory. It starts
+// empty, and its state is lost when the process exits, which makes it useful
+// for tests and for embedding hark.
+func NewMemoryDal() Dal {
+	return newMemoryDal()
+}
+
+func newMemoryDal() *memoryDal {
+	md := &memoryDal{now: systemClock}
+	md.singleTx = singleTx{md}
+	return md
+}
+
+// memoryDal keeps the state in memory.
+//
+// Each transaction changes the state in place while the write lock is held,
+// then passes the journal entries describing its changes to commit. On its
+// own, a memoryDal has nothing more to do; a dal which persists the state can
+// embed one and record the entries durably in commit. If commit fails, the
+// changes are undone.
+type memoryDal struct {
+	singleTx
+
+	mutex  sync.RWMutex
+	state  jsonFileState
+	commit func([]journalEntry) error
+
+	// now gives the time at which each mutation is made.
+	now func() time.Time
+}
+
+// View runs fn with the read lock held.
+func (md *memoryDal) View(fn func(ReadTx) error) error {
+	md.mutex.RLock()
+	defer md.mutex.RUnlock()
+
+	return fn(readTx{&md.state})
+}
+
+// Update runs fn with the write lock held. If fn returns an error or panics,
+// or its changes cannot be committed, none of its changes are kept.
+func (md *memoryDal) Update(fn func(WriteTx) error) error {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	tx := newWriteTx(&md.state, md.now)
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.entries) > 0 && md.commit != nil {
+		if err := md.commit(tx.entries); err != nil {
+			return err
+		}
+	}
+	committed = true
+	return nil
+}
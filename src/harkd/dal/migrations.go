@@ -0,0 +1,89 @@
+package dal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"harkd/errors"
+)
+
+// rawState is the state as generic JSON, which migrations work on. Numbers are
+// kept as json.Number so that they survive a migration unchanged.
+type rawState map[string]interface{}
+
+// migration upgrades the state from one schema version to the next.
+//
+// Migrations work on raw JSON rather than on jsonFileState, because the types
+// in core describe the current schema, not the one being migrated from.
+type migration struct {
+	description string
+	apply       func(rawState) error
+}
+
+// migrations is the ordered chain of migrations: migrations[i] upgrades a
+// state of schema version i to version i+1. State files written before
+// versioning was introduced have no schemaVersion, and are version 0.
+//
+// Migrations must only ever be appended to this list.
+var migrations = []migration{
+	{"introduce schemaVersion", func(rawState) error { return nil }},
+	{"seed machine history", seedMachineHistory},
+}
+
+// currentSchemaVersion is the schema version this harkd reads and writes.
+var currentSchemaVersion = len(migrations)
+
+const schemaVersionKey = "schemaVersion"
+
+// schemaVersionOf reads the schema version of raw state JSON.
+func schemaVersionOf(b []byte) (int, error) {
+	var versioned struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(b, &versioned); err != nil {
+		return 0, err
+	}
+	return versioned.SchemaVersion, nil
+}
+
+// migrateState upgrades raw state JSON to the end of a migration chain. State
+// which is already up to date is returned as it is; state from a newer schema
+// than the chain knows about is refused.
+func migrateState(b []byte, chain []migration) ([]byte, error) {
+	version, err := schemaVersionOf(b)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(chain) {
+		return nil, errors.ErrStateVersionUnsupported(version, len(chain))
+	}
+	if version == len(chain) {
+		return b, nil
+	}
+
+	var state rawState
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = rawState{}
+	}
+
+	for v := version; v < len(chain); v++ {
+		if err := chain[v].apply(state); err != nil {
+			return nil, errors.ErrStateMigration(v, v+1, fmt.Errorf("%s: %s", chain[v].description, err))
+		}
+		state[schemaVersionKey] = v + 1
+	}
+
+	return json.Marshal(state)
+}
+
+// preMigrationBackupPath is where a state file is copied before it is
+// migrated from the given schema version.
+func preMigrationBackupPath(filename string, version int) string {
+	return fmt.Sprintf("%s.schema-v%d.bak", filename, version)
+}
@@ -0,0 +1,157 @@
+package dal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"harkd/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMigrations renames the "machines" key in version 0 to "vms" in version
+// 1, then counts them in version 2.
+var testMigrations = []migration{
+	{"rename machines", func(s rawState) error {
+		s["vms"] = s["machines"]
+		delete(s, "machines")
+		return nil
+	}},
+	{"count vms", func(s rawState) error {
+		vms, _ := s["vms"].([]interface{})
+		s["count"] = len(vms)
+		return nil
+	}},
+}
+
+var migrateStateTests = []struct {
+	name   string
+	chain  []migration
+	state  string
+	expect string
+	valid  bool
+}{
+	{"unversioned", testMigrations, `{"machines":[{"id":"foo","memoryMB":512}]}`, `{"count":1,"schemaVersion":2,"vms":[{"id":"foo","memoryMB":512}]}`, true},
+	{"part way", testMigrations, `{"schemaVersion":1,"vms":[]}`, `{"count":0,"schemaVersion":2,"vms":[]}`, true},
+	{"up to date", testMigrations, `{"schemaVersion":2,"vms":[],"count":0}`, `{"schemaVersion":2,"vms":[],"count":0}`, true},
+	{"empty", testMigrations, `{}`, `{"count":0,"schemaVersion":2,"vms":null}`, true},
+	{"too new", testMigrations, `{"schemaVersion":3}`, "", false},
+	{"invalid json", testMigrations, `{"schemaVersion":`, "", false},
+	{"invalid version", testMigrations, `{"schemaVersion":"1"}`, "", false},
+	{"failed migration", []migration{{"fail", func(rawState) error { return errors.New("nope") }}}, `{}`, "", false},
+}
+
+func TestMigrateState(t *testing.T) {
+	for _, c := range migrateStateTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			migrated, err := migrateState([]byte(c.state), c.chain)
+
+			if c.valid {
+				require.NoError(t, err)
+				require.Equal(t, c.expect, string(migrated))
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func tempStateFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "hark-dal")
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, "hark-state.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(contents), jsonFileDalFileMode))
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestOpenJSONFileDalMigrates(t *testing.T) {
+	const unversioned = `{"machines":[{"id":"foo","name":"Foo","memoryMB":512}]}`
+	filename, cleanup := tempStateFile(t, unversioned)
+	defer cleanup()
+
+	d, err := OpenJSONFileDal(filename, 0, 0)
+	require.NoError(t, err)
+
+	// The original file is backed up...
+	backup, err := ioutil.ReadFile(preMigrationBackupPath(filename, 0))
+	require.NoError(t, err)
+	require.Equal(t, unversioned, string(backup))
+
+	// ...and replaced with the migrated state.
+	version, err := schemaVersionOf(mustReadFile(t, filename))
+	require.NoError(t, err)
+	require.Equal(t, currentSchemaVersion, version)
+
+	m, err := d.GetMachineByID("foo")
+	require.NoError(t, err)
+	require.Equal(t, uint(512), m.MemoryMB)
+}
+
+func TestOpenJSONFileDalUpToDate(t *testing.T) {
+	filename, cleanup := tempStateFile(t, `{"schemaVersion":2,"machines":[]}`)
+	defer cleanup()
+
+	_, err := OpenJSONFileDal(filename, 0, 0)
+	require.NoError(t, err)
+
+	_, err = os.Stat(preMigrationBackupPath(filename, 2))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOpenJSONFileDalRefusesNewerState(t *testing.T) {
+	const newer = `{"schemaVersion":1000,"machines":[]}`
+	filename, cleanup := tempStateFile(t, newer)
+	defer cleanup()
+
+	_, err := OpenJSONFileDal(filename, 0, 0)
+	require.Error(t, err)
+
+	// The file is left alone for the newer harkd.
+	require.Equal(t, newer, string(mustReadFile(t, filename)))
+}
+
+func mustReadFile(t *testing.T, filename string) []byte {
+	b, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	return b
+}
+
+func TestOpenJSONFileDalSeedsMachineHistory(t *testing.T) {
+	// Prepare: foo was saved before history was kept, and bar after.
+	const v1 = `{"schemaVersion":1,"revision":3,"machines":[` +
+		`{"id":"foo","name":"foo","memoryMB":512,"revision":1},` +
+		`{"id":"bar","name":"bar","memoryMB":256,"revision":3}],` +
+		`"history":{"bar":[{"revision":2,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"bar","name":"bar","memoryMB":128,"revision":2},"changes":[]},` +
+		`{"revision":3,"savedAt":"2017-01-02T03:04:05Z","machine":{"id":"bar","name":"bar","memoryMB":256,"revision":3},"changes":[{"field":"memoryMB","from":128,"to":256}]}]}}`
+	filename, cleanup := tempStateFile(t, v1)
+	defer cleanup()
+
+	// Execute
+	d, err := OpenJSONFileDal(filename, 0, 0)
+	require.NoError(t, err)
+
+	// Assert: foo's definition is kept as its first version.
+	foo, err := d.GetMachineHistory("foo")
+	require.NoError(t, err)
+	require.Len(t, foo, 1)
+	require.Equal(t, core.Machine{ID: "foo", Name: "foo", MemoryMB: 512, Revision: 1}, foo[0].Machine)
+	require.Equal(t, uint64(1), foo[0].Revision)
+	require.Empty(t, foo[0].Changes)
+	require.False(t, foo[0].SavedAt.IsZero())
+
+	bar, err := d.GetMachineHistory("bar")
+	require.NoError(t, err)
+	require.Len(t, bar, 2)
+	require.Equal(t, uint(128), bar[0].Machine.MemoryMB)
+
+	// The seeded history is saved with the migrated state.
+	version, err := schemaVersionOf(mustReadFile(t, filename))
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	require.Contains(t, string(mustReadFile(t, filename)), `"foo":[{`)
+}
@@ -0,0 +1,223 @@
+package dal
+
+import (
+	"fmt"
+	"time"
+
+	"harkd/core"
+	"harkd/errors"
+)
+
+// ReadTx reads the state within a transaction. Every read in a transaction
+// sees the same state.
+type ReadTx interface {
+	GetMachines() ([]core.Machine, error)
+	GetMachineByID(string) (core.Machine, error)
+	GetMachineHistory(string) ([]core.MachineVersion, error)
+
+	GetOperations() ([]core.Operation, error)
+	GetOperation(string) (core.Operation, error)
+}
+
+// WriteTx reads and changes the state within a transaction. Reads see the
+// changes already made in the transaction.
+type WriteTx interface {
+	ReadTx
+
+	SaveMachine(core.Machine) error
+	UpdateMachine(string, func(core.Machine) (core.Machine, error)) (core.Machine, error)
+	DeleteMachine(string) error
+
+	PutOperation(core.Operation) error
+}
+
+// readTx reads a state.
+type readTx struct {
+	state *jsonFileState
+}
+
+func (tx readTx) GetMachines() ([]core.Machine, error) {
+	if tx.state.Machines == nil {
+		return nil, nil
+	}
+	return append([]core.Machine{}, tx.state.Machines...), nil
+}
+
+func (tx readTx) GetMachineByID(machineID string) (core.Machine, error) {
+	if i := tx.state.machineIndex(machineID); i >= 0 {
+		return tx.state.Machines[i], nil
+	}
+	return core.Machine{}, errors.ErrMachineNotFound(machineID)
+}
+
+func (tx readTx) GetMachineHistory(machineID string) ([]core.MachineVersion, error) {
+	if tx.state.machineIndex(machineID) < 0 {
+		return nil, errors.ErrMachineNotFound(machineID)
+	}
+	return tx.state.machineHistory(machineID), nil
+}
+
+func (tx readTx) GetOperations() ([]core.Operation, error) {
+	if tx.state.Operations == nil {
+		return nil, nil
+	}
+	return append([]core.Operation{}, tx.state.Operations...), nil
+}
+
+func (tx readTx) GetOperation(operationID string) (core.Operation, error) {
+	for _, o := range tx.state.Operations {
+		if o.ID == operationID {
+			return o, nil
+		}
+	}
+	return core.Operation{}, errors.ErrOperationNotFound(operationID)
+}
+
+// writeTx changes a state in place. Each change is described as a journal
+// entry, and can be undone until the transaction is over.
+type writeTx struct {
+	readTx
+	now func() time.Time
+
+	entries []journalEntry
+	undo    []func()
+}
+
+func newWriteTx(state *jsonFileState, now func() time.Time) *writeTx {
+	return &writeTx{readTx: readTx{state}, now: now}
+}
+
+func (tx *writeTx) SaveMachine(machine core.Machine) error {
+	if tx.state.machineIndex(machine.ID) >= 0 {
+		return errors.ErrEntityConflict(fmt.Sprintf("already have machine with id %q", machine.ID))
+	}
+	machine.Revision = tx.state.nextRevision()
+	return tx.apply(journalEntry{Time: tx.now(), Op: journalPutMachine, Machine: &machine})
+}
+
+// UpdateMachine applies fn to the machine with the given ID and saves the
+// result. fn can veto the update by returning an error.
+func (tx *writeTx) UpdateMachine(machineID string, fn func(core.Machine) (core.Machine, error)) (core.Machine, error) {
+	i := tx.state.machineIndex(machineID)
+	if i < 0 {
+		return core.Machine{}, errors.ErrMachineNotFound(machineID)
+	}
+
+	updated, err := fn(tx.state.Machines[i])
+	if err != nil {
+		return updated, err
+	}
+	if updated.ID != machineID {
+		return updated, errors.ErrValidation([]errors.Violation{{Field: "/id", Reason: errors.ReasonImmutable, Message: "machine id cannot be changed"}})
+	}
+	updated.Revision = tx.state.nextRevision()
+	return updated, tx.apply(journalEntry{Time: tx.now(), Op: journalPutMachine, Machine: &updated})
+}
+
+func (tx *writeTx) DeleteMachine(machineID string) error {
+	if tx.state.machineIndex(machineID) < 0 {
+		return errors.ErrMachineNotFound(machineID)
+	}
+	return tx.apply(journalEntry{Time: tx.now(), Op: journalDeleteMachine, MachineID: machineID})
+}
+
+func (tx *writeTx) PutOperation(operation core.Operation) error {
+	operation.Revision = tx.state.nextRevision()
+	return tx.apply(journalEntry{Time: tx.now(), Op: journalPutOperation, Operation: &operation})
+}
+
+func (tx *writeTx) apply(entry journalEntry) error {
+	undo, err := applyJournalEntry(tx.state, entry)
+	if err != nil {
+		return err
+	}
+	tx.entries = append(tx.entries, entry)
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// rollback undoes the changes made in the transaction, latest first.
+func (tx *writeTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.entries, tx.undo = nil, nil
+}
+
+// transactor is a Dal's View and Update.
+type transactor interface {
+	View(func(ReadTx) error) error
+	Update(func(WriteTx) error) error
+}
+
+// singleTx implements the rest of Dal on top of View and Update, running each
+// call in a transaction of its own.
+type singleTx struct {
+	transactor
+}
+
+func (d singleTx) GetMachines() (machines []core.Machine, err error) {
+	err = d.View(func(tx ReadTx) error {
+		machines, err = tx.GetMachines()
+		return err
+	})
+	return machines, err
+}
+
+func (d singleTx) GetMachineByID(machineID string) (machine core.Machine, err error) {
+	err = d.View(func(tx ReadTx) error {
+		machine, err = tx.GetMachineByID(machineID)
+		return err
+	})
+	return machine, err
+}
+
+func (d singleTx) GetMachineHistory(machineID string) (history []core.MachineVersion, err error) {
+	err = d.View(func(tx ReadTx) error {
+		history, err = tx.GetMachineHistory(machineID)
+		return err
+	})
+	return history, err
+}
+
+func (d singleTx) SaveMachine(machine core.Machine) error {
+	return d.Update(func(tx WriteTx) error {
+		return tx.SaveMachine(machine)
+	})
+}
+
+func (d singleTx) UpdateMachine(machineID string, fn func(core.Machine) (core.Machine, error)) (updated core.Machine, err error) {
+	err = d.Update(func(tx WriteTx) error {
+		updated, err = tx.UpdateMachine(machineID, fn)
+		return err
+	})
+	return updated, err
+}
+
+func (d singleTx) DeleteMachine(machineID string) error {
+	return d.Update(func(tx WriteTx) error {
+		return tx.DeleteMachine(machineID)
+	})
+}
+
+func (d singleTx) GetOperations() (operations []core.Operation, err error) {
+	err = d.View(func(tx ReadTx) error {
+		operations, err = tx.GetOperations()
+		return err
+	})
+	return operations, err
+}
+
+func (d singleTx) GetOperation(operationID string) (operation core.Operation, err error) {
+	err = d.View(func(tx ReadTx) error {
+		operation, err = tx.GetOperation(operationID)
+		return err
+	})
+	return operation, err
+}
+
+func (d singleTx) PutOperation(operation core.Operation) error {
+	return d.Update(func(tx WriteTx) error {
+		return tx.PutOperation(operation)
+	})
+}
@@ -1,9 +1,48 @@
 package driver
 
 import (
+	"harkd/core"
+	"harkd/events"
 	"harkd/util/command"
 )
 
+// DefaultDriver is the name of the driver used for machines which do not
+// specify one.
+const DefaultDriver = "virtualbox"
+
+// Driver manages the VMs backing hark machines using a particular
+// virtualization backend.
+type Driver interface {
+	Info() Info
+
+	Create(core.Machine) error
+	Modify(core.Machine) error
+	Start(core.Machine) error
+	Stop(m core.Machine, force bool) error
+	Restart(core.Machine) error
+	Pause(core.Machine) error
+	Resume(core.Machine) error
+	Save(core.Machine) error
+	Destroy(core.Machine) error
+
+	Status(core.Machine) (core.MachineState, error)
+	Inspect(core.Machine) (core.RuntimeInfo, error)
+
+	// ListMachineIDs lists the IDs of the machines which have a VM in the
+	// driver's backend, whether or not hark still knows about them.
+	ListMachineIDs() ([]string, error)
+}
+
+// Config is passed to a driver's Constructor, and holds everything a driver
+// needs to talk to its backend.
+type Config struct {
+	Runner command.Runner
+
+	// Events is where the driver publishes changes to the state of the VMs it
+	// manages. It may be nil.
+	Events events.Publisher
+}
+
 // Info is information about a particular driver.
 type Info struct {
 	DriverName          string `json:"driverName"`
@@ -14,9 +53,12 @@ type Info struct {
 }
 
 // GetDriverInfo returns information on every Driver supported by hark.
-func GetDriverInfo(runner command.Runner) []Info {
-	vb := virtualbox{runner}
-	return []Info{
-		{"virtualbox", vb.available(), vb.installed(), vb.healthy(), vb.version()},
+func GetDriverInfo(cfg Config) []Info {
+	names := Names()
+	infos := make([]Info, 0, len(names))
+	for _, name := range names {
+		d, _ := Lookup(name, cfg)
+		infos = append(infos, d.Info())
 	}
+	return infos
 }
@@ -0,0 +1,257 @@
+// Package drivertest provides a fake driver.Driver, for testing the code which
+// manages machines through a driver without a real virtualization backend.
+package drivertest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"harkd/core"
+	"harkd/driver"
+)
+
+// Name is the name the fake driver is registered under.
+const Name = "fake"
+
+var (
+	once    sync.Once
+	mutex   sync.Mutex
+	current *Backend
+)
+
+// Install registers the fake driver, if it is not already, and gives it a new,
+// empty Backend. Machines whose driver is Name are managed by it until Install
+// is called again.
+func Install() *Backend {
+	once.Do(func() {
+		driver.Register(Name, func(driver.Config) driver.Driver {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return fake{current}
+		})
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	current = &Backend{
+		Installed: true,
+		VMs:       make(map[string]VM),
+		Fail:      make(map[string]error),
+	}
+	return current
+}
+
+// VM is a VM in the fake backend.
+type VM struct {
+	State    core.MachineState
+	MemoryMB uint
+}
+
+// Backend holds the VMs of the fake driver, and records what was done to them.
+type Backend struct {
+	mutex sync.Mutex
+
+	// Installed is whether the backend is installed. If it is not, every
+	// method of the driver but Info fails.
+	Installed bool
+
+	// VMs holds the VM of each machine which has one, by machine ID.
+	VMs map[string]VM
+
+	// Fail holds the errors the driver's methods fail with, by method name,
+	// such as "Modify".
+	Fail map[string]error
+
+	// Calls records each method called, with the ID of the machine it was
+	// called for, such as "Modify foo".
+	Calls []string
+}
+
+// SetVM gives a machine a VM.
+func (b *Backend) SetVM(id string, vm VM) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.VMs[id] = vm
+}
+
+// GetVM returns a machine's VM, and whether it has one.
+func (b *Backend) GetVM(id string) (VM, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	vm, ok := b.VMs[id]
+	return vm, ok
+}
+
+// SetInstalled installs or uninstalls the backend.
+func (b *Backend) SetInstalled(installed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Installed = installed
+}
+
+// SetFail makes a method of the driver fail with err, or succeed again if err
+// is nil.
+func (b *Backend) SetFail(method string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.Fail, method)
+	} else {
+		b.Fail[method] = err
+	}
+}
+
+// GetCalls returns the calls made so far.
+func (b *Backend) GetCalls() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string{}, b.Calls...)
+}
+
+// call records a call to a method, and returns the error it should fail with.
+// The caller must hold the mutex.
+func (b *Backend) call(method string, m core.Machine) error {
+	b.Calls = append(b.Calls, method+" "+m.ID)
+	if !b.Installed {
+		return errNotInstalled
+	}
+	return b.Fail[method]
+}
+
+var errNotInstalled = fmt.Errorf("the fake backend is not installed")
+
+type fake struct {
+	*Backend
+}
+
+func (f fake) Info() driver.Info {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return driver.Info{DriverName: Name, AvailableOnPlatform: true, Installed: f.Installed, Healthy: f.Installed, Version: "1"}
+}
+
+func (f fake) Create(m core.Machine) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.call("Create", m); err != nil {
+		return err
+	}
+	if _, ok := f.VMs[m.ID]; ok {
+		return fmt.Errorf("machine %q already has a VM", m.ID)
+	}
+	f.VMs[m.ID] = VM{core.StatePoweroff, m.MemoryMB}
+	return nil
+}
+
+func (f fake) Modify(m core.Machine) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.call("Modify", m); err != nil {
+		return err
+	}
+	vm, ok := f.VMs[m.ID]
+	if !ok {
+		return fmt.Errorf("machine %q has no VM", m.ID)
+	}
+	vm.MemoryMB = m.MemoryMB
+	f.VMs[m.ID] = vm
+	return nil
+}
+
+// act takes a power action on a machine's VM, if the lifecycle allows it.
+func (f fake) act(method string, m core.Machine, action core.Action) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.call(method, m); err != nil {
+		return err
+	}
+	vm, ok := f.VMs[m.ID]
+	if !ok {
+		return fmt.Errorf("machine %q has no VM", m.ID)
+	}
+	state, err := core.Transition(vm.State, action)
+	if err != nil {
+		return err
+	}
+	vm.State = state
+	f.VMs[m.ID] = vm
+	return nil
+}
+
+func (f fake) Start(m core.Machine) error {
+	return f.act("Start", m, core.ActionStart)
+}
+
+func (f fake) Stop(m core.Machine, force bool) error {
+	return f.act("Stop", m, core.ActionStop)
+}
+
+func (f fake) Restart(m core.Machine) error {
+	return f.act("Restart", m, core.ActionRestart)
+}
+
+func (f fake) Pause(m core.Machine) error {
+	return f.act("Pause", m, core.ActionPause)
+}
+
+func (f fake) Resume(m core.Machine) error {
+	return f.act("Resume", m, core.ActionResume)
+}
+
+func (f fake) Save(m core.Machine) error {
+	return f.act("Save", m, core.ActionSave)
+}
+
+func (f fake) Destroy(m core.Machine) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.call("Destroy", m); err != nil {
+		return err
+	}
+	delete(f.VMs, m.ID)
+	return nil
+}
+
+func (f fake) Status(m core.Machine) (core.MachineState, error) {
+	info, err := f.Inspect(m)
+	return info.State, err
+}
+
+// Inspect reports the state of a machine's VM. A machine with no VM has an
+// unknown state.
+func (f fake) Inspect(m core.Machine) (core.RuntimeInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.call("Inspect", m); err != nil {
+		return core.RuntimeInfo{State: core.StateUnknown}, err
+	}
+	vm, ok := f.VMs[m.ID]
+	if !ok {
+		return core.RuntimeInfo{State: core.StateUnknown}, nil
+	}
+	return core.RuntimeInfo{State: vm.State, MemoryMB: vm.MemoryMB}, nil
+}
+
+func (f fake) ListMachineIDs() ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.Installed {
+		return nil, errNotInstalled
+	}
+	if err := f.Fail["ListMachineIDs"]; err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(f.VMs))
+	for id := range f.VMs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"harkd/errors"
+)
+
+// Constructor constructs a Driver from a Config.
+type Constructor func(Config) Driver
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Constructor)
+)
+
+// Register makes a driver available under the provided name.
+//
+// It is intended to be called from the init function of the file implementing
+// the driver, and panics if a driver is registered twice under the same name.
+func Register(name string, ctor Constructor) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if ctor == nil {
+		panic("driver: Register constructor is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("driver: Register called twice for driver %q", name))
+	}
+	registry[name] = ctor
+}
+
+// unregister removes a driver, so that tests can register drivers of their
+// own without leaving them behind.
+func unregister(name string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	delete(registry, name)
+}
+
+// Names returns the sorted names of every registered driver.
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup constructs the driver registered under the provided name. An empty
+// name refers to the DefaultDriver.
+func Lookup(name string, cfg Config) (Driver, error) {
+	if name == "" {
+		name = DefaultDriver
+	}
+
+	registryMutex.RLock()
+	ctor, ok := registry[name]
+	registryMutex.RUnlock()
+
+	if !ok {
+		return nil, errors.ErrUnknownDriver(name)
+	}
+	return ctor(cfg), nil
+}
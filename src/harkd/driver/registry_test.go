@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"testing"
+
+	"harkd/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDriver struct {
+	Config
+}
+
+func (fd fakeDriver) Info() Info                                     { return Info{DriverName: "fake"} }
+func (fd fakeDriver) Create(core.Machine) error                      { return nil }
+func (fd fakeDriver) Modify(core.Machine) error                      { return nil }
+func (fd fakeDriver) Start(core.Machine) error                       { return nil }
+func (fd fakeDriver) Stop(core.Machine, bool) error                  { return nil }
+func (fd fakeDriver) Restart(core.Machine) error                     { return nil }
+func (fd fakeDriver) Pause(core.Machine) error                       { return nil }
+func (fd fakeDriver) Resume(core.Machine) error                      { return nil }
+func (fd fakeDriver) Save(core.Machine) error                        { return nil }
+func (fd fakeDriver) Destroy(core.Machine) error                     { return nil }
+func (fd fakeDriver) Status(core.Machine) (core.MachineState, error) { return core.StatePoweroff, nil }
+func (fd fakeDriver) Inspect(core.Machine) (core.RuntimeInfo, error) {
+	return core.RuntimeInfo{State: core.StatePoweroff}, nil
+}
+
+func (fd fakeDriver) ListMachineIDs() ([]string, error) { return nil, nil }
+
+func newFakeDriver(cfg Config) Driver {
+	return fakeDriver{cfg}
+}
+
+// registerFake registers a fake driver for the length of a test.
+func registerFake(t *testing.T, name string) {
+	Register(name, newFakeDriver)
+	t.Cleanup(func() { unregister(name) })
+}
+
+func TestRegistryLookup(t *testing.T) {
+	registerFake(t, "fake-lookup")
+
+	d, err := Lookup("fake-lookup", Config{})
+	require.NoError(t, err)
+	require.Equal(t, "fake", d.Info().DriverName)
+
+	_, err = Lookup("no-such-driver", Config{})
+	require.Error(t, err)
+}
+
+func TestRegistryLookupDefault(t *testing.T) {
+	d, err := Lookup("", Config{})
+	require.NoError(t, err)
+	require.IsType(t, virtualbox{}, d)
+}
+
+func TestRegistryRegisterTwice(t *testing.T) {
+	registerFake(t, "fake-twice")
+
+	require.Panics(t, func() {
+		Register("fake-twice", newFakeDriver)
+	})
+}
+
+func TestRegistryNames(t *testing.T) {
+	registerFake(t, "fake-names")
+
+	names := Names()
+	require.Contains(t, names, "fake-names")
+	require.Contains(t, names, DefaultDriver)
+}
@@ -0,0 +1,211 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"harkd/core"
+)
+
+// vboxStates maps the VMState values reported by VirtualBox to hark's
+// normalized machine states. Anything not listed here is unknown.
+var vboxStates = map[string]core.MachineState{
+	"poweroff":      core.StatePoweroff,
+	"starting":      core.StateStarting,
+	"restoring":     core.StateStarting,
+	"running":       core.StateRunning,
+	"paused":        core.StatePaused,
+	"saved":         core.StateSaved,
+	"aborted":       core.StateAborted,
+	"aborted-saved": core.StateAborted,
+}
+
+// machineReadableLine is a single key=value line of 'VBoxManage showvminfo
+// --machinereadable' output.
+type machineReadableLine struct {
+	key   string
+	value string
+}
+
+// parseMachineReadable parses the key=value output of 'VBoxManage showvminfo
+// --machinereadable'. Keys and values may both be quoted; quoted values may
+// contain backslash-escaped quotes.
+//
+// The format is not entirely regular - some versions print a few lines which
+// are not key=value pairs, or values which are only partly quoted - so lines
+// without a '=' are skipped and values which are not properly quoted are kept
+// as they are.
+//
+// The lines are returned in order, since some values (e.g. forwarding rules)
+// only make sense in the context of the lines before them.
+func parseMachineReadable(out []byte) ([]machineReadableLine, error) {
+	var lines []machineReadableLine
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		text := strings.TrimRight(scanner.Text(), "\r")
+
+		// A quoted key may itself contain '=', so look for the separator after
+		// the end of it.
+		keyEnd := 0
+		if strings.HasPrefix(text, `"`) {
+			if end := strings.Index(text[1:], `"`); end >= 0 {
+				keyEnd = end + 2
+			}
+		}
+		eq := strings.Index(text[keyEnd:], "=")
+		if eq < 0 {
+			continue
+		}
+		eq += keyEnd
+
+		lines = append(lines, machineReadableLine{
+			unquoteMachineReadable(text[:eq]),
+			unquoteMachineReadable(text[eq+1:]),
+		})
+	}
+
+	return lines, scanner.Err()
+}
+
+// unquoteMachineReadable strips the quotes from a quoted key or value and
+// undoes VirtualBox's escaping of '"' and '\'. Anything which is not a single
+// quoted string is returned as it is.
+func unquoteMachineReadable(s string) string {
+	if len(s) < 2 || !strings.HasPrefix(s, `"`) || !strings.HasSuffix(s, `"`) {
+		return s
+	}
+
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// parseVMInfo builds a RuntimeInfo from 'VBoxManage showvminfo
+// --machinereadable' output.
+func parseVMInfo(out []byte) (core.RuntimeInfo, error) {
+	info := core.RuntimeInfo{State: core.StateUnknown}
+
+	lines, err := parseMachineReadable(out)
+	if err != nil {
+		return info, err
+	}
+
+	nics := make(map[int]*core.NIC)
+	getNIC := func(index int) *core.NIC {
+		if nics[index] == nil {
+			nics[index] = &core.NIC{Index: index}
+		}
+		return nics[index]
+	}
+
+	// Forwarding rules are listed after the NIC they belong to, and are
+	// numbered per NIC.
+	currentNIC := 0
+
+	for _, line := range lines {
+		switch {
+		case line.key == "VMState":
+			if state, ok := vboxStates[line.value]; ok {
+				info.State = state
+			}
+		case line.key == "memory":
+			memory, err := strconv.ParseUint(line.value, 10, 0)
+			if err != nil {
+				return info, fmt.Errorf("invalid memory %q: %s", line.value, err)
+			}
+			info.MemoryMB = uint(memory)
+		case line.key == "cpus":
+			cpus, err := strconv.ParseUint(line.value, 10, 0)
+			if err != nil {
+				return info, fmt.Errorf("invalid cpus %q: %s", line.value, err)
+			}
+			info.CPUs = uint(cpus)
+		case strings.HasPrefix(line.key, "Forwarding("):
+			rule, err := parseForwardingRule(currentNIC, line.value)
+			if err != nil {
+				return info, err
+			}
+			info.ForwardingRules = append(info.ForwardingRules, rule)
+		default:
+			if index, ok := keyIndex(line.key, "nic"); ok {
+				currentNIC = index
+				if line.value != "none" {
+					getNIC(index).Type = line.value
+				}
+			} else if index, ok := keyIndex(line.key, "macaddress"); ok {
+				getNIC(index).MACAddress = line.value
+			}
+		}
+	}
+
+	// Only report adapters which are attached to something.
+	var indexes []int
+	for index, nic := range nics {
+		if nic.Type != "" {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		info.NICs = append(info.NICs, *nics[index])
+	}
+
+	return info, nil
+}
+
+// keyIndex matches keys like "nic1" or "macaddress2", returning the number
+// after the prefix.
+func keyIndex(key, prefix string) (int, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(key[len(prefix):])
+	if err != nil || index < 1 {
+		return 0, false
+	}
+	return index, true
+}
+
+// parseForwardingRule parses a NAT forwarding rule, which is formatted as:
+//
+//	name,protocol,hostip,hostport,guestip,guestport
+func parseForwardingRule(nic int, value string) (core.ForwardingRule, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 6 {
+		return core.ForwardingRule{}, fmt.Errorf("invalid forwarding rule: %q", value)
+	}
+
+	hostPort, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return core.ForwardingRule{}, fmt.Errorf("invalid forwarding rule host port: %q", value)
+	}
+	guestPort, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return core.ForwardingRule{}, fmt.Errorf("invalid forwarding rule guest port: %q", value)
+	}
+
+	return core.ForwardingRule{
+		NIC:       nic,
+		Name:      fields[0],
+		Protocol:  fields[1],
+		HostIP:    fields[2],
+		HostPort:  hostPort,
+		GuestIP:   fields[4],
+		GuestPort: guestPort,
+	}, nil
+}
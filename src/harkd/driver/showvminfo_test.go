@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"harkd/core"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The fixtures in testdata are 'VBoxManage showvminfo --machinereadable'
+// output for different versions of VirtualBox. testdata/README.adoc records
+// where each came from: they were written by hand, and are to be replaced
+// with captures.
+var parseVMInfoTests = []struct {
+	fixture string
+	expect  core.RuntimeInfo
+}{
+	{
+		"showvminfo-4.3.txt",
+		core.RuntimeInfo{
+			State:    core.StatePoweroff,
+			MemoryMB: 512,
+			CPUs:     1,
+			NICs: []core.NIC{
+				{Index: 1, Type: "nat", MACAddress: "0800271A2B3C"},
+			},
+			ForwardingRules: []core.ForwardingRule{
+				{NIC: 1, Name: "ssh", Protocol: "tcp", HostPort: 2222, GuestPort: 22},
+			},
+		},
+	},
+	{
+		"showvminfo-5.2.txt",
+		core.RuntimeInfo{
+			State:    core.StateRunning,
+			MemoryMB: 2048,
+			CPUs:     2,
+			NICs: []core.NIC{
+				{Index: 1, Type: "nat", MACAddress: "080027D4E5F6"},
+				{Index: 2, Type: "hostonly", MACAddress: "0800279A8B7C"},
+			},
+			ForwardingRules: []core.ForwardingRule{
+				{NIC: 1, Name: "ssh", Protocol: "tcp", HostIP: "127.0.0.1", HostPort: 2222, GuestPort: 22},
+				{NIC: 1, Name: "web", Protocol: "tcp", HostPort: 8080, GuestPort: 80},
+			},
+		},
+	},
+	{
+		"showvminfo-6.1.txt",
+		core.RuntimeInfo{
+			State:    core.StatePaused,
+			MemoryMB: 1024,
+			CPUs:     1,
+			NICs: []core.NIC{
+				{Index: 1, Type: "nat", MACAddress: "080027112233"},
+				{Index: 2, Type: "bridged", MACAddress: "080027445566"},
+				{Index: 3, Type: "nat", MACAddress: "080027778899"},
+			},
+			ForwardingRules: []core.ForwardingRule{
+				{NIC: 1, Name: "ssh", Protocol: "tcp", HostPort: 2222, GuestPort: 22},
+				{NIC: 3, Name: "dns", Protocol: "udp", HostPort: 5353, GuestIP: "10.0.4.15", GuestPort: 53},
+			},
+		},
+	},
+	{
+		"showvminfo-7.0.txt",
+		core.RuntimeInfo{
+			State:    core.StateAborted,
+			MemoryMB: 4096,
+			CPUs:     4,
+			NICs: []core.NIC{
+				{Index: 1, Type: "nat", MACAddress: "080027ABCDEF"},
+			},
+			ForwardingRules: []core.ForwardingRule{
+				{NIC: 1, Name: "ssh", Protocol: "tcp", HostPort: 2222, GuestPort: 22},
+			},
+		},
+	},
+}
+
+func TestParseVMInfo(t *testing.T) {
+	for _, c := range parseVMInfoTests {
+		c := c
+		t.Run(c.fixture, func(t *testing.T) {
+			out, err := ioutil.ReadFile(filepath.Join("testdata", c.fixture))
+			require.NoError(t, err)
+
+			info, err := parseVMInfo(out)
+			require.NoError(t, err)
+			require.Equal(t, c.expect, info)
+		})
+	}
+}
+
+var parseVMInfoStateTests = []struct {
+	vmState string
+	expect  core.MachineState
+}{
+	{"poweroff", core.StatePoweroff},
+	{"starting", core.StateStarting},
+	{"restoring", core.StateStarting},
+	{"running", core.StateRunning},
+	{"paused", core.StatePaused},
+	{"saved", core.StateSaved},
+	{"aborted", core.StateAborted},
+	{"aborted-saved", core.StateAborted},
+	{"gurumeditation", core.StateUnknown},
+	{"teleporting", core.StateUnknown},
+}
+
+func TestParseVMInfoStates(t *testing.T) {
+	for _, c := range parseVMInfoStateTests {
+		c := c
+		t.Run(c.vmState, func(t *testing.T) {
+			info, err := parseVMInfo([]byte(`VMState="` + c.vmState + `"`))
+			require.NoError(t, err)
+			require.Equal(t, c.expect, info.State)
+		})
+	}
+}
+
+var parseMachineReadableTests = []struct {
+	name   string
+	line   string
+	expect []machineReadableLine
+}{
+	{"unquoted", "memory=512", []machineReadableLine{{"memory", "512"}}},
+	{"quoted value", `name="hark-foo"`, []machineReadableLine{{"name", "hark-foo"}}},
+	{"quoted key", `"SATA-0-0"="/vms/disk.vdi"`, []machineReadableLine{{"SATA-0-0", "/vms/disk.vdi"}}},
+	{"escaped quotes", `description="a \"b\" c"`, []machineReadableLine{{"description", `a "b" c`}}},
+	{"escaped backslashes", `CfgFile="C:\\vms\\foo.vbox"`, []machineReadableLine{{"CfgFile", `C:\vms\foo.vbox`}}},
+	{"partly quoted value", `VideoMode="720,400,0"@0,0 1`, []machineReadableLine{{"VideoMode", `"720,400,0"@0,0 1`}}},
+	{"empty value", `videocapopts=`, []machineReadableLine{{"videocapopts", ""}}},
+	{"not a key=value line", " rec_screen0", nil},
+}
+
+func TestParseMachineReadable(t *testing.T) {
+	for _, c := range parseMachineReadableTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			lines, err := parseMachineReadable([]byte(c.line + "\n"))
+			require.NoError(t, err)
+			require.Equal(t, c.expect, lines)
+		})
+	}
+}
+
+func TestParseVMInfoInvalid(t *testing.T) {
+	_, err := parseVMInfo([]byte(`memory=lots`))
+	require.Error(t, err)
+
+	_, err = parseVMInfo([]byte(`Forwarding(0)="ssh,tcp,,2222"`))
+	require.Error(t, err)
+}
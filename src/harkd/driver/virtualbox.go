@@ -1,13 +1,44 @@
 package driver
 
 import (
+	"bufio"
+	"bytes"
+	"strconv"
 	"strings"
 
+	"harkd/core"
+	"harkd/errors"
+	"harkd/events"
 	"harkd/util/command"
 )
 
+const virtualboxDriverName = "virtualbox"
+
+const vboxManage = "VBoxManage"
+
+// vboxObjectNotFound is the error code VBoxManage reports when asked about a
+// VM which is not registered.
+const vboxObjectNotFound = "VBOX_E_OBJECT_NOT_FOUND"
+
+// vmNamePrefix is prepended to the ID of a hark machine to give the name of
+// the VirtualBox VM backing it.
+const vmNamePrefix = "hark-"
+
+func init() {
+	Register(virtualboxDriverName, newVirtualbox)
+}
+
+func newVirtualbox(cfg Config) Driver {
+	return virtualbox{cfg.Runner, cfg.Events}
+}
+
 type virtualbox struct {
 	command.Runner
+	events events.Publisher
+}
+
+func (v virtualbox) Info() Info {
+	return Info{virtualboxDriverName, v.available(), v.installed(), v.healthy(), v.version()}
 }
 
 func (v virtualbox) available() bool {
@@ -17,19 +48,237 @@ func (v virtualbox) available() bool {
 
 func (v virtualbox) installed() bool {
 	// Just check for the command in the path
-	return v.HaveOnPath("VBoxManage")
+	return v.HaveOnPath(vboxManage)
 }
 
 func (v virtualbox) healthy() bool {
 	// Run the command with --version; ignore the output
-	res := v.RunSimple("VBoxManage", "--version")
+	res := v.RunSimple(vboxManage, "--version")
 	return res.Error == nil
 }
 
 func (v virtualbox) version() string {
-	res := v.RunSimple("VBoxManage", "--version")
+	res := v.RunSimple(vboxManage, "--version")
 	if res.Error != nil {
 		return ""
 	}
 	return strings.TrimSpace(string(res.Output))
 }
+
+// run runs VBoxManage with the given arguments, wrapping any failure in a
+// hark error that carries the command output.
+func (v virtualbox) run(args ...string) ([]byte, error) {
+	res := v.RunSimple(vboxManage, args...)
+	if res.Error != nil {
+		return nil, errors.ErrDriverCommand(vboxManage+" "+strings.Join(args, " "), res.Error, res.Output)
+	}
+	return res.Output, nil
+}
+
+// changeState runs a VBoxManage command which changes the state of a
+// machine's VM, then publishes the state the VM is in afterwards.
+func (v virtualbox) changeState(m core.Machine, args ...string) error {
+	if _, err := v.run(args...); err != nil {
+		return err
+	}
+	if v.events == nil {
+		return nil
+	}
+
+	// The command succeeded, so failing to find out what it did is not worth
+	// reporting.
+	if state, err := v.Status(m); err == nil {
+		v.events.Publish(events.MachineStateChanged, events.StateChange{MachineID: m.ID, State: string(state)})
+	}
+	return nil
+}
+
+// listVMNames runs 'VBoxManage list' for the given list type and returns the
+// names of the VMs in the output.
+func (v virtualbox) listVMNames(listType string) ([]string, error) {
+	out, err := v.run("list", listType)
+	if err != nil {
+		return nil, err
+	}
+	return parseVMList(out), nil
+}
+
+func (v virtualbox) registered(m core.Machine) (bool, error) {
+	names, err := v.listVMNames("vms")
+	if err != nil {
+		return false, err
+	}
+	return containsString(names, vmName(m)), nil
+}
+
+func (v virtualbox) running(m core.Machine) (bool, error) {
+	names, err := v.listVMNames("runningvms")
+	if err != nil {
+		return false, err
+	}
+	return containsString(names, vmName(m)), nil
+}
+
+// Create registers a new VM for a machine and configures its hardware.
+//
+// If the VM cannot be configured it is deleted again, so that a failed create
+// does not leave a half-built VM behind.
+func (v virtualbox) Create(m core.Machine) error {
+	if _, err := v.run("createvm", "--name", vmName(m), "--register"); err != nil {
+		return err
+	}
+
+	if err := v.Modify(m); err != nil {
+		// Best effort: the configuration error is the interesting one.
+		v.run("unregistervm", vmName(m), "--delete")
+		return err
+	}
+	return nil
+}
+
+// Modify applies a machine's hardware configuration to its VM. The VM must be
+// powered off.
+func (v virtualbox) Modify(m core.Machine) error {
+	_, err := v.run("modifyvm", vmName(m), "--memory", strconv.FormatUint(uint64(m.MemoryMB), 10))
+	return err
+}
+
+// Start boots the VM for a machine without opening a GUI window.
+func (v virtualbox) Start(m core.Machine) error {
+	return v.changeState(m, "startvm", vmName(m), "--type", "headless")
+}
+
+// Stop shuts down the VM for a machine. Unless force is set, this presses the
+// ACPI power button and leaves the guest to shut itself down; with force set,
+// the VM is powered off immediately.
+func (v virtualbox) Stop(m core.Machine, force bool) error {
+	action := "acpipowerbutton"
+	if force {
+		action = "poweroff"
+	}
+	return v.changeState(m, "controlvm", vmName(m), action)
+}
+
+// Restart hard-resets the VM for a machine.
+func (v virtualbox) Restart(m core.Machine) error {
+	return v.changeState(m, "controlvm", vmName(m), "reset")
+}
+
+// Pause suspends execution of the VM for a machine, keeping it in memory.
+func (v virtualbox) Pause(m core.Machine) error {
+	return v.changeState(m, "controlvm", vmName(m), "pause")
+}
+
+// Resume continues execution of a paused VM.
+func (v virtualbox) Resume(m core.Machine) error {
+	return v.changeState(m, "controlvm", vmName(m), "resume")
+}
+
+// Save saves the state of the VM for a machine to disk and stops it. Starting
+// it again restores the saved state.
+func (v virtualbox) Save(m core.Machine) error {
+	return v.changeState(m, "controlvm", vmName(m), "savestate")
+}
+
+// Destroy unregisters the VM backing a machine and deletes its disks.
+//
+// If the VM is running it is powered off first. A machine which never had a
+// VM registered is not an error: there is just nothing to tear down.
+func (v virtualbox) Destroy(m core.Machine) error {
+	registered, err := v.registered(m)
+	if err != nil || !registered {
+		return err
+	}
+
+	running, err := v.running(m)
+	if err != nil {
+		return err
+	}
+	if running {
+		if _, err := v.run("controlvm", vmName(m), "poweroff"); err != nil {
+			return err
+		}
+	}
+
+	_, err = v.run("unregistervm", vmName(m), "--delete")
+	return err
+}
+
+// Status reports the normalized state of the VM backing a machine.
+func (v virtualbox) Status(m core.Machine) (core.MachineState, error) {
+	info, err := v.Inspect(m)
+	return info.State, err
+}
+
+// Inspect reports the live state and configuration of the VM backing a
+// machine. A machine whose VM is not registered has an unknown state.
+func (v virtualbox) Inspect(m core.Machine) (core.RuntimeInfo, error) {
+	args := []string{"showvminfo", vmName(m), "--machinereadable"}
+
+	res := v.RunSimple(vboxManage, args...)
+	if res.Error != nil {
+		if bytes.Contains(res.Output, []byte(vboxObjectNotFound)) {
+			return core.RuntimeInfo{State: core.StateUnknown}, nil
+		}
+		return core.RuntimeInfo{State: core.StateUnknown}, errors.ErrDriverCommand(vboxManage+" "+strings.Join(args, " "), res.Error, res.Output)
+	}
+
+	info, err := parseVMInfo(res.Output)
+	if err != nil {
+		return info, errors.ErrDriverOutput(vboxManage+" showvminfo", err)
+	}
+	return info, nil
+}
+
+// ListMachineIDs lists the IDs of the machines which have a registered VM,
+// going by the names of the VMs.
+func (v virtualbox) ListMachineIDs() ([]string, error) {
+	names, err := v.listVMNames("vms")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, name := range names {
+		if strings.HasPrefix(name, vmNamePrefix) && len(name) > len(vmNamePrefix) {
+			ids = append(ids, name[len(vmNamePrefix):])
+		}
+	}
+	return ids, nil
+}
+
+func vmName(m core.Machine) string {
+	return vmNamePrefix + m.ID
+}
+
+// parseVMList parses the output of 'VBoxManage list vms', which has a line
+// like this for each VM:
+//
+//	"hark-foo" {0d3c4f2e-7d7a-4b0e-9a53-2b7c1f7d6a10}
+func parseVMList(out []byte) []string {
+	var names []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+		end := strings.LastIndex(line, `"`)
+		if end <= 0 {
+			continue
+		}
+		names = append(names, line[1:end])
+	}
+
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
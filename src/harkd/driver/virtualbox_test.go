@@ -0,0 +1,311 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"harkd/core"
+	"harkd/events"
+	"harkd/test/fixtures"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testMachine = core.Machine{ID: "foo", Name: "Foo", MemoryMB: 1024, Driver: virtualboxDriverName}
+
+const listVMsOutput = `"hark-foo" {0d3c4f2e-7d7a-4b0e-9a53-2b7c1f7d6a10}
+"some-other-vm" {8a1d2c3b-4e5f-4a6b-8c7d-9e0f1a2b3c4d}
+`
+
+var errCommandFailed = errors.New("exit status 1")
+
+func expectList(listType, output string) fixtures.ScriptedCommand {
+	return fixtures.Expect("VBoxManage", "list", listType).WithOutput(output)
+}
+
+var virtualboxLifecycleTests = []struct {
+	name   string
+	script []fixtures.ScriptedCommand
+	action func(Driver) error
+	valid  bool
+}{
+	{
+		"create",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "createvm", "--name", "hark-foo", "--register"),
+			fixtures.Expect("VBoxManage", "modifyvm", "hark-foo", "--memory", "1024"),
+		},
+		func(d Driver) error { return d.Create(testMachine) },
+		true,
+	},
+	{
+		"create fails to register",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "createvm", "--name", "hark-foo", "--register").WithError(errCommandFailed),
+		},
+		func(d Driver) error { return d.Create(testMachine) },
+		false,
+	},
+	{
+		"create fails to configure, cleans up",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "createvm", "--name", "hark-foo", "--register"),
+			fixtures.Expect("VBoxManage", "modifyvm", "hark-foo", "--memory", "1024").WithError(errCommandFailed),
+			fixtures.Expect("VBoxManage", "unregistervm", "hark-foo", "--delete"),
+		},
+		func(d Driver) error { return d.Create(testMachine) },
+		false,
+	},
+	{
+		"modify",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "modifyvm", "hark-foo", "--memory", "1024"),
+		},
+		func(d Driver) error { return d.Modify(testMachine) },
+		true,
+	},
+	{
+		"start",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "startvm", "hark-foo", "--type", "headless"),
+		},
+		func(d Driver) error { return d.Start(testMachine) },
+		true,
+	},
+	{
+		"start fails",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "startvm", "hark-foo", "--type", "headless").WithError(errCommandFailed),
+		},
+		func(d Driver) error { return d.Start(testMachine) },
+		false,
+	},
+	{
+		"stop with acpi shutdown",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "acpipowerbutton"),
+		},
+		func(d Driver) error { return d.Stop(testMachine, false) },
+		true,
+	},
+	{
+		"stop with hard power-off",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "poweroff"),
+		},
+		func(d Driver) error { return d.Stop(testMachine, true) },
+		true,
+	},
+	{
+		"restart",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "reset"),
+		},
+		func(d Driver) error { return d.Restart(testMachine) },
+		true,
+	},
+	{
+		"pause",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "pause"),
+		},
+		func(d Driver) error { return d.Pause(testMachine) },
+		true,
+	},
+	{
+		"resume",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "resume"),
+		},
+		func(d Driver) error { return d.Resume(testMachine) },
+		true,
+	},
+	{
+		"save",
+		[]fixtures.ScriptedCommand{
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "savestate"),
+		},
+		func(d Driver) error { return d.Save(testMachine) },
+		true,
+	},
+	{
+		"destroy powered off vm",
+		[]fixtures.ScriptedCommand{
+			expectList("vms", listVMsOutput),
+			expectList("runningvms", ""),
+			fixtures.Expect("VBoxManage", "unregistervm", "hark-foo", "--delete"),
+		},
+		func(d Driver) error { return d.Destroy(testMachine) },
+		true,
+	},
+	{
+		"destroy running vm",
+		[]fixtures.ScriptedCommand{
+			expectList("vms", listVMsOutput),
+			expectList("runningvms", listVMsOutput),
+			fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "poweroff"),
+			fixtures.Expect("VBoxManage", "unregistervm", "hark-foo", "--delete"),
+		},
+		func(d Driver) error { return d.Destroy(testMachine) },
+		true,
+	},
+	{
+		"destroy unregistered vm",
+		[]fixtures.ScriptedCommand{
+			expectList("vms", `"some-other-vm" {8a1d2c3b-4e5f-4a6b-8c7d-9e0f1a2b3c4d}`),
+		},
+		func(d Driver) error { return d.Destroy(testMachine) },
+		true,
+	},
+	{
+		"destroy fails to unregister",
+		[]fixtures.ScriptedCommand{
+			expectList("vms", listVMsOutput),
+			expectList("runningvms", ""),
+			fixtures.Expect("VBoxManage", "unregistervm", "hark-foo", "--delete").WithError(errCommandFailed),
+		},
+		func(d Driver) error { return d.Destroy(testMachine) },
+		false,
+	},
+}
+
+func TestVirtualboxLifecycle(t *testing.T) {
+	for _, c := range virtualboxLifecycleTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			runner := fixtures.NewRunnerFixture(c.script...)
+			d := newVirtualbox(Config{Runner: runner})
+
+			// Keep a copy of the expected command lines before the script is consumed
+			var expectCalls [][]string
+			for _, sc := range c.script {
+				expectCalls = append(expectCalls, sc.Args)
+			}
+
+			// Execute
+			err := c.action(d)
+
+			// Assert
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			require.Equal(t, expectCalls, runner.Calls)
+			require.Empty(t, runner.Script)
+		})
+	}
+}
+
+const showVMInfoNotFound = `VBoxManage: error: Could not find a registered machine named 'hark-foo'
+VBoxManage: error: Details: code VBOX_E_OBJECT_NOT_FOUND (0x80bb0001), component VirtualBoxWrap, interface IVirtualBox, callee nsISupports
+`
+
+func expectShowVMInfo() fixtures.ScriptedCommand {
+	return fixtures.Expect("VBoxManage", "showvminfo", "hark-foo", "--machinereadable")
+}
+
+var virtualboxStatusTests = []struct {
+	name        string
+	script      []fixtures.ScriptedCommand
+	expectState core.MachineState
+	valid       bool
+}{
+	{"unregistered", []fixtures.ScriptedCommand{expectShowVMInfo().WithOutput(showVMInfoNotFound).WithError(errCommandFailed)}, core.StateUnknown, true},
+	{"powered off", []fixtures.ScriptedCommand{expectShowVMInfo().WithOutput(`VMState="poweroff"`)}, core.StatePoweroff, true},
+	{"running", []fixtures.ScriptedCommand{expectShowVMInfo().WithOutput(`VMState="running"`)}, core.StateRunning, true},
+	{"command fails", []fixtures.ScriptedCommand{expectShowVMInfo().WithError(errCommandFailed)}, core.StateUnknown, false},
+	{"invalid output", []fixtures.ScriptedCommand{expectShowVMInfo().WithOutput(`memory=lots`)}, core.StateUnknown, false},
+}
+
+func TestVirtualboxStatus(t *testing.T) {
+	for _, c := range virtualboxStatusTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			runner := fixtures.NewRunnerFixture(c.script...)
+			d := newVirtualbox(Config{Runner: runner})
+
+			state, err := d.Status(testMachine)
+
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.Equal(t, c.expectState, state)
+			require.Empty(t, runner.Script)
+		})
+	}
+}
+
+type recordingPublisher struct {
+	events []events.StateChange
+}
+
+func (rp *recordingPublisher) Publish(eventType string, data interface{}) {
+	if eventType == events.MachineStateChanged {
+		rp.events = append(rp.events, data.(events.StateChange))
+	}
+}
+
+func TestVirtualboxPublishesStateChanges(t *testing.T) {
+	runner := fixtures.NewRunnerFixture(
+		fixtures.Expect("VBoxManage", "startvm", "hark-foo", "--type", "headless"),
+		expectShowVMInfo().WithOutput(`VMState="running"`),
+	)
+	publisher := new(recordingPublisher)
+	d := newVirtualbox(Config{Runner: runner, Events: publisher})
+
+	err := d.Start(testMachine)
+
+	require.NoError(t, err)
+	require.Empty(t, runner.Script)
+	require.Equal(t, []events.StateChange{{MachineID: "foo", State: "running"}}, publisher.events)
+}
+
+func TestVirtualboxDoesNotPublishFailedChanges(t *testing.T) {
+	runner := fixtures.NewRunnerFixture(
+		fixtures.Expect("VBoxManage", "controlvm", "hark-foo", "pause").WithError(errCommandFailed),
+	)
+	publisher := new(recordingPublisher)
+	d := newVirtualbox(Config{Runner: runner, Events: publisher})
+
+	err := d.Pause(testMachine)
+
+	require.Error(t, err)
+	require.Empty(t, publisher.events)
+}
+
+var virtualboxListMachineIDsTests = []struct {
+	name      string
+	script    []fixtures.ScriptedCommand
+	expectIDs []string
+	valid     bool
+}{
+	{"no vms", []fixtures.ScriptedCommand{expectList("vms", "")}, nil, true},
+	{"hark and other vms", []fixtures.ScriptedCommand{expectList("vms", listVMsOutput)}, []string{"foo"}, true},
+	{"bare prefix", []fixtures.ScriptedCommand{expectList("vms", `"hark-" {0d3c4f2e-7d7a-4b0e-9a53-2b7c1f7d6a10}`)}, nil, true},
+	{"command fails", []fixtures.ScriptedCommand{expectList("vms", "").WithError(errCommandFailed)}, nil, false},
+}
+
+func TestVirtualboxListMachineIDs(t *testing.T) {
+	for _, c := range virtualboxListMachineIDsTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			runner := fixtures.NewRunnerFixture(c.script...)
+			d := newVirtualbox(Config{Runner: runner})
+
+			ids, err := d.ListMachineIDs()
+
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.Equal(t, c.expectIDs, ids)
+			require.Empty(t, runner.Script)
+		})
+	}
+}
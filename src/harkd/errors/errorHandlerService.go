@@ -15,12 +15,18 @@ type errorHandlerService struct{}
 
 func (ehs errorHandlerService) GetHTTPStatusCode(err error) int {
 	switch err.(type) {
-	case harkBadRequestError:
+	case harkBadRequestError, harkValidationError:
 		return 400
 	case harkNotFoundError:
 		return 404
 	case harkConflictError:
 		return 409
+	case harkMethodNotAllowedError:
+		return 405
+	case harkPreconditionFailedError:
+		return 412
+	case harkServiceUnavailableError:
+		return 503
 	case harkInternalServerError:
 		return 500
 	default:
@@ -1,6 +1,9 @@
 package errors
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // DefaultErrorCode is the default code used for an error.
 // This applies if we handle an error which is not for hark code without wrapping it.
@@ -50,6 +53,45 @@ func (hc harkConflictError) Code() int {
 	return hc.code
 }
 
+type harkPreconditionFailedError struct {
+	code int
+	msg  string
+}
+
+func (hpf harkPreconditionFailedError) Error() string {
+	return hpf.msg
+}
+
+func (hpf harkPreconditionFailedError) Code() int {
+	return hpf.code
+}
+
+type harkServiceUnavailableError struct {
+	code int
+	msg  string
+}
+
+func (hsu harkServiceUnavailableError) Error() string {
+	return hsu.msg
+}
+
+func (hsu harkServiceUnavailableError) Code() int {
+	return hsu.code
+}
+
+type harkMethodNotAllowedError struct {
+	code int
+	msg  string
+}
+
+func (hmna harkMethodNotAllowedError) Error() string {
+	return hmna.msg
+}
+
+func (hmna harkMethodNotAllowedError) Code() int {
+	return hmna.code
+}
+
 type harkInternalServerError struct {
 	code int
 	msg  string
@@ -73,16 +115,91 @@ func ErrEntityInvalid(msg string) error {
 	return harkBadRequestError{400002, fmt.Sprintf("Request entity invalid: %q", msg)}
 }
 
+// ErrInvalidQueryParam creates an error for 400 responses
+func ErrInvalidQueryParam(name, value string) error {
+	return harkBadRequestError{400003, fmt.Sprintf("Invalid value for query parameter %q: %q", name, value)}
+}
+
+// ErrUnknownDriver creates an error for 400 responses
+func ErrUnknownDriver(name string) error {
+	return harkBadRequestError{400004, fmt.Sprintf("Unknown driver: %q", name)}
+}
+
+// ErrInvalidBundle creates an error for 400 responses
+func ErrInvalidBundle(err error) error {
+	return harkBadRequestError{400005, fmt.Sprintf("Invalid state bundle: %s", err)}
+}
+
 // ErrMachineNotFound creates an error for 404 responses
 func ErrMachineNotFound(machineID string) error {
 	return harkNotFoundError{404001, fmt.Sprintf("Machine not found: %q", machineID)}
 }
 
+// ErrOperationNotFound creates an error for 404 responses
+func ErrOperationNotFound(operationID string) error {
+	return harkNotFoundError{404003, fmt.Sprintf("Operation not found: %q", operationID)}
+}
+
+// ErrMachineVersionNotFound creates an error for 404 responses
+func ErrMachineVersionNotFound(machineID string, revision uint64) error {
+	return harkNotFoundError{404004, fmt.Sprintf("Machine %q has no version at revision %d", machineID, revision)}
+}
+
+// ErrStateNotLocked creates an error for 404 responses
+func ErrStateNotLocked() error {
+	return harkNotFoundError{404005, "State is not guarded by a lock file"}
+}
+
+// ErrRouteNotFound creates an error for 404 responses
+func ErrRouteNotFound(method, path string) error {
+	return harkNotFoundError{404006, fmt.Sprintf("No route for %s %q", method, path)}
+}
+
 // ErrEntityConflict creates an error for 409 responses
 func ErrEntityConflict(msg string) error {
 	return harkConflictError{404002, msg}
 }
 
+// ErrMachineRunning creates an error for 409 responses
+func ErrMachineRunning(machineID string) error {
+	return harkConflictError{409001, fmt.Sprintf("Machine is running: %q", machineID)}
+}
+
+// ErrMachineNotPoweredOff creates an error for 409 responses
+func ErrMachineNotPoweredOff(machineID string) error {
+	return harkConflictError{409002, fmt.Sprintf("Machine must be powered off: %q", machineID)}
+}
+
+// ErrIllegalTransition creates an error for 409 responses
+func ErrIllegalTransition(action, state string) error {
+	return harkConflictError{409003, fmt.Sprintf("Cannot %s a machine which is %s", action, state)}
+}
+
+// ErrOperationFinished creates an error for 409 responses
+func ErrOperationFinished(operationID string) error {
+	return harkConflictError{409004, fmt.Sprintf("Operation has already finished: %q", operationID)}
+}
+
+// ErrOperationNotCancellable creates an error for 409 responses
+func ErrOperationNotCancellable(operationID string) error {
+	return harkConflictError{409005, fmt.Sprintf("Operation is not running in this process: %q", operationID)}
+}
+
+// ErrMachineChanged creates an error for 409 responses
+func ErrMachineChanged(machineID string) error {
+	return harkConflictError{409006, fmt.Sprintf("Machine changed while it was being updated: %q", machineID)}
+}
+
+// ErrMethodNotAllowed creates an error for 405 responses
+func ErrMethodNotAllowed(method, path string) error {
+	return harkMethodNotAllowedError{405001, fmt.Sprintf("Method %s is not allowed for %q", method, path)}
+}
+
+// ErrPreconditionFailed creates an error for 412 responses
+func ErrPreconditionFailed(entity, id string, revision uint64) error {
+	return harkPreconditionFailedError{412001, fmt.Sprintf("%s %q has changed: it is at revision %d", entity, id, revision)}
+}
+
 // ErrSerialization creates an error for 500 responses
 func ErrSerialization(msg string, err error) error {
 	fullMsg := fmt.Sprintf("Failed %s: %q", msg, err)
@@ -96,7 +213,7 @@ func ErrStatePersist(err error) error {
 
 // ErrStateLock creates an error for 500 responses
 func ErrStateLock(err error) error {
-	return harkInternalServerError{500003, "failed to lock state for writing: " + err.Error()}
+	return harkInternalServerError{500003, "failed to lock state: " + err.Error()}
 }
 
 // ErrUserLookup creates an error for 500 responses
@@ -108,3 +225,53 @@ func ErrUserLookup(err error) error {
 func ErrStateInitialization(err error) error {
 	return harkInternalServerError{500005, "failed to persist state: " + err.Error()}
 }
+
+// ErrDriverCommand creates an error for 500 responses
+func ErrDriverCommand(command string, err error, output []byte) error {
+	return harkInternalServerError{500006, fmt.Sprintf("driver command %q failed: %s: %q", command, err, output)}
+}
+
+// ErrDriverOutput creates an error for 500 responses
+func ErrDriverOutput(command string, err error) error {
+	return harkInternalServerError{500007, fmt.Sprintf("could not parse output of driver command %q: %s", command, err)}
+}
+
+// ErrOperationInterrupted creates an error for 500 responses
+func ErrOperationInterrupted() error {
+	return harkInternalServerError{500008, "operation was interrupted by a harkd restart"}
+}
+
+// ErrStreamingUnsupported creates an error for 500 responses
+func ErrStreamingUnsupported() error {
+	return harkInternalServerError{500009, "response streaming is not supported"}
+}
+
+// ErrStateVersionUnsupported creates an error for 500 responses
+func ErrStateVersionUnsupported(version, supported int) error {
+	return harkInternalServerError{500010, fmt.Sprintf("state has schema version %d, but this harkd only supports versions up to %d: upgrade harkd to use it", version, supported)}
+}
+
+// ErrStateMigration creates an error for 500 responses
+func ErrStateMigration(from, to int, err error) error {
+	return harkInternalServerError{500011, fmt.Sprintf("failed to migrate state from schema version %d to %d: %s", from, to, err)}
+}
+
+// ErrStateCorrupt creates an error for 500 responses
+func ErrStateCorrupt(filename string, err error) error {
+	return harkInternalServerError{500012, fmt.Sprintf("state file %q is corrupt and no valid backup of it was found: %s", filename, err)}
+}
+
+// ErrUnknownStateBackend creates an error for 500 responses
+func ErrUnknownStateBackend(backend string) error {
+	return harkInternalServerError{500013, fmt.Sprintf("unknown state backend %q", backend)}
+}
+
+// ErrHandlerPanic creates an error for 500 responses
+func ErrHandlerPanic() error {
+	return harkInternalServerError{500014, "internal error while handling the request"}
+}
+
+// ErrStateLockTimeout creates an error for 503 responses
+func ErrStateLockTimeout(timeout time.Duration, holder string) error {
+	return harkServiceUnavailableError{503001, fmt.Sprintf("timed out after %s waiting for the state lock: %s", timeout, holder)}
+}
@@ -0,0 +1,181 @@
+package errors
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The reasons a field can be invalid for, as reported in a Violation.
+const (
+	// ReasonRequired is given for a field which is missing or empty.
+	ReasonRequired = "required"
+
+	// ReasonPattern is given for a field which is not in the required format.
+	ReasonPattern = "pattern"
+
+	// ReasonMinimum is given for a field which is less than its minimum.
+	ReasonMinimum = "minimum"
+
+	// ReasonMaximum is given for a field which is more than its maximum.
+	ReasonMaximum = "maximum"
+
+	// ReasonType is given for a field whose JSON value is of the wrong type.
+	ReasonType = "type"
+
+	// ReasonImmutable is given for a field which cannot be changed.
+	ReasonImmutable = "immutable"
+
+	// ReasonReadOnly is given for a field which is set by the server, and
+	// cannot be given by the client.
+	ReasonReadOnly = "readOnly"
+)
+
+// Violation is a single problem with a field of a request entity.
+type Violation struct {
+	// Field is a JSON pointer to the field, such as "/memoryMB".
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// Detailer is an error made up of problems with individual fields.
+type Detailer interface {
+	error
+	Details() []Violation
+}
+
+// Violations collects the problems found with an entity, so that all of them
+// can be reported at once.
+type Violations []Violation
+
+// Add adds a problem with the field at the given JSON pointer.
+func (v *Violations) Add(field, reason, msg string) {
+	*v = append(*v, Violation{field, reason, msg})
+}
+
+// Err returns an error reporting the problems, or nil if there are none.
+func (v Violations) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return ErrValidation(v)
+}
+
+type harkValidationError struct {
+	code       int
+	msg        string
+	violations []Violation
+}
+
+func (hv harkValidationError) Error() string {
+	return hv.msg
+}
+
+func (hv harkValidationError) Code() int {
+	return hv.code
+}
+
+func (hv harkValidationError) Details() []Violation {
+	return hv.violations
+}
+
+// ErrValidation creates an error for 400 responses
+func ErrValidation(violations []Violation) error {
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.Message
+	}
+	return harkValidationError{400002, fmt.Sprintf("Request entity invalid: %q", strings.Join(msgs, "; ")), violations}
+}
+
+// ErrDecode creates an error for 400 responses, from an error decoding a
+// request entity. A JSON value of the wrong type is reported as a problem with
+// the field holding it.
+func ErrDecode(err error) error {
+	typeErr, ok := err.(*json.UnmarshalTypeError)
+	if !ok {
+		return ErrBadRequestEntity(err)
+	}
+
+	msg := fmt.Sprintf("must be %s, but is a JSON %s", describeType(typeErr.Type), typeErr.Value)
+	if typeErr.Field != "" {
+		msg = typeErr.Field + " " + msg
+	}
+	return ErrValidation([]Violation{{jsonPointer(typeErr.Field), ReasonType, msg}})
+}
+
+// DecodeEntity decodes a JSON request entity into v, which must be a pointer.
+// json.Unmarshal reports only the first value of the wrong type it finds, so
+// if there is one each member of the entity is decoded again on its own, and
+// every member holding a value of the wrong type is reported.
+func DecodeEntity(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		return ErrDecode(err)
+	}
+
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) != nil {
+		return ErrDecode(err)
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var violations []Violation
+	for _, name := range names {
+		member, _ := json.Marshal(map[string]json.RawMessage{name: members[name]})
+		if typeErr, ok := json.Unmarshal(member, reflect.New(reflect.TypeOf(v).Elem()).Interface()).(*json.UnmarshalTypeError); ok {
+			violations = append(violations, ErrDecode(typeErr).(Detailer).Details()...)
+		}
+	}
+	if len(violations) == 0 {
+		return ErrDecode(err)
+	}
+	return ErrValidation(violations)
+}
+
+// jsonPointer converts the dotted path of a field, as given by encoding/json,
+// to a JSON pointer.
+func jsonPointer(path string) string {
+	if path == "" {
+		return ""
+	}
+	escape := strings.NewReplacer("~", "~0", "/", "~1")
+	segments := strings.Split(path, ".")
+	for i, s := range segments {
+		segments[i] = escape.Replace(s)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// describeType describes the JSON values a Go type can be decoded from.
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Ptr:
+		return describeType(t.Elem())
+	}
+	return "a " + t.String()
+}
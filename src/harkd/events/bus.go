@@ -0,0 +1,125 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultBufferSize is the number of events a bus created by NewBus keeps for
+// replay.
+const DefaultBufferSize = 1024
+
+// subscriberBufferSize is the number of events which can be waiting for a
+// subscriber before it is considered too slow and dropped.
+const subscriberBufferSize = 64
+
+// NewBus creates a new Bus which keeps the last bufferSize events for replay.
+func NewBus(bufferSize int) Bus {
+	return &bus{
+		ring:        make([]Event, bufferSize),
+		subscribers: make(map[*subscription]struct{}),
+	}
+}
+
+type bus struct {
+	mutex sync.Mutex
+
+	// ring holds the most recent events; next is the index the next event
+	// will be stored at, and count is the number of events stored.
+	ring  []Event
+	next  int
+	count int
+
+	lastID      uint64
+	subscribers map[*subscription]struct{}
+}
+
+func (b *bus) Publish(eventType string, data interface{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	ev := Event{b.lastID, eventType, time.Now().UTC(), data}
+
+	if len(b.ring) > 0 {
+		b.ring[b.next] = ev
+		b.next = (b.next + 1) % len(b.ring)
+		if b.count < len(b.ring) {
+			b.count++
+		}
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- ev:
+		default:
+			// The subscriber is not keeping up; drop it rather than block
+			// every publisher. It can resubscribe and catch up from the
+			// buffer.
+			b.unsubscribe(sub)
+		}
+	}
+}
+
+func (b *bus) Subscribe(lastID uint64) Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	replay := b.since(lastID)
+
+	sub := &subscription{
+		bus:    b,
+		events: make(chan Event, len(replay)+subscriberBufferSize),
+	}
+	for _, ev := range replay {
+		sub.events <- ev
+	}
+	b.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+// since returns the buffered events published after lastID, oldest first.
+//
+// If lastID is not in the buffer - because it has been overwritten, or
+// because it came from before harkd restarted - every buffered event is
+// returned.
+func (b *bus) since(lastID uint64) []Event {
+	events := make([]Event, 0, b.count)
+	if b.count == 0 {
+		return events
+	}
+
+	start := (b.next - b.count + len(b.ring)) % len(b.ring)
+	for i := 0; i < b.count; i++ {
+		events = append(events, b.ring[(start+i)%len(b.ring)])
+	}
+
+	if lastID < events[0].ID-1 || lastID > b.lastID {
+		return events
+	}
+	return events[lastID-(events[0].ID-1):]
+}
+
+func (b *bus) unsubscribe(sub *subscription) {
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+type subscription struct {
+	bus    *bus
+	events chan Event
+}
+
+func (s *subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	s.bus.unsubscribe(s)
+}
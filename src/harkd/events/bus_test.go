@@ -0,0 +1,101 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func publishN(b Bus, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(MachineCreated, i)
+	}
+}
+
+// drain reads the events already waiting on a subscription.
+func drain(sub Subscription) []uint64 {
+	var ids []uint64
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return ids
+			}
+			ids = append(ids, ev.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+var subscribeReplayTests = []struct {
+	name      string
+	published int
+	lastID    uint64
+	expectIDs []uint64
+}{
+	{"nothing published", 0, 0, nil},
+	{"new subscriber gets the whole buffer", 3, 0, []uint64{1, 2, 3}},
+	{"reconnecting subscriber gets missed events", 5, 3, []uint64{4, 5}},
+	{"up to date subscriber gets nothing", 5, 5, nil},
+	{"buffer overwritten since last event", 10, 2, []uint64{7, 8, 9, 10}},
+	{"last event just before the buffer", 10, 6, []uint64{7, 8, 9, 10}},
+	{"last event from before a restart", 3, 100, []uint64{1, 2, 3}},
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	for _, c := range subscribeReplayTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b := NewBus(4)
+			publishN(b, c.published)
+
+			sub := b.Subscribe(c.lastID)
+			defer sub.Close()
+
+			require.Equal(t, c.expectIDs, drain(sub))
+		})
+	}
+}
+
+func TestSubscribeLiveEvents(t *testing.T) {
+	b := NewBus(4)
+	publishN(b, 2)
+
+	sub := b.Subscribe(2)
+	defer sub.Close()
+
+	b.Publish(MachineDeleted, "foo")
+
+	ev := <-sub.Events()
+	require.Equal(t, uint64(3), ev.ID)
+	require.Equal(t, MachineDeleted, ev.Type)
+	require.Equal(t, "foo", ev.Data)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := NewBus(4)
+	sub := b.Subscribe(0)
+
+	publishN(b, subscriberBufferSize+1)
+
+	ids := drain(sub)
+	require.Len(t, ids, subscriberBufferSize)
+
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+
+	// Closing a dropped subscription is harmless
+	sub.Close()
+}
+
+func TestClose(t *testing.T) {
+	b := NewBus(4)
+	sub := b.Subscribe(0)
+	sub.Close()
+
+	b.Publish(MachineCreated, nil)
+
+	_, ok := <-sub.Events()
+	require.False(t, ok)
+}
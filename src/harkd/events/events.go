@@ -0,0 +1,66 @@
+// Package events provides an in-process bus for notifications about changes
+// in hark, such as machines being created or changing state.
+package events
+
+import (
+	"time"
+)
+
+// The types of event published by hark.
+const (
+	MachineCreated      = "machine.created"
+	MachineUpdated      = "machine.updated"
+	MachineDeleted      = "machine.deleted"
+	MachineStateChanged = "machine.state_changed"
+
+	OperationStarted  = "operation.started"
+	OperationFinished = "operation.finished"
+
+	// DriftDetected is a warning that machines in the state no longer match
+	// the VMs in their drivers' backends. Its data is a core.DriftReport.
+	DriftDetected = "system.drift_detected"
+
+	// StateExternallyModified is a notification that the state file was
+	// changed by something other than this harkd, and has been reloaded.
+	StateExternallyModified = "state.externally_modified"
+)
+
+// Event is a notification that something happened in hark.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Publisher is anything events can be published to.
+type Publisher interface {
+	Publish(eventType string, data interface{})
+}
+
+// Bus is a Publisher which delivers events to subscribers.
+type Bus interface {
+	Publisher
+
+	// Subscribe subscribes to every event published after the one with the
+	// given ID. Events which have already been published are replayed from a
+	// bounded buffer, so a subscriber reconnecting after a short gap does not
+	// miss any.
+	Subscribe(lastID uint64) Subscription
+}
+
+// Subscription is a subscriber's view of a Bus.
+type Subscription interface {
+	// Events delivers events in the order they were published. It is closed
+	// if the subscriber falls too far behind, after which it should
+	// resubscribe from the last event it saw.
+	Events() <-chan Event
+
+	Close()
+}
+
+// StateChange is the data of a MachineStateChanged event.
+type StateChange struct {
+	MachineID string `json:"machineID"`
+	State     string `json:"state"`
+}
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"harkd/context"
+	"harkd/errors"
+	"harkd/events"
+
+	"github.com/ceralena/go-restroute"
+)
+
+// eventKeepAliveInterval is how often a comment is sent on an idle event
+// stream, so that proxies do not time the connection out.
+const eventKeepAliveInterval = 30 * time.Second
+
+type eventRouter struct {
+	bus events.Bus
+	responseWriter
+	context.Factory
+
+	// done is closed when the server is shutting down, which ends every
+	// stream.
+	done <-chan struct{}
+}
+
+func newEventRouter(ctxFactory context.Factory, done <-chan struct{}) eventRouter {
+	return eventRouter{
+		ctxFactory.GetContext().GetEventBus(),
+		newResponseWriter(),
+		ctxFactory,
+		done,
+	}
+}
+
+func (er eventRouter) getRouteMap() restroute.Map {
+	return restroute.Map{
+		"^/events$": restroute.MethodMap{
+			"GET": er.streamEvents,
+		},
+	}
+}
+
+// streamEvents streams events to the client as server-sent events, until the
+// client goes away or the server shuts down.
+//
+// Clients reconnecting after a dropped connection send the ID of the last
+// event they saw in the Last-Event-ID header, and are sent the events they
+// missed first.
+func (er eventRouter) streamEvents(req restroute.Request) {
+	flusher, ok := req.W.(http.Flusher)
+	if !ok {
+		er.WriteResponse(req.W, errors.ErrStreamingUnsupported())
+		return
+	}
+
+	lastID, err := getLastEventID(req)
+	if err != nil {
+		er.WriteResponse(req.W, err)
+		return
+	}
+
+	sub := er.bus.Subscribe(lastID)
+	defer sub.Close()
+
+	h := req.W.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	req.W.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// We fell behind; the client will reconnect and catch up.
+				return
+			}
+			if err := writeEvent(req.W, ev); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(req.W, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.R.Context().Done():
+			return
+		case <-er.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// getLastEventID reads the ID of the last event a client saw. Browsers send it
+// as a header when an EventSource reconnects; other clients may find the
+// query parameter easier.
+func getLastEventID(req restroute.Request) (uint64, error) {
+	name, raw := "Last-Event-ID", req.R.Header.Get("Last-Event-ID")
+	if raw == "" {
+		name, raw = "lastEventId", req.R.URL.Query().Get("lastEventId")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, errors.ErrInvalidQueryParam(name, raw)
+	}
+	return id, nil
+}
+
+func writeEvent(w http.ResponseWriter, ev events.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
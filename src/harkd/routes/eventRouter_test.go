@@ -0,0 +1,190 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"harkd/dal"
+	"harkd/events"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testEventServer serves the event stream from a bus over HTTP, through the
+// router. Closing done ends the streams being served.
+func testEventServer(t *testing.T) (*httptest.Server, events.Bus, chan struct{}) {
+	ctx := &testContext{dal.NewMemoryDal(), events.NewBus(events.DefaultBufferSize)}
+	done := make(chan struct{})
+	h, err := newRouter(newEventRouter(ctx, done).getRouteMap())
+	require.NoError(t, err)
+	return httptest.NewServer(h), ctx.events, done
+}
+
+// sseEvent is an event as framed on the stream.
+type sseEvent struct {
+	id, event string
+	data      events.Event
+}
+
+// readEvent reads the next event from a stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	read := make(chan sseEvent, 1)
+	go func() {
+		var ev sseEvent
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(read)
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && ev.id != "":
+				read <- ev
+				return
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			}
+		}
+	}()
+
+	select {
+	case ev, ok := <-read:
+		require.True(t, ok, "the stream ended")
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was sent")
+		return sseEvent{}
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	cases := []struct {
+		name      string
+		header    string
+		query     string
+		expectIDs []string
+	}{
+		{"everything buffered", "", "", []string{"1", "2", "3", "4"}},
+		{"replayed from the header", "1", "", []string{"2", "3", "4"}},
+		{"replayed from the query", "", "?lastEventId=2", []string{"3", "4"}},
+		{"header preferred to the query", "2", "?lastEventId=1", []string{"3", "4"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			srv, bus, done := testEventServer(t)
+			defer srv.Close()
+			defer close(done)
+			for i := 0; i < 3; i++ {
+				bus.Publish(events.MachineCreated, i)
+			}
+
+			req, err := http.NewRequest("GET", srv.URL+"/events"+c.query, nil)
+			require.NoError(t, err)
+			if c.header != "" {
+				req.Header.Set("Last-Event-ID", c.header)
+			}
+
+			// Execute
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			r := bufio.NewReader(res.Body)
+			bus.Publish(events.MachineDeleted, "foo")
+
+			// Assert
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+			require.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+			for i, id := range c.expectIDs {
+				ev := readEvent(t, r)
+				require.Equal(t, id, ev.id)
+				require.Equal(t, id, strconv.FormatUint(ev.data.ID, 10))
+				require.Equal(t, ev.event, ev.data.Type)
+
+				// The stream ends with the live event.
+				expectType := events.MachineCreated
+				if i == len(c.expectIDs)-1 {
+					expectType = events.MachineDeleted
+				}
+				require.Equal(t, expectType, ev.event)
+			}
+		})
+	}
+}
+
+func TestStreamEventsEnds(t *testing.T) {
+	// Prepare
+	srv, _, done := testEventServer(t)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/events")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	// Execute
+	close(done)
+
+	// Assert: the stream ends when the server shuts down.
+	ended := make(chan error, 1)
+	go func() {
+		_, err := bufio.NewReader(res.Body).ReadString('\n')
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not end")
+	}
+}
+
+func TestStreamEventsInvalidLastEventID(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		query  string
+	}{
+		{"header", "abc", ""},
+		{"query", "", "?lastEventId=-1"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			srv, _, done := testEventServer(t)
+			defer srv.Close()
+			defer close(done)
+
+			req, err := http.NewRequest("GET", srv.URL+"/events"+c.query, nil)
+			require.NoError(t, err)
+			if c.header != "" {
+				req.Header.Set("Last-Event-ID", c.header)
+			}
+
+			// Execute
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			// Assert
+			require.Equal(t, http.StatusBadRequest, res.StatusCode)
+			var body testResponse
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			requireErrorCode(t, 400003, body)
+		})
+	}
+}
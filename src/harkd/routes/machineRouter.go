@@ -1,13 +1,24 @@
 package routes
 
 import (
+	"fmt"
+	"strconv"
+
 	"harkd/context"
 	"harkd/core"
+	"harkd/errors"
 	"harkd/services"
 
 	"github.com/ceralena/go-restroute"
 )
 
+const machinePathPrefix = apiV1Prefix + "/machine/"
+
+// machinePath is the path of the resource for a single machine.
+func machinePath(machineID string) string {
+	return machinePathPrefix + machineID
+}
+
 type machineRouter struct {
 	service services.MachineService
 	responseWriter
@@ -15,9 +26,9 @@ type machineRouter struct {
 	context.Factory
 }
 
-func newMachineRouter(ctxFactory context.Factory) machineRouter {
+func newMachineRouter(ctxFactory context.Factory, operations services.OperationService) machineRouter {
 	return machineRouter{
-		services.NewMachineService(ctxFactory),
+		services.NewMachineService(ctxFactory, operations),
 		newResponseWriter(),
 		jsonRequestDecoder(),
 		ctxFactory,
@@ -26,25 +37,69 @@ func newMachineRouter(ctxFactory context.Factory) machineRouter {
 
 func (mr machineRouter) getRouteMap() restroute.Map {
 	return restroute.Map{
-		"^/api/machine$": restroute.MethodMap{
-			"GET": mr.getMachines,
-			"PUT": mr.createMachine,
+		"^/machine$": restroute.MethodMap{
+			"GET":  mr.getMachines,
+			"PUT":  mr.createMachine,
+			"POST": mr.createMachineWithNewID,
+		},
+		`^/machine/(?P<machine_id>[\w-]+)$`: restroute.MethodMap{
+			"GET":    mr.getMachineByID,
+			"PATCH":  mr.updateMachine,
+			"DELETE": mr.deleteMachine,
+		},
+		`^/machine/(?P<machine_id>[\w-]+)/state$`: restroute.MethodMap{
+			"GET": mr.getMachineState,
+		},
+		`^/machine/(?P<machine_id>[\w-]+)/history$`: restroute.MethodMap{
+			"GET": mr.getMachineHistory,
 		},
-		`^/api/machine/(?P<machine_id>\w+)$`: restroute.MethodMap{
-			"GET": mr.getMachineByID,
+		`^/machine/(?P<machine_id>[\w-]+)/history/(?P<revision>\d+)/restore$`: restroute.MethodMap{
+			"POST": mr.restoreMachine,
+		},
+		`^/machine/(?P<machine_id>[\w-]+)/(?P<action>start|stop|restart|pause|resume|save)$`: restroute.MethodMap{
+			"POST": mr.powerAction,
 		},
 	}
 }
 
 func (mr machineRouter) getMachines(req restroute.Request) {
-	machines, err := mr.service.GetMachines()
+	q, err := getMachineQuery(req)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
+
+	page, err := mr.service.ListMachines(q)
 	if err != nil {
 		mr.WriteResponse(req.W, err)
 	} else {
-		mr.WriteResponse(req.W, machines)
+		mr.WriteResponse(req.W, listPage{page.Machines, listMeta{page.Total, page.NextCursor}})
 	}
 }
 
+// getMachineQuery reads the filters, order and page of a machine list from
+// the query string.
+func getMachineQuery(req restroute.Request) (core.MachineQuery, error) {
+	params := req.R.URL.Query()
+	q := core.MachineQuery{
+		Name:   params.Get("name"),
+		Driver: params.Get("driver"),
+		Cursor: params.Get("cursor"),
+	}
+
+	var err error
+	if state := params.Get("state"); state != "" {
+		if q.State, err = core.ParseMachineState(state); err != nil {
+			return q, err
+		}
+	}
+	if q.Sort, err = core.ParseMachineSort(params.Get("sort")); err != nil {
+		return q, err
+	}
+	q.Limit, err = getLimitQueryParam(req, "limit")
+	return q, err
+}
+
 func (mr machineRouter) createMachine(req restroute.Request) {
 	// Parse the machine from the request body
 	var machine core.Machine
@@ -55,13 +110,36 @@ func (mr machineRouter) createMachine(req restroute.Request) {
 	}
 
 	// Get the service to create the machine
-	err = mr.service.CreateMachine(machine)
+	op, err := mr.service.CreateMachine(machine)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteAccepted(req.W, op)
+	}
+}
+
+func (mr machineRouter) createMachineWithNewID(req restroute.Request) {
+	// The machine has no ID yet, so it can only be validated once the
+	// service has generated one.
+	payload, err := mr.DecodeRaw(req.R.Body)
 	if err != nil {
 		mr.WriteResponse(req.W, err)
 		return
 	}
+	var machine core.Machine
+	if err := errors.DecodeEntity(payload, &machine); err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
 
-	mr.WriteResponseWithStatus(req.W, 201, nil)
+	created, op, err := mr.service.CreateMachineWithNewID(machine)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
+
+	setETag(req.W, created.Revision)
+	mr.WriteCreated(req.W, machinePath(created.ID), createdEntity{created, createdMeta{op}})
 }
 
 func (mr machineRouter) getMachineByID(req restroute.Request) {
@@ -70,6 +148,102 @@ func (mr machineRouter) getMachineByID(req restroute.Request) {
 	if err != nil {
 		mr.WriteResponse(req.W, err)
 	} else {
+		setETag(req.W, m.Revision)
 		mr.WriteResponse(req.W, m)
 	}
 }
+
+func (mr machineRouter) getMachineState(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+	state, err := mr.service.GetMachineState(machineID)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteResponse(req.W, state)
+	}
+}
+
+func (mr machineRouter) getMachineHistory(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+	history, err := mr.service.GetMachineHistory(machineID)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteResponse(req.W, history)
+	}
+}
+
+func (mr machineRouter) restoreMachine(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+
+	// The route only matches digits, so the revision can only be invalid by
+	// being too large.
+	revision, err := strconv.ParseUint(req.Params["revision"], 10, 64)
+	if err != nil {
+		var v errors.Violations
+		v.Add("/revision", errors.ReasonMaximum, fmt.Sprintf("revision %s is larger than any revision", req.Params["revision"]))
+		mr.WriteResponse(req.W, v.Err())
+		return
+	}
+
+	op, err := mr.service.RestoreMachine(machineID, revision, getPrecondition(req.R))
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteAccepted(req.W, op)
+	}
+}
+
+func (mr machineRouter) updateMachine(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+
+	// The payload is a merge patch rather than a full machine, so it is only
+	// validated once it has been applied.
+	patch, err := mr.DecodeRaw(req.R.Body)
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
+
+	op, err := mr.service.UpdateMachine(machineID, patch, getPrecondition(req.R))
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteAccepted(req.W, op)
+	}
+}
+
+func (mr machineRouter) deleteMachine(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+
+	force, err := getBoolQueryParam(req, "force")
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
+
+	op, err := mr.service.DeleteMachine(machineID, force, getPrecondition(req.R))
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteAccepted(req.W, op)
+	}
+}
+
+func (mr machineRouter) powerAction(req restroute.Request) {
+	machineID := req.Params["machine_id"]
+	action := core.Action(req.Params["action"])
+
+	force, err := getBoolQueryParam(req, "force")
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+		return
+	}
+
+	op, err := mr.service.PowerAction(machineID, action, force, getPrecondition(req.R))
+	if err != nil {
+		mr.WriteResponse(req.W, err)
+	} else {
+		mr.WriteAccepted(req.W, op)
+	}
+}
@@ -0,0 +1,485 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"harkd/core"
+	"harkd/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+// patchMachine changes a machine's memory through the API, and waits for the
+// change to be saved.
+func (api testAPI) patchMachine(t *testing.T, id string, memoryMB int) {
+	w, res := api.do(t, "PATCH", "/machine/"+id, fmt.Sprintf(`{"payload":{"memoryMB":%d}}`, memoryMB))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	op := api.finishOperation(t, res)
+	require.Equal(t, core.OperationSucceeded, op.Status, string(op.Result))
+}
+
+// finishOperation waits for the operation accepted in a response to finish.
+func (api testAPI) finishOperation(t *testing.T, res testResponse) core.Operation {
+	var op core.Operation
+	require.NoError(t, json.Unmarshal(res.Payload, &op))
+	return api.waitForOperation(t, op.ID)
+}
+
+// etag returns the ETag of a machine's current revision. Revisions are shared
+// with operations, so a machine's next revision cannot be known in advance.
+func (api testAPI) etag(t *testing.T, id string) string {
+	w, _ := api.do(t, "GET", "/machine/"+id, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	return w.Header().Get("ETag")
+}
+
+// machineResult returns the machine an operation resulted in.
+func machineResult(t *testing.T, op core.Operation) core.Machine {
+	require.Equal(t, core.OperationSucceeded, op.Status)
+	var m core.Machine
+	require.NoError(t, json.Unmarshal(op.Result, &m))
+	return m
+}
+
+// listMachines lists machines through the API, and returns their IDs and the
+// meta of the page.
+func (api testAPI) listMachines(t *testing.T, query string) ([]string, listMeta) {
+	w, res := api.do(t, "GET", "/machine"+query, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var machines []core.Machine
+	require.NoError(t, json.Unmarshal(res.Payload, &machines))
+	var meta listMeta
+	require.NoError(t, json.Unmarshal(res.Meta, &meta))
+
+	ids := []string{}
+	for _, m := range machines {
+		ids = append(ids, m.ID)
+	}
+	return ids, meta
+}
+
+func TestListMachinesRoute(t *testing.T) {
+	cases := []struct {
+		name        string
+		query       string
+		expectIDs   []string
+		expectTotal int
+	}{
+		{"everything, in creation order", "", []string{"c", "a", "b"}, 3},
+		{"by name", "?name=a", []string{"a"}, 1},
+		{"by driver", "?driver=fake", []string{"c", "a", "b"}, 3},
+		{"by other driver", "?driver=virtualbox", []string{}, 0},
+		{"by state", "?state=running", []string{"a"}, 1},
+		{"with no vm", "?state=unknown", []string{"b"}, 1},
+		{"sorted", "?sort=-name", []string{"c", "b", "a"}, 3},
+		{"first page", "?sort=name&limit=2", []string{"a", "b"}, 3},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "c", core.StatePoweroff)
+			api.saveMachine(t, "a", core.StateRunning)
+			api.saveMachine(t, "b", core.StateUnknown)
+
+			// Execute
+			ids, meta := api.listMachines(t, c.query)
+
+			// Assert
+			require.Equal(t, c.expectIDs, ids)
+			require.Equal(t, c.expectTotal, meta.Total)
+		})
+	}
+}
+
+func TestListMachinesRoutePages(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	for _, id := range []string{"c", "a", "d", "b"} {
+		api.saveMachine(t, id, core.StatePoweroff)
+	}
+
+	// Execute: list every page.
+	var pages [][]string
+	query := "?limit=3"
+	for {
+		ids, meta := api.listMachines(t, query)
+		require.Equal(t, 4, meta.Total)
+		pages = append(pages, ids)
+		if meta.NextCursor == "" {
+			break
+		}
+		query = "?limit=3&cursor=" + url.QueryEscape(meta.NextCursor)
+	}
+
+	// Assert
+	require.Equal(t, [][]string{{"c", "a", "d"}, {"b"}}, pages)
+}
+
+func TestListMachinesRouteInvalidParams(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+	}{
+		{"unknown state", "?state=sleeping"},
+		{"unknown sort field", "?sort=revision"},
+		{"limit not a number", "?limit=ten"},
+		{"limit too small", "?limit=0"},
+		{"cursor not a cursor", "?cursor=!!"},
+		{"cursor for another order", "?sort=name&cursor=" + url.QueryEscape(creationOrderCursor(t))},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+
+			// Execute
+			w, res := api.do(t, "GET", "/machine"+c.query, "")
+
+			// Assert
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			requireErrorCode(t, 400003, res)
+		})
+	}
+}
+
+// creationOrderCursor returns a cursor for a page of machines listed in the
+// order they were created.
+func creationOrderCursor(t *testing.T) string {
+	page, err := core.SelectMachines([]core.Machine{{ID: "a"}, {ID: "b"}}, core.MachineQuery{Limit: 1}, nil)
+	require.NoError(t, err)
+	return page.NextCursor
+}
+
+func TestMachineETagRoutes(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+
+	// Execute
+	created, res := api.do(t, "PUT", "/machine", `{"payload":{"id":"foo","name":"foo","memoryMB":512,"driver":"fake"}}`)
+	require.Equal(t, http.StatusAccepted, created.Code, created.Body.String())
+	api.finishOperation(t, res)
+	gotCreated, _ := api.do(t, "GET", "/machine/foo", "")
+
+	patched, res := api.do(t, "PATCH", "/machine/foo", `{"payload":{"memoryMB":1024}}`, "If-Match", gotCreated.Header().Get("ETag"))
+	require.Equal(t, http.StatusAccepted, patched.Code, patched.Body.String())
+	api.finishOperation(t, res)
+	gotPatched, _ := api.do(t, "GET", "/machine/foo", "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, gotCreated.Code)
+	require.Equal(t, `"1"`, gotCreated.Header().Get("ETag"))
+	require.Equal(t, http.StatusOK, gotPatched.Code)
+	saved, err := api.ctx.dal.GetMachineByID("foo")
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf(`"%d"`, saved.Revision), gotPatched.Header().Get("ETag"))
+	require.NotEqual(t, gotCreated.Header().Get("ETag"), gotPatched.Header().Get("ETag"))
+}
+
+func TestCreateMachineWithNewIDRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+
+	// Execute
+	w, res := api.do(t, "POST", "/machine", `{"payload":{"name":"web","memoryMB":512,"driver":"fake"}}`)
+
+	// Assert: the machine was created with a generated ID.
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created core.Machine
+	require.NoError(t, json.Unmarshal(res.Payload, &created))
+	require.Regexp(t, `^[0-9A-Z]{26}$`, created.ID)
+	require.Equal(t, core.Machine{ID: created.ID, Name: "web", MemoryMB: 512, Driver: "fake", Revision: 1}, created)
+	require.Equal(t, `"1"`, w.Header().Get("ETag"))
+	require.Equal(t, apiV1Prefix+"/machine/"+created.ID, w.Header().Get("Location"))
+
+	// Its VM is created by the operation in the meta.
+	var meta createdMeta
+	require.NoError(t, json.Unmarshal(res.Meta, &meta))
+	require.Equal(t, "machine.create", meta.Operation.Type)
+	require.Equal(t, created.ID, meta.Operation.MachineID)
+	op := api.waitForOperation(t, meta.Operation.ID)
+	require.Equal(t, created, machineResult(t, op))
+	_, ok := api.backend.GetVM(created.ID)
+	require.True(t, ok)
+
+	// The machine can be found where the Location header points.
+	got, res := api.do(t, "GET", strings.TrimPrefix(w.Header().Get("Location"), apiV1Prefix), "")
+	require.Equal(t, http.StatusOK, got.Code, got.Body.String())
+	var m core.Machine
+	require.NoError(t, json.Unmarshal(res.Payload, &m))
+	require.Equal(t, created, m)
+}
+
+func TestDashedMachineIDRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	w, res := api.do(t, "PUT", "/machine", `{"payload":{"id":"web-1","name":"web","memoryMB":512,"driver":"fake"}}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	api.finishOperation(t, res)
+
+	// Execute
+	w, res = api.do(t, "GET", "/machine/web-1", "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var m core.Machine
+	require.NoError(t, json.Unmarshal(res.Payload, &m))
+	require.Equal(t, "web-1", m.ID)
+}
+
+func TestCreateAndUpdateMachineOperations(t *testing.T) {
+	cases := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectType   string
+		expectMemory uint
+	}{
+		{"create", "PUT", "/machine", `{"payload":{"id":"bar","name":"bar","memoryMB":256,"driver":"fake"}}`, "machine.create", 256},
+		{"update", "PATCH", "/machine/foo", `{"payload":{"memoryMB":1024}}`, "machine.update", 1024},
+		{"restore", "POST", "/machine/foo/history/1/restore", "", "machine.restore", 512},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+			api.patchMachine(t, "foo", 768)
+
+			// Execute
+			w, res := api.do(t, c.method, c.path, c.body)
+			op := api.finishOperation(t, res)
+
+			// Assert: the request was accepted, and the VM was configured in
+			// the background.
+			require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+			require.Equal(t, operationPath(op.ID), w.Header().Get("Location"))
+			require.Empty(t, w.Header().Get("ETag"))
+			require.Equal(t, c.expectType, op.Type)
+
+			m := machineResult(t, op)
+			require.Equal(t, op.MachineID, m.ID)
+			require.Equal(t, c.expectMemory, m.MemoryMB)
+			saved, err := api.ctx.dal.GetMachineByID(m.ID)
+			require.NoError(t, err)
+			require.Equal(t, m, saved)
+			vm, ok := api.backend.GetVM(m.ID)
+			require.True(t, ok)
+			require.Equal(t, c.expectMemory, vm.MemoryMB)
+		})
+	}
+}
+
+func TestUpdateRunningMachineRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StateRunning)
+
+	// Execute
+	w, res := api.do(t, "PATCH", "/machine/foo", `{"payload":{"memoryMB":1024}}`)
+
+	// Assert: the change is refused rather than accepted only to fail.
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	requireErrorCode(t, 409002, res)
+	ops, err := api.operations.GetOperations()
+	require.NoError(t, err)
+	require.Empty(t, ops)
+}
+
+func TestMachinePreconditionRoutes(t *testing.T) {
+	// "current" stands for the ETag of the machine's current revision.
+	cases := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		ifMatch      string
+		expectStatus int
+	}{
+		{"update", "PATCH", "/machine/foo", `{"payload":{"name":"bar"}}`, "current", http.StatusAccepted},
+		{"update with a stale revision", "PATCH", "/machine/foo", `{"payload":{"name":"bar"}}`, `"1"`, http.StatusPreconditionFailed},
+		{"delete", "DELETE", "/machine/foo", "", "current", http.StatusAccepted},
+		{"delete with a stale revision", "DELETE", "/machine/foo", "", `"1"`, http.StatusPreconditionFailed},
+		{"power action", "POST", "/machine/foo/start", "", `"1", current`, http.StatusAccepted},
+		{"power action with a stale revision", "POST", "/machine/foo/start", "", `"1"`, http.StatusPreconditionFailed},
+		{"any revision", "POST", "/machine/foo/start", "", "*", http.StatusAccepted},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+			api.patchMachine(t, "foo", 1024)
+			ifMatch := strings.Replace(c.ifMatch, "current", api.etag(t, "foo"), 1)
+
+			// Execute
+			w, res := api.do(t, c.method, c.path, c.body, "If-Match", ifMatch)
+
+			// Assert
+			require.Equal(t, c.expectStatus, w.Code, w.Body.String())
+			if c.expectStatus == http.StatusPreconditionFailed {
+				requireErrorCode(t, 412001, res)
+				require.Empty(t, w.Header().Get("ETag"))
+				ops, err := api.operations.GetOperations()
+				require.NoError(t, err)
+				require.Len(t, ops, 1, "only the update made while preparing")
+			} else {
+				api.finishOperation(t, res)
+			}
+
+			saved, err := api.ctx.dal.GetMachineByID("foo")
+			if c.name == "delete" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.name == "update", saved.Name == "bar")
+		})
+	}
+}
+
+func TestMachineHistoryRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StatePoweroff)
+	api.patchMachine(t, "foo", 1024)
+
+	// Execute
+	w, res := api.do(t, "GET", "/machine/foo/history", "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, w.Code)
+	var history []core.MachineVersion
+	require.NoError(t, json.Unmarshal(res.Payload, &history))
+	require.Len(t, history, 2)
+	require.Equal(t, uint64(1), history[0].Revision)
+	require.Empty(t, history[0].Changes)
+	saved, err := api.ctx.dal.GetMachineByID("foo")
+	require.NoError(t, err)
+	require.Equal(t, saved.Revision, history[1].Revision)
+	require.Equal(t, []core.FieldChange{{Field: "memoryMB", From: float64(512), To: float64(1024)}}, history[1].Changes)
+
+	w, res = api.do(t, "GET", "/machine/nothing/history", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	requireErrorCode(t, 404001, res)
+}
+
+func TestRestoreMachineRoute(t *testing.T) {
+	cases := []struct {
+		name         string
+		path         string
+		ifMatch      string
+		expectStatus int
+		expectCode   int
+		expectMemory uint
+	}{
+		{"restore", "/machine/foo/history/1/restore", "", http.StatusAccepted, 0, 512},
+		{"matching revision", "/machine/foo/history/1/restore", "current", http.StatusAccepted, 0, 512},
+		{"stale revision", "/machine/foo/history/1/restore", `"1"`, http.StatusPreconditionFailed, 412001, 1024},
+		{"unknown revision", "/machine/foo/history/99/restore", "", http.StatusNotFound, 404004, 1024},
+		{"unknown machine", "/machine/nothing/history/1/restore", "", http.StatusNotFound, 404001, 1024},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+			api.patchMachine(t, "foo", 1024)
+			patched := api.etag(t, "foo")
+
+			var headers []string
+			if c.ifMatch != "" {
+				headers = []string{"If-Match", strings.Replace(c.ifMatch, "current", patched, 1)}
+			}
+
+			// Execute
+			w, res := api.do(t, "POST", c.path, "", headers...)
+
+			// Assert
+			require.Equal(t, c.expectStatus, w.Code, w.Body.String())
+			if c.expectCode != 0 {
+				requireErrorCode(t, c.expectCode, res)
+				require.Empty(t, w.Header().Get("ETag"))
+			} else {
+				m := machineResult(t, api.finishOperation(t, res))
+				require.NotEqual(t, patched, fmt.Sprintf(`"%d"`, m.Revision))
+			}
+
+			saved, err := api.ctx.dal.GetMachineByID("foo")
+			require.NoError(t, err)
+			require.Equal(t, c.expectMemory, saved.MemoryMB)
+		})
+	}
+}
+
+func TestMachineRouteViolations(t *testing.T) {
+	cases := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		expectDetails []errors.Violation
+	}{
+		{
+			"create with an id",
+			"POST", "/machine", `{"payload":{"id":"foo","name":"foo","memoryMB":512}}`,
+			[]errors.Violation{{Field: "/id", Reason: errors.ReasonReadOnly, Message: "machine id is generated by the server; use PUT to choose one"}},
+		},
+		{
+			"create with an id and no name",
+			"POST", "/machine", `{"payload":{"id":"foo","memoryMB":512}}`,
+			[]errors.Violation{
+				{Field: "/id", Reason: errors.ReasonReadOnly, Message: "machine id is generated by the server; use PUT to choose one"},
+				{Field: "/name", Reason: errors.ReasonRequired, Message: "machine name cannot be empty"},
+			},
+		},
+		{
+			"create with wrong types",
+			"POST", "/machine", `{"payload":{"name":1,"memoryMB":"512"}}`,
+			[]errors.Violation{
+				{Field: "/memoryMB", Reason: errors.ReasonType, Message: "memoryMB must be a non-negative integer, but is a JSON string"},
+				{Field: "/name", Reason: errors.ReasonType, Message: "name must be a string, but is a JSON number"},
+			},
+		},
+		{
+			"restore a revision too large",
+			"POST", "/machine/foo/history/18446744073709551616/restore", "",
+			[]errors.Violation{{Field: "/revision", Reason: errors.ReasonMaximum, Message: "revision 18446744073709551616 is larger than any revision"}},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+
+			// Execute
+			w, res := api.do(t, c.method, c.path, c.body)
+
+			// Assert
+			require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			requireErrorCode(t, 400002, res)
+			require.Equal(t, c.expectDetails, res.Details)
+		})
+	}
+}
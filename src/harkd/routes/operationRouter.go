@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"harkd/context"
+	"harkd/services"
+
+	"github.com/ceralena/go-restroute"
+)
+
+const operationPathPrefix = apiV1Prefix + "/operation/"
+
+// operationPath is the path of the resource for a single operation.
+func operationPath(operationID string) string {
+	return operationPathPrefix + operationID
+}
+
+type operationRouter struct {
+	service services.OperationService
+	responseWriter
+	context.Factory
+}
+
+func newOperationRouter(ctxFactory context.Factory, operations services.OperationService) operationRouter {
+	return operationRouter{
+		operations,
+		newResponseWriter(),
+		ctxFactory,
+	}
+}
+
+func (or operationRouter) getRouteMap() restroute.Map {
+	return restroute.Map{
+		"^/operation$": restroute.MethodMap{
+			"GET": or.getOperations,
+		},
+		`^/operation/(?P<operation_id>\w+)$`: restroute.MethodMap{
+			"GET":    or.getOperationByID,
+			"DELETE": or.cancelOperation,
+		},
+	}
+}
+
+func (or operationRouter) getOperations(req restroute.Request) {
+	operations, err := or.service.GetOperations()
+	if err != nil {
+		or.WriteResponse(req.W, err)
+	} else {
+		or.WriteResponse(req.W, operations)
+	}
+}
+
+func (or operationRouter) getOperationByID(req restroute.Request) {
+	operationID := req.Params["operation_id"]
+	op, err := or.service.GetOperation(operationID)
+	if err != nil {
+		or.WriteResponse(req.W, err)
+	} else {
+		or.WriteResponse(req.W, op)
+	}
+}
+
+func (or operationRouter) cancelOperation(req restroute.Request) {
+	operationID := req.Params["operation_id"]
+	op, err := or.service.CancelOperation(operationID)
+	if err != nil {
+		or.WriteResponse(req.W, err)
+	} else {
+		or.WriteAccepted(req.W, op)
+	}
+}
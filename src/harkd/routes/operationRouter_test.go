@@ -0,0 +1,146 @@
+package routes
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/events"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startOperation starts an operation with a request, checking that it is
+// accepted, and returns it.
+func (api testAPI) startOperation(t *testing.T, method, path string) core.Operation {
+	w, res := api.do(t, method, path, "")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var op core.Operation
+	require.NoError(t, json.Unmarshal(res.Payload, &op))
+	require.Equal(t, operationPath(op.ID), w.Header().Get("Location"))
+	return op
+}
+
+func TestPowerActionOperation(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StateRunning)
+
+	// Execute
+	started := api.startOperation(t, "POST", "/machine/foo/stop")
+	op := api.waitForOperation(t, started.ID)
+
+	// Assert
+	require.Equal(t, "machine.stop", started.Type)
+	require.Equal(t, "foo", started.MachineID)
+	require.Equal(t, core.OperationSucceeded, op.Status)
+
+	var info core.RuntimeInfo
+	require.NoError(t, json.Unmarshal(op.Result, &info))
+	require.Equal(t, core.StatePoweroff, info.State)
+}
+
+func TestDeleteMachineOperation(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StatePoweroff)
+
+	// Execute
+	started := api.startOperation(t, "DELETE", "/machine/foo")
+	op := api.waitForOperation(t, started.ID)
+
+	// Assert
+	require.Equal(t, core.OperationSucceeded, op.Status)
+	w, res := api.do(t, "GET", "/machine/foo", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	requireErrorCode(t, 404001, res)
+	_, ok := api.backend.GetVM("foo")
+	require.False(t, ok)
+}
+
+func TestDeleteMachineOperationWithoutDriver(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StateUnknown)
+	api.backend.SetInstalled(false)
+
+	// Execute
+	started := api.startOperation(t, "DELETE", "/machine/foo")
+	op := api.waitForOperation(t, started.ID)
+
+	// Assert: the machine was removed without calling the driver.
+	require.Equal(t, core.OperationSucceeded, op.Status)
+	w, res := api.do(t, "GET", "/machine/foo", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	requireErrorCode(t, 404001, res)
+	require.Empty(t, api.backend.GetCalls())
+}
+
+func TestFailedOperation(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StatePoweroff)
+	api.backend.SetFail("Start", fmt.Errorf("no room"))
+
+	// Execute
+	started := api.startOperation(t, "POST", "/machine/foo/start")
+	op := api.waitForOperation(t, started.ID)
+
+	// Assert
+	require.Equal(t, core.OperationFailed, op.Status)
+	require.NotNil(t, op.Error)
+	require.Equal(t, "no room", op.Error.Message)
+}
+
+func TestCancelOperationRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	running := make(chan struct{})
+	started, err := api.operations.StartOperation("test", "", func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		close(running)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, err)
+	<-running
+
+	// Execute
+	cancelled := api.startOperation(t, "DELETE", "/operation/"+started.ID)
+	op := api.waitForOperation(t, started.ID)
+
+	// Assert
+	require.Equal(t, started.ID, cancelled.ID)
+	require.Equal(t, core.OperationCancelled, op.Status)
+
+	// Cancelling an operation which has finished is a conflict.
+	w, res := api.do(t, "DELETE", "/operation/"+started.ID, "")
+	require.Equal(t, http.StatusConflict, w.Code)
+	requireErrorCode(t, 409004, res)
+
+	w, res = api.do(t, "DELETE", "/operation/nothing", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	requireErrorCode(t, 404003, res)
+}
+
+func TestOrphanedOperationRoute(t *testing.T) {
+	// Prepare: an operation left running by a process which has stopped.
+	ctx := &testContext{dal.NewMemoryDal(), events.NewBus(events.DefaultBufferSize)}
+	require.NoError(t, ctx.dal.PutOperation(core.Operation{ID: "orphan", Type: "machine.start", Status: core.OperationRunning}))
+
+	// Execute
+	api := newTestAPIWithContext(t, ctx)
+	op := api.waitForOperation(t, "orphan")
+
+	// Assert
+	require.Equal(t, core.OperationFailed, op.Status)
+	require.Equal(t, 500008, op.Error.Code())
+
+	w, res := api.do(t, "DELETE", "/operation/orphan", "")
+	require.Equal(t, http.StatusConflict, w.Code)
+	requireErrorCode(t, 409004, res)
+}
@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"harkd/core"
+)
+
+// etag is the entity tag for an entity at a revision.
+func etag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+// setETag tells the client the revision of the entity in the response.
+func setETag(w http.ResponseWriter, revision uint64) {
+	w.Header().Set("ETag", etag(revision))
+}
+
+// getPrecondition reads the If-Match header of a request. Without one, any
+// revision is accepted.
+func getPrecondition(req *http.Request) core.Precondition {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	return ifMatch(header)
+}
+
+// ifMatch parses an If-Match header (RFC 7232). It matches any revision if it
+// is "*", and otherwise only the revisions of the entity tags it lists. Weak
+// tags never match, since If-Match uses strong comparison.
+func ifMatch(header string) core.Precondition {
+	if strings.TrimSpace(header) == "*" {
+		return func(uint64) bool { return true }
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tags = append(tags, strings.TrimSpace(tag))
+	}
+	return func(revision uint64) bool {
+		for _, tag := range tags {
+			if tag == etag(revision) {
+				return true
+			}
+		}
+		return false
+	}
+}
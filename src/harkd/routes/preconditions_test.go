@@ -0,0 +1,31 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ifMatchTests = []struct {
+	name     string
+	header   string
+	revision uint64
+	match    bool
+}{
+	{"any revision", "*", 3, true},
+	{"matching tag", `"3"`, 3, true},
+	{"stale tag", `"2"`, 3, false},
+	{"one of several tags", `"1", "3"`, 3, true},
+	{"none of several tags", `"1","2"`, 3, false},
+	{"weak tag", `W/"3"`, 3, false},
+	{"unquoted tag", `3`, 3, false},
+}
+
+func TestIfMatch(t *testing.T) {
+	for _, c := range ifMatchTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.match, ifMatch(c.header)(c.revision))
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package routes
+
+import (
+	"strconv"
+
+	"harkd/errors"
+
+	"github.com/ceralena/go-restroute"
+)
+
+// getBoolQueryParam reads an optional boolean query parameter, which is false
+// if it is absent.
+func getBoolQueryParam(req restroute.Request, name string) (bool, error) {
+	raw := req.R.URL.Query().Get(name)
+	if raw == "" {
+		return false, nil
+	}
+
+	val, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, errors.ErrInvalidQueryParam(name, raw)
+	}
+	return val, nil
+}
+
+// getLimitQueryParam reads an optional page size, which is 0, for no limit, if
+// it is absent.
+func getLimitQueryParam(req restroute.Request, name string) (int, error) {
+	raw := req.R.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+
+	val, err := strconv.Atoi(raw)
+	if err != nil || val < 1 {
+		return 0, errors.ErrInvalidQueryParam(name, raw)
+	}
+	return val, nil
+}
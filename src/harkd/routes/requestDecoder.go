@@ -10,6 +10,7 @@ import (
 
 type requestDecoder interface {
 	Decode(io.Reader, core.Validator) error
+	DecodeRaw(io.Reader) (json.RawMessage, error)
 }
 
 func jsonRequestDecoder() requestDecoder {
@@ -28,22 +29,31 @@ type wrappedRequestPayload struct {
 }
 
 func (jrd jsonRequestDecoderImpl) Decode(r io.Reader, into core.Validator) error {
-	// Decode the full request
-	var wrapped wrappedRequestPayload
-
-	dec := json.NewDecoder(r)
-	err := dec.Decode(&wrapped)
-
+	payload, err := jrd.DecodeRaw(r)
 	if err != nil {
-		return errors.ErrBadRequestEntity(err)
+		return err
 	}
 
 	// Now decode the actual entity payload into the interface provided
 	// by the caller.
-	if err = json.Unmarshal([]byte(wrapped.Payload), into); err != nil {
+	if err = errors.DecodeEntity(payload, into); err != nil {
 		return err
 	}
 
 	// Now that we've decoded the entity, we'll validate it
 	return into.Validate()
 }
+
+// DecodeRaw unwraps the request payload without decoding it, for requests such
+// as merge patches whose payload is not itself an entity.
+func (jrd jsonRequestDecoderImpl) DecodeRaw(r io.Reader) (json.RawMessage, error) {
+	// Decode the full request
+	var wrapped wrappedRequestPayload
+
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&wrapped); err != nil {
+		return nil, errors.ErrBadRequestEntity(err)
+	}
+
+	return wrapped.Payload, nil
+}
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"harkd/core"
+	"harkd/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+var decodeTests = []struct {
+	name             string
+	body             string
+	expectCode       int
+	expectViolations []errors.Violation
+}{
+	{"valid", `{"payload":{"id":"m1","name":"m1","memoryMB":512}}`, 0, nil},
+	{"not JSON", `{"payload":`, 400001, nil},
+	{"wrong type", `{"payload":{"id":"m1","name":"m1","memoryMB":"lots"}}`, 400002, []errors.Violation{
+		{Field: "/memoryMB", Reason: errors.ReasonType, Message: "memoryMB must be a non-negative integer, but is a JSON string"},
+	}},
+	{"several wrong types", `{"payload":{"id":"m1","name":7,"memoryMB":"lots"}}`, 400002, []errors.Violation{
+		{Field: "/memoryMB", Reason: errors.ReasonType, Message: "memoryMB must be a non-negative integer, but is a JSON string"},
+		{Field: "/name", Reason: errors.ReasonType, Message: "name must be a string, but is a JSON number"},
+	}},
+	{"invalid fields", `{"payload":{"id":"m 1","memoryMB":512}}`, 400002, []errors.Violation{
+		{Field: "/id", Reason: errors.ReasonPattern, Message: "machine id can only contain letters, digits, '_' and '-'"},
+		{Field: "/name", Reason: errors.ReasonRequired, Message: "machine name cannot be empty"},
+	}},
+}
+
+func TestDecode(t *testing.T) {
+	for _, c := range decodeTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			var m core.Machine
+			err := jsonRequestDecoder().Decode(strings.NewReader(c.body), &m)
+
+			// Assert
+			if c.expectCode == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Equal(t, c.expectCode, getErrorCode(err))
+
+			b, err := json.Marshal(payloadResponseWrapper{}.Wrap(err, ""))
+			require.NoError(t, err)
+			var res wrappedResponsePayload
+			require.NoError(t, json.Unmarshal(b, &res))
+			require.Equal(t, c.expectViolations, res.Details)
+		})
+	}
+}
@@ -2,13 +2,14 @@ package routes
 
 import (
 	"encoding/json"
-	"io"
+	"net/http"
 
+	"harkd/core"
 	"harkd/errors"
 )
 
 type responseWrapper interface {
-	Wrap(interface{}) interface{}
+	Wrap(res interface{}, requestID string) interface{}
 }
 
 type payloadResponseWrapper struct {
@@ -16,20 +17,81 @@ type payloadResponseWrapper struct {
 
 type wrappedResponsePayload struct {
 	Payload   interface{} `json:"payload,omitempty"`
+	Meta      interface{} `json:"meta,omitempty"`
 	Error     *string     `json:"error,omitempty"`
 	ErrorCode *int        `json:"errorCode,omitempty"`
+
+	// RequestID identifies the request an error is for, so that it can be
+	// found in the logs.
+	RequestID string `json:"requestID,omitempty"`
+
+	// Details lists the problems with each field of an invalid request
+	// entity.
+	Details []errors.Violation `json:"details,omitempty"`
+}
+
+// listPage is a page of a list. The items are the payload of the response,
+// and the rest is reported in its meta field.
+type listPage struct {
+	items interface{}
+	meta  listMeta
+}
+
+// listMeta describes a page of a list.
+type listMeta struct {
+	// Total is the number of items in the list, across all pages.
+	Total int `json:"total"`
+
+	// NextCursor fetches the next page when passed as the cursor query
+	// parameter. It is omitted on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// createdEntity is an entity created by a request, whose resources, such as
+// a machine's VM, are still being made by an operation. The entity is the
+// payload of the response, and the operation is reported in its meta field.
+type createdEntity struct {
+	entity interface{}
+	meta   createdMeta
+}
+
+// createdMeta describes the making of a created entity.
+type createdMeta struct {
+	// Operation tracks the work of making the entity's resources.
+	Operation core.Operation `json:"operation"`
+}
+
+// failedPayload is implemented by payloads which describe work that may have
+// failed, such as an operation. The failure is reported in the error fields of
+// the response, alongside the payload.
+type failedPayload interface {
+	Failure() error
 }
 
-func (pr payloadResponseWrapper) Wrap(res interface{}) interface{} {
-	// Meta is not implemented - create an empty map for now
+func (pr payloadResponseWrapper) Wrap(res interface{}, requestID string) interface{} {
 	// If the response is an error, we use it as the error in the response.
 	// Otherwise, we use it as the payload.
 	if resErr, ok := res.(error); ok {
 		code := getErrorCode(resErr)
 		errMsg := resErr.Error()
-		return wrappedResponsePayload{nil, &errMsg, &code}
+		wrapped := wrappedResponsePayload{Error: &errMsg, ErrorCode: &code, RequestID: requestID}
+		if detailed, ok := resErr.(errors.Detailer); ok {
+			wrapped.Details = detailed.Details()
+		}
+		return wrapped
+	}
+	if page, ok := res.(listPage); ok {
+		return wrappedResponsePayload{Payload: page.items, Meta: page.meta}
+	}
+	if created, ok := res.(createdEntity); ok {
+		return wrappedResponsePayload{Payload: created.entity, Meta: created.meta}
+	}
+	if failed, ok := res.(failedPayload); ok && failed.Failure() != nil {
+		code := getErrorCode(failed.Failure())
+		errMsg := failed.Failure().Error()
+		return wrappedResponsePayload{Payload: res, Error: &errMsg, ErrorCode: &code, RequestID: requestID}
 	}
-	return wrappedResponsePayload{res, nil, nil}
+	return wrappedResponsePayload{Payload: res}
 }
 
 // getErrorCode determines the error code given an error.
@@ -44,7 +106,7 @@ func getErrorCode(err error) int {
 }
 
 type responseEncoder interface {
-	Encode(w io.Writer, val interface{})
+	Encode(w http.ResponseWriter, val interface{})
 }
 
 func jsonResponseEncoder() responseEncoder {
@@ -55,8 +117,8 @@ type jsonResponseEncoderImpl struct {
 	responseWrapper
 }
 
-func (jsr jsonResponseEncoderImpl) Encode(w io.Writer, val interface{}) {
-	wrapped := jsr.Wrap(val)
+func (jsr jsonResponseEncoderImpl) Encode(w http.ResponseWriter, val interface{}) {
+	wrapped := jsr.Wrap(val, w.Header().Get(RequestIDHeader))
 	enc := json.NewEncoder(w)
 	enc.Encode(wrapped)
 }
@@ -3,6 +3,7 @@ package routes
 import (
 	"net/http"
 
+	"harkd/core"
 	"harkd/errors"
 )
 
@@ -11,6 +12,8 @@ import (
 type responseWriter interface {
 	WriteResponse(http.ResponseWriter, interface{})
 	WriteResponseWithStatus(http.ResponseWriter, int, interface{})
+	WriteAccepted(http.ResponseWriter, core.Operation)
+	WriteCreated(w http.ResponseWriter, location string, val interface{})
 }
 
 func newResponseWriter() responseWriter {
@@ -39,3 +42,17 @@ func (rw responseWriterImpl) WriteResponseWithStatus(w http.ResponseWriter, stat
 	w.WriteHeader(statusCode)
 	rw.Encode(w, val)
 }
+
+// WriteAccepted writes a 202 response for work which will be done in the
+// background, pointing the client at the operation tracking it.
+func (rw responseWriterImpl) WriteAccepted(w http.ResponseWriter, op core.Operation) {
+	w.Header().Set("Location", operationPath(op.ID))
+	rw.WriteResponseWithStatus(w, http.StatusAccepted, op)
+}
+
+// WriteCreated writes a 201 response for a newly created resource, pointing
+// the client at where it can be found.
+func (rw responseWriterImpl) WriteCreated(w http.ResponseWriter, location string, val interface{}) {
+	w.Header().Set("Location", location)
+	rw.WriteResponseWithStatus(w, http.StatusCreated, val)
+}
@@ -0,0 +1,186 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"harkd/errors"
+
+	"github.com/ceralena/go-restroute"
+)
+
+// RequestIDHeader is the header which identifies a request. If it is set on a
+// response, it is also echoed in the body of an error response.
+const RequestIDHeader = "X-Request-ID"
+
+// RouteInfo records which route handled a request, for logging.
+type RouteInfo struct {
+	// Route is the path of the route, with its parameters written as
+	// "{name}", or empty if no route matched.
+	Route string
+}
+
+type routeInfoKey struct{}
+
+// WithRouteInfo returns a copy of a request in which the Router records the
+// route which handles it in info.
+func WithRouteInfo(r *http.Request, info *RouteInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeInfoKey{}, info))
+}
+
+// router dispatches requests to the handlers in a restroute.Map. Unlike the
+// router restroute compiles, it answers requests which no handler can serve,
+// and requests whose handler panics, with hark's error envelope.
+type router struct {
+	routes []compiledRoute
+	responseWriter
+
+	// errLog is where panics in handlers are logged.
+	errLog io.Writer
+}
+
+type compiledRoute struct {
+	template string
+	r        *regexp.Regexp
+	handlers restroute.MethodMap
+}
+
+// routeParam matches a named parameter in a route's pattern.
+var routeParam = regexp.MustCompile(`\(\?P<(\w+)>[^)]*\)`)
+
+// routeTemplate describes a route's pattern for logging, such as
+// "/api/v1/machine/{machine_id}" for `^/api/v1/machine/(?P<machine_id>[\w-]+)$`.
+func routeTemplate(pattern string) string {
+	template := strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	return routeParam.ReplaceAllString(template, "{$1}")
+}
+
+// newRouter compiles the routes in m. They are tried in order of their
+// patterns, so that which one matches a request does not depend on map
+// order.
+func newRouter(m restroute.Map) (*router, error) {
+	var patterns []string
+	for pattern := range m {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	routes := make([]compiledRoute, 0, len(patterns))
+	for _, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad route %q: %s", pattern, err)
+		}
+		routes = append(routes, compiledRoute{routeTemplate(pattern), r, m[pattern]})
+	}
+	return &router{routes, newResponseWriter(), os.Stderr}, nil
+}
+
+func (rtr *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+	defer rtr.recoverPanic(sw, r)
+
+	route, params := rtr.match(r.URL.Path)
+	if route == nil {
+		rtr.WriteResponse(sw, errors.ErrRouteNotFound(r.Method, r.URL.Path))
+		return
+	}
+	if info, ok := r.Context().Value(routeInfoKey{}).(*RouteInfo); ok {
+		info.Route = route.template
+	}
+
+	handler, ok := route.handlers[r.Method]
+	if !ok {
+		sw.Header().Set("Allow", route.allow())
+		rtr.WriteResponse(sw, errors.ErrMethodNotAllowed(r.Method, r.URL.Path))
+		return
+	}
+
+	handler(restroute.Request{W: sw, R: r, Params: params})
+}
+
+// match finds the route for a path, and the parameters named in its pattern.
+func (rtr *router) match(path string) (*compiledRoute, map[string]string) {
+	for i := range rtr.routes {
+		route := &rtr.routes[i]
+		matches := route.r.FindStringSubmatch(path)
+		if matches == nil {
+			continue
+		}
+
+		params := make(map[string]string)
+		for j, name := range route.r.SubexpNames() {
+			if name != "" {
+				params[name] = matches[j]
+			}
+		}
+		return route, params
+	}
+	return nil, nil
+}
+
+// allow lists the methods a route handles, for an Allow header.
+func (cr compiledRoute) allow() string {
+	methods := make([]string, 0, len(cr.handlers))
+	for method := range cr.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// recoverPanic recovers from a panic in a handler, logging it with the
+// request's ID, so that it can be matched to the access log, and answering
+// with an error. If the handler had already started its response, the error
+// cannot be sent, so the panic is passed on for the server to log and cut the
+// response short.
+func (rtr *router) recoverPanic(sw *statusWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	requestID := sw.Header().Get(RequestIDHeader)
+	if sw.status != 0 {
+		// The server logs the panic itself, but without the request's ID.
+		fmt.Fprintf(rtr.errLog, "harkd: panic handling %s %s (request %s) after its response started: %v\n", r.Method, r.URL.Path, requestID, p)
+		panic(p)
+	}
+
+	fmt.Fprintf(rtr.errLog, "harkd: panic handling %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID, p, debug.Stack())
+	rtr.WriteResponse(sw, errors.ErrHandlerPanic())
+}
+
+// statusWriter records the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush flushes the response, if the underlying writer can, so that streamed
+// responses still work.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
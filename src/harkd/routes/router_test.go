@@ -0,0 +1,160 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ceralena/go-restroute"
+	"github.com/stretchr/testify/require"
+)
+
+// testRouter provides a router whose panics are logged to ioutil.Discard.
+func testRouter(t *testing.T) *router {
+	h, err := newRouter(restroute.Map{
+		`^/machine/(?P<machine_id>\w+)$`: restroute.MethodMap{
+			"GET": func(req restroute.Request) {
+				req.W.Write([]byte(req.Params["machine_id"]))
+			},
+			"DELETE": func(req restroute.Request) {},
+		},
+		"^/panic$": restroute.MethodMap{
+			"GET": func(req restroute.Request) {
+				panic("oops")
+			},
+		},
+		"^/panic/late$": restroute.MethodMap{
+			"GET": func(req restroute.Request) {
+				req.W.Write([]byte("partial"))
+				panic("oops")
+			},
+		},
+	})
+	require.NoError(t, err)
+	h.errLog = ioutil.Discard
+	return h
+}
+
+var routerErrorTests = []struct {
+	name        string
+	method      string
+	path        string
+	expectCode  int
+	expectError int
+	expectAllow string
+}{
+	{"unknown path", "GET", "/nothing", http.StatusNotFound, 404006, ""},
+	{"unsupported method", "POST", "/machine/m1", http.StatusMethodNotAllowed, 405001, "DELETE, GET"},
+	{"panic", "GET", "/panic", http.StatusInternalServerError, 500014, ""},
+}
+
+func TestRouterErrors(t *testing.T) {
+	h := testRouter(t)
+
+	for _, c := range routerErrorTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+
+			// Assert
+			require.Equal(t, c.expectCode, w.Code)
+			require.Equal(t, c.expectAllow, w.Header().Get("Allow"))
+
+			var res wrappedResponsePayload
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			require.NotNil(t, res.Error)
+			require.NotNil(t, res.ErrorCode)
+			require.Equal(t, c.expectError, *res.ErrorCode)
+		})
+	}
+}
+
+func TestRouterPassesParams(t *testing.T) {
+	w := httptest.NewRecorder()
+	testRouter(t).ServeHTTP(w, httptest.NewRequest("GET", "/machine/m1", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "m1", w.Body.String())
+}
+
+func TestRouterPassesOnPanicAfterResponseStarted(t *testing.T) {
+	w := httptest.NewRecorder()
+	h := testRouter(t)
+
+	require.Panics(t, func() {
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/panic/late", nil))
+	})
+	require.Equal(t, "partial", w.Body.String())
+}
+
+func TestRouterRecordsRoute(t *testing.T) {
+	cases := []struct {
+		name        string
+		path        string
+		expectRoute string
+	}{
+		{"route with params", "/machine/m1", "/machine/{machine_id}"},
+		{"no route", "/nothing", ""},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			info := new(RouteInfo)
+			r := WithRouteInfo(httptest.NewRequest("GET", c.path, nil), info)
+
+			testRouter(t).ServeHTTP(httptest.NewRecorder(), r)
+
+			require.Equal(t, c.expectRoute, info.Route)
+		})
+	}
+}
+
+func TestErrorEchoesRequestID(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "req-1")
+
+	testRouter(t).ServeHTTP(w, httptest.NewRequest("GET", "/nothing", nil))
+
+	var res wrappedResponsePayload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Equal(t, "req-1", res.RequestID)
+}
+
+func TestPanicLogIncludesRequestID(t *testing.T) {
+	cases := []struct {
+		name       string
+		path       string
+		expectLine string
+	}{
+		{"panic", "/panic", "harkd: panic handling GET /panic (request req-1): oops\n"},
+		{"panic after responding", "/panic/late", "harkd: panic handling GET /panic/late (request req-1) after its response started: oops\n"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			var log bytes.Buffer
+			h := testRouter(t)
+			h.errLog = &log
+			w := httptest.NewRecorder()
+			w.Header().Set(RequestIDHeader, "req-1")
+
+			// Execute
+			func() {
+				defer func() { recover() }()
+				h.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+			}()
+
+			// Assert
+			require.True(t, strings.HasPrefix(log.String(), c.expectLine), log.String())
+		})
+	}
+}
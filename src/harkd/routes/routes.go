@@ -1,21 +1,87 @@
 package routes
 
 import (
+	gocontext "context"
 	"net/http"
+	"time"
 
 	"harkd/context"
+	"harkd/services"
 
 	"github.com/ceralena/go-restroute"
 )
 
-// Router implements http.Handler.
-type Router http.Handler
+// Router serves the API. Closing it stops the background work started
+// alongside it, and ends any streams of events being served.
+type Router interface {
+	http.Handler
+	Close()
+}
+
+type apiRouter struct {
+	http.Handler
+	stop gocontext.CancelFunc
+}
+
+func (ar apiRouter) Close() {
+	ar.stop()
+}
+
+// Config configures the API, and the background work done alongside serving
+// requests.
+type Config struct {
+	// DriftCheckInterval is how often to check for drift between the state
+	// and the drivers' backends. If it is zero, drift is only checked on
+	// request.
+	DriftCheckInterval time.Duration
+
+	// UnversionedSunset is when the unversioned paths are to be removed, as
+	// announced in their Sunset header.
+	UnversionedSunset time.Time
+}
 
 // New provides a new Router.
-func New(ctxFactory context.Factory) (Router, error) {
-	m := restroute.Merge(
-		newSystemRouter(ctxFactory).getRouteMap(),
-		newMachineRouter(ctxFactory).getRouteMap(),
-	)
-	return m.Compile()
+func New(ctxFactory context.Factory, config Config) (Router, error) {
+	if err := checkUnversionedSunset(config.UnversionedSunset); err != nil {
+		return nil, err
+	}
+
+	// The operation service tracks work running in this process, so there
+	// must only be one.
+	operations, err := services.NewOperationService(ctxFactory)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := gocontext.WithCancel(gocontext.Background())
+
+	drift := services.NewDriftService(ctxFactory)
+	drift.Start(ctx, config.DriftCheckInterval)
+
+	if err := services.NewStateWatchService(ctxFactory).Start(ctx); err != nil {
+		stop()
+		return nil, err
+	}
+
+	v1 := apiVersion{apiV1Prefix, restroute.Merge(
+		newSystemRouter(ctxFactory, drift).getRouteMap(),
+		newMachineRouter(ctxFactory, operations).getRouteMap(),
+		newOperationRouter(ctxFactory, operations).getRouteMap(),
+		newEventRouter(ctxFactory, ctx.Done()).getRouteMap(),
+	)}
+
+	// A new version is added to this list, alongside the ones still served.
+	// The unversioned paths stay aliases of v1, since that is what clients
+	// using them expect.
+	m, err := mountVersions([]apiVersion{v1}, v1, config.UnversionedSunset)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	h, err := newRouter(m)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return apiRouter{h, stop}, nil
 }
@@ -0,0 +1,131 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"harkd/context"
+	"harkd/core"
+	"harkd/dal"
+	"harkd/driver/drivertest"
+	"harkd/errors"
+	"harkd/events"
+	"harkd/services"
+
+	"github.com/ceralena/go-restroute"
+	"github.com/stretchr/testify/require"
+)
+
+// testContext gives every caller the same in-memory dal and event bus.
+type testContext struct {
+	dal    dal.Dal
+	events events.Bus
+}
+
+func (tc *testContext) GetContext() context.Context {
+	return tc
+}
+
+func (tc *testContext) GetDal() dal.Dal {
+	return tc.dal
+}
+
+func (tc *testContext) GetEventBus() events.Bus {
+	return tc.events
+}
+
+// testAPI serves the system, machine and operation routes over an in-memory dal, with
+// machines managed by the fake driver.
+type testAPI struct {
+	http.Handler
+	ctx        *testContext
+	backend    *drivertest.Backend
+	operations services.OperationService
+}
+
+func newTestAPI(t *testing.T) testAPI {
+	ctx := &testContext{dal.NewMemoryDal(), events.NewBus(events.DefaultBufferSize)}
+	return newTestAPIWithContext(t, ctx)
+}
+
+func newTestAPIWithContext(t *testing.T, ctx *testContext) testAPI {
+	backend := drivertest.Install()
+
+	operations, err := services.NewOperationService(ctx)
+	require.NoError(t, err)
+
+	h, err := newRouter(restroute.Merge(
+		newSystemRouter(ctx, services.NewDriftService(ctx)).getRouteMap(),
+		newMachineRouter(ctx, operations).getRouteMap(),
+		newOperationRouter(ctx, operations).getRouteMap(),
+	))
+	require.NoError(t, err)
+	return testAPI{h, ctx, backend, operations}
+}
+
+// saveMachine saves a machine using the fake driver, with a VM in the given
+// state.
+func (api testAPI) saveMachine(t *testing.T, id string, state core.MachineState) {
+	m := core.Machine{ID: id, Name: id, MemoryMB: 512, Driver: drivertest.Name}
+	require.NoError(t, api.ctx.dal.SaveMachine(m))
+	if state != core.StateUnknown {
+		api.backend.SetVM(id, drivertest.VM{State: state, MemoryMB: m.MemoryMB})
+	}
+}
+
+// testResponse is a response envelope whose payload and meta are kept to be
+// decoded by the test.
+type testResponse struct {
+	Payload   json.RawMessage    `json:"payload"`
+	Meta      json.RawMessage    `json:"meta"`
+	Error     *string            `json:"error"`
+	ErrorCode *int               `json:"errorCode"`
+	Details   []errors.Violation `json:"details"`
+}
+
+// do makes a request, with the given body and headers given as name and value
+// pairs, and decodes the response envelope.
+func (api testAPI) do(t *testing.T, method, path, body string, headers ...string) (*httptest.ResponseRecorder, testResponse) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	var res testResponse
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res), w.Body.String())
+	}
+	return w, res
+}
+
+// waitForOperation polls an operation through the API until it has finished.
+func (api testAPI) waitForOperation(t *testing.T, id string) core.Operation {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w, res := api.do(t, "GET", "/operation/"+id, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var op core.Operation
+		require.NoError(t, json.Unmarshal(res.Payload, &op))
+		if op.Status.Finished() {
+			return op
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("operation %s still %s", id, op.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// requireErrorCode checks that a response is an error with the given code.
+func requireErrorCode(t *testing.T, code int, res testResponse) {
+	require.NotNil(t, res.ErrorCode)
+	require.Equal(t, code, *res.ErrorCode)
+}
@@ -1,7 +1,12 @@
 package routes
 
 import (
+	"fmt"
+	"net/http"
+	"time"
+
 	"harkd/context"
+	"harkd/core"
 	"harkd/services"
 
 	"github.com/ceralena/go-restroute"
@@ -9,35 +14,108 @@ import (
 
 type systemRouter struct {
 	service services.SystemService
-	responseEncoder
+	responseWriter
 	context.Factory
 }
 
-func newSystemRouter(ctxFactory context.Factory) systemRouter {
+func newSystemRouter(ctxFactory context.Factory, drift services.DriftService) systemRouter {
 	return systemRouter{
-		services.NewSystemService(),
-		jsonResponseEncoder(),
+		services.NewSystemService(ctxFactory, drift),
+		newResponseWriter(),
 		ctxFactory,
 	}
 }
 
 func (sr systemRouter) getRouteMap() restroute.Map {
 	return restroute.Map{
-		"^/api/system/status$": restroute.MethodMap{
+		"^/system/status$": restroute.MethodMap{
 			"GET": sr.getStatus,
 		},
-		"^/api/system/driver$": restroute.MethodMap{
+		"^/system/driver$": restroute.MethodMap{
 			"GET": sr.getDriverInfo,
 		},
+		"^/system/drift$": restroute.MethodMap{
+			"GET": sr.getDrift,
+		},
+		"^/system/lock$": restroute.MethodMap{
+			"GET": sr.getStateLock,
+		},
+		"^/system/state/export$": restroute.MethodMap{
+			"GET": sr.exportState,
+		},
+		"^/system/state/import$": restroute.MethodMap{
+			"POST": sr.importState,
+		},
 	}
 }
 
 func (sr systemRouter) getStatus(req restroute.Request) {
 	status := sr.service.GetStatus()
-	sr.Encode(req.W, status)
+	sr.WriteResponse(req.W, status)
 }
 
 func (sr systemRouter) getDriverInfo(req restroute.Request) {
 	driverInfo := sr.service.GetDriverInfo()
-	sr.Encode(req.W, driverInfo)
+	sr.WriteResponse(req.W, driverInfo)
+}
+
+func (sr systemRouter) getDrift(req restroute.Request) {
+	report, err := sr.service.GetDrift()
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+		return
+	}
+	sr.WriteResponse(req.W, report)
+}
+
+func (sr systemRouter) getStateLock(req restroute.Request) {
+	stats, err := sr.service.GetStateLock()
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+		return
+	}
+	sr.WriteResponse(req.W, stats)
+}
+
+// maxImportSize is the largest state bundle which can be imported.
+const maxImportSize = 16 << 20
+
+func (sr systemRouter) exportState(req restroute.Request) {
+	filename := fmt.Sprintf("hark-state-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	req.W.Header().Set("Content-Type", "application/gzip")
+	req.W.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// The bundle is only written once it is complete, so an error can still
+	// be reported in place of it.
+	if err := sr.service.ExportState(req.W); err != nil {
+		req.W.Header().Del("Content-Type")
+		req.W.Header().Del("Content-Disposition")
+		sr.WriteResponse(req.W, err)
+	}
+}
+
+func (sr systemRouter) importState(req restroute.Request) {
+	mode, err := core.ParseImportMode(req.R.URL.Query().Get("mode"))
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+		return
+	}
+	force, err := getBoolQueryParam(req, "force")
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+		return
+	}
+	dryRun, err := getBoolQueryParam(req, "dryRun")
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+		return
+	}
+
+	body := http.MaxBytesReader(req.W, req.R.Body, maxImportSize)
+	report, err := sr.service.ImportState(body, mode, force, dryRun)
+	if err != nil {
+		sr.WriteResponse(req.W, err)
+	} else {
+		sr.WriteResponse(req.W, report)
+	}
 }
@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/dal/daltest"
+	"harkd/driver/drivertest"
+	"harkd/events"
+	"harkd/util"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportStateRoute(t *testing.T) {
+	cases := []struct {
+		name          string
+		query         string
+		imported      core.Machine
+		expectStatus  int
+		expectCode    int
+		expectField   string
+		expectUpdated []string
+		expectMemory  uint
+	}{
+		{
+			"replace", "?mode=replace",
+			core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: drivertest.Name},
+			http.StatusOK, 0, "", []string{"foo"}, 1024,
+		},
+		{
+			"dry run", "?mode=replace&dryRun=true",
+			core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: drivertest.Name},
+			http.StatusOK, 0, "", []string{"foo"}, 512,
+		},
+		{
+			"driver changed", "?mode=replace",
+			core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: "virtualbox"},
+			http.StatusBadRequest, 400002, "/machines/0/driver", nil, 512,
+		},
+		{
+			"unknown mode", "?mode=overwrite",
+			core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: drivertest.Name},
+			http.StatusBadRequest, 400003, "", nil, 512,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			api := newTestAPI(t)
+			api.saveMachine(t, "foo", core.StatePoweroff)
+
+			// Execute
+			w, res := api.do(t, "POST", "/system/state/import"+c.query, daltest.StateBundle(t, c.imported).String())
+
+			// Assert
+			require.Equal(t, c.expectStatus, w.Code, w.Body.String())
+			if c.expectCode != 0 {
+				requireErrorCode(t, c.expectCode, res)
+				if c.expectField != "" {
+					require.Len(t, res.Details, 1)
+					require.Equal(t, c.expectField, res.Details[0].Field)
+				}
+			} else {
+				var report core.ImportReport
+				require.NoError(t, json.Unmarshal(res.Payload, &report))
+				require.Equal(t, c.expectUpdated, report.Updated)
+			}
+
+			vm, _ := api.backend.GetVM("foo")
+			require.Equal(t, c.expectMemory, vm.MemoryMB)
+		})
+	}
+}
+
+func TestImportStateReplaceRunningRoute(t *testing.T) {
+	// Prepare
+	api := newTestAPI(t)
+	api.saveMachine(t, "foo", core.StatePoweroff)
+	api.saveMachine(t, "bar", core.StateRunning)
+	bundle := daltest.StateBundle(t, core.Machine{ID: "foo", Name: "foo", MemoryMB: 512, Driver: drivertest.Name}).String()
+
+	// Execute & Assert: bar is only deleted if forced.
+	w, res := api.do(t, "POST", "/system/state/import?mode=replace", bundle)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	requireErrorCode(t, 409001, res)
+	require.Contains(t, *res.Error, `"bar"`)
+
+	w, res = api.do(t, "POST", "/system/state/import?mode=replace&force=true", bundle)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var report core.ImportReport
+	require.NoError(t, json.Unmarshal(res.Payload, &report))
+	require.Equal(t, []string{"bar"}, report.Deleted)
+}
+
+func TestStateLockRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hark")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Prepare: a write has taken the lock, and a holder is recorded in the
+	// lock file.
+	filename := filepath.Join(dir, "state.json")
+	d, err := dal.NewJSONFileDal(filename, 0)
+	require.NoError(t, err)
+	require.NoError(t, d.SaveMachine(core.Machine{ID: "foo", Name: "foo"}))
+	holder := `{"pid":` + strconv.Itoa(os.Getpid()) + `,"since":"2017-01-02T03:04:05Z"}`
+	require.NoError(t, ioutil.WriteFile(filename+".lock", []byte(holder), 0644))
+	api := newTestAPIWithContext(t, &testContext{d, events.NewBus(events.DefaultBufferSize)})
+
+	// Execute
+	w, res := api.do(t, "GET", "/system/lock", "")
+
+	// Assert
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stats util.LockStats
+	require.NoError(t, json.Unmarshal(res.Payload, &stats))
+	require.Equal(t, filename+".lock", stats.File)
+	require.Equal(t, util.DefaultLockTimeout, stats.Timeout)
+	require.NotNil(t, stats.Holder)
+	require.Equal(t, os.Getpid(), stats.Holder.PID)
+	require.False(t, stats.Holder.Stale)
+	require.False(t, stats.Exclusive)
+	require.True(t, stats.Writes.Acquired > 0)
+
+	// A dal without a lock file has no lock to report on.
+	w, res = newTestAPI(t).do(t, "GET", "/system/lock", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	requireErrorCode(t, 404005, res)
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ceralena/go-restroute"
+)
+
+// apiPrefix is the root of the API. Each version of it is mounted beneath.
+const apiPrefix = "/api"
+
+// apiV1Prefix is the root of version 1 of the API.
+const apiV1Prefix = apiPrefix + "/v1"
+
+// unversionedDeprecation is when the unversioned paths directly under
+// apiPrefix became deprecated aliases of version 1: the release which
+// introduced apiV1Prefix. It is a fact about that release, so it is fixed.
+//
+// When the aliases are removed is a decision for whoever runs harkd, so their
+// sunset is configured. Clients are given at least minSunsetNotice to move to
+// a versioned path.
+var unversionedDeprecation = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// minSunsetNotice is the least time allowed between deprecating a path and
+// its sunset.
+const minSunsetNotice = 180 * 24 * time.Hour
+
+// checkUnversionedSunset checks that the unversioned paths are not sunset
+// before clients have been given notice of it.
+func checkUnversionedSunset(sunset time.Time) error {
+	if earliest := unversionedDeprecation.Add(minSunsetNotice); sunset.Before(earliest) {
+		return fmt.Errorf("the unversioned API cannot be sunset before %s", earliest.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// apiVersion is a version of the API: a set of routes mounted under a common
+// prefix. Route paths are relative to the prefix, and each starts with "^/".
+type apiVersion struct {
+	prefix string
+	routes restroute.Map
+}
+
+// mountVersions mounts each version of the API under its prefix, so that
+// versions can be served side by side. The routes of legacy are also mounted
+// directly under apiPrefix, as deprecated aliases which are removed at
+// sunset.
+func mountVersions(versions []apiVersion, legacy apiVersion, sunset time.Time) (restroute.Map, error) {
+	var maps []restroute.Map
+	for _, v := range versions {
+		m, err := mount(v.prefix, v.routes, nil)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+
+	aliases, err := mount(apiPrefix, legacy.routes, func(h restroute.Handler) restroute.Handler {
+		return deprecated(h, legacy.prefix, sunset)
+	})
+	if err != nil {
+		return nil, err
+	}
+	maps = append(maps, aliases)
+
+	return restroute.Merge(maps...), nil
+}
+
+// mount prepends prefix to the path of each route, wrapping each handler with
+// wrap if it is given.
+func mount(prefix string, routes restroute.Map, wrap func(restroute.Handler) restroute.Handler) (restroute.Map, error) {
+	mounted := make(restroute.Map, len(routes))
+	for path, methods := range routes {
+		if !strings.HasPrefix(path, "^/") {
+			return nil, fmt.Errorf("route %q is not anchored to the root of the API", path)
+		}
+
+		handlers := make(restroute.MethodMap, len(methods))
+		for method, h := range methods {
+			if wrap != nil {
+				h = wrap(h)
+			}
+			handlers[method] = h
+		}
+		mounted["^"+prefix+path[1:]] = handlers
+	}
+	return mounted, nil
+}
+
+// deprecated wraps the handler of an unversioned alias, adding headers which
+// say that it is deprecated, when it will be removed, and where it has moved
+// to.
+func deprecated(h restroute.Handler, successorPrefix string, sunset time.Time) restroute.Handler {
+	return func(req restroute.Request) {
+		successor := successorPrefix + strings.TrimPrefix(req.R.URL.Path, apiPrefix)
+
+		header := req.W.Header()
+		header.Set("Deprecation", fmt.Sprintf("@%d", unversionedDeprecation.Unix()))
+		header.Set("Sunset", sunset.Format(http.TimeFormat))
+		header.Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		h(req)
+	}
+}
@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ceralena/go-restroute"
+	"github.com/stretchr/testify/require"
+)
+
+var testSunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+
+// versionedRoutes serves two versions of a route which writes which version
+// handled the request.
+func versionedRoutes(t *testing.T) http.Handler {
+	version := func(name string) apiVersion {
+		return apiVersion{apiPrefix + "/" + name, restroute.Map{
+			`^/machine/(?P<machine_id>\w+)$`: restroute.MethodMap{
+				"GET": func(req restroute.Request) {
+					req.W.Write([]byte(name + " " + req.Params["machine_id"]))
+				},
+			},
+		}}
+	}
+	v1, v2 := version("v1"), version("v2")
+
+	m, err := mountVersions([]apiVersion{v1, v2}, v1, testSunset)
+	require.NoError(t, err)
+	h, err := newRouter(m)
+	require.NoError(t, err)
+	return h
+}
+
+var versionTests = []struct {
+	name       string
+	path       string
+	body       string
+	deprecated bool
+	successor  string
+}{
+	{"v1", "/api/v1/machine/m1", "v1 m1", false, ""},
+	{"v2", "/api/v2/machine/m1", "v2 m1", false, ""},
+	{"unversioned alias", "/api/machine/m1", "v1 m1", true, `</api/v1/machine/m1>; rel="successor-version"`},
+}
+
+func TestMountVersions(t *testing.T) {
+	h := versionedRoutes(t)
+
+	for _, c := range versionTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+
+			// Assert
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, c.body, w.Body.String())
+			if c.deprecated {
+				require.Equal(t, "@1792281600", w.Header().Get("Deprecation"))
+				require.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+				require.Equal(t, c.successor, w.Header().Get("Link"))
+			} else {
+				require.Empty(t, w.Header().Get("Deprecation"))
+				require.Empty(t, w.Header().Get("Sunset"))
+			}
+		})
+	}
+}
+
+func TestCheckUnversionedSunset(t *testing.T) {
+	cases := []struct {
+		name        string
+		sunset      time.Time
+		expectError bool
+	}{
+		{"default", testSunset, false},
+		{"six months' notice", time.Date(2027, time.April, 16, 0, 0, 0, 0, time.UTC), false},
+		{"too little notice", time.Date(2027, time.April, 15, 0, 0, 0, 0, time.UTC), true},
+		{"unset", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			err := checkUnversionedSunset(c.sunset)
+			if c.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMountRejectsUnanchoredRoute(t *testing.T) {
+	_, err := mount(apiV1Prefix, restroute.Map{"/machine$": restroute.MethodMap{}}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"harkd/routes"
+	"harkd/util"
+)
+
+// The formats the access log can be written in.
+const (
+	// AccessLogJSON writes each request as a JSON object on a line of its
+	// own.
+	AccessLogJSON = "json"
+
+	// AccessLogText writes each request as a line of key=value pairs.
+	AccessLogText = "text"
+
+	// AccessLogOff writes no access log.
+	AccessLogOff = "off"
+)
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 128
+
+// middleware wraps a handler with behaviour common to every request.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in each of the middlewares, the first outermost.
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// requestID gives each request an ID, set in the X-Request-ID header of the
+// response. If trustClient is set, a valid ID sent by the client is used, so
+// that a request can be followed across services.
+func requestID(trustClient bool) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(routes.RequestIDHeader)
+			if !trustClient || !validRequestID(id) {
+				var err error
+				if id, err = util.NewULID(); err != nil {
+					id = ""
+				}
+			}
+			if id != "" {
+				w.Header().Set(routes.RequestIDHeader, id)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validRequestID reports whether a client's request ID can be used: it must
+// be short, and only have printable ASCII characters, so that it cannot break
+// up the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestID,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"durationMs"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+func (e accessEntry) text() string {
+	return fmt.Sprintf("time=%s requestID=%q method=%s path=%q route=%q status=%d bytes=%d durationMs=%.3f remoteAddr=%q\n",
+		e.Time.Format(time.RFC3339Nano), e.RequestID, e.Method, e.Path, e.Route, e.Status, e.Bytes, e.DurationMS, e.RemoteAddr)
+}
+
+// accessLog writes a line to out for each request, once it has been handled,
+// in the given format. A request whose handler panics is logged as well.
+func accessLog(format string, out io.Writer) (middleware, error) {
+	var encode func(accessEntry) []byte
+	switch format {
+	case AccessLogJSON:
+		encode = func(e accessEntry) []byte {
+			b, _ := json.Marshal(e)
+			return append(b, '\n')
+		}
+	case AccessLogText:
+		encode = func(e accessEntry) []byte {
+			return []byte(e.text())
+		}
+	case AccessLogOff:
+		return func(next http.Handler) http.Handler { return next }, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	// Lines are written whole, one at a time, so that concurrent requests
+	// do not interleave them.
+	var mutex sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &recordingWriter{ResponseWriter: w}
+			info := new(routes.RouteInfo)
+
+			defer func() {
+				status := rw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				line := encode(accessEntry{
+					Time:       start.UTC(),
+					RequestID:  w.Header().Get(routes.RequestIDHeader),
+					Method:     r.Method,
+					Path:       r.URL.Path,
+					Route:      info.Route,
+					Status:     status,
+					Bytes:      rw.bytes,
+					DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+					RemoteAddr: r.RemoteAddr,
+				})
+
+				mutex.Lock()
+				out.Write(line)
+				mutex.Unlock()
+			}()
+
+			next.ServeHTTP(rw, routes.WithRouteInfo(r, info))
+		})
+	}, nil
+}
+
+// recordingWriter records the status and size of the response written
+// through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the response, if the underlying writer can, so that streamed
+// responses still work.
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"harkd/context"
+	"harkd/dal"
+	"harkd/events"
+	"harkd/routes"
+
+	"github.com/stretchr/testify/require"
+)
+
+// echoRequestID responds with the request ID it was given.
+var echoRequestID = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(w.Header().Get(routes.RequestIDHeader)))
+})
+
+var requestIDTests = []struct {
+	name        string
+	clientID    string
+	trustClient bool
+	expectKept  bool
+}{
+	{"no client id", "", true, false},
+	{"client id", "abc-123", true, true},
+	{"untrusted client id", "abc-123", false, false},
+	{"client id with spaces", "abc 123", true, false},
+	{"overlong client id", strings.Repeat("a", maxRequestIDLength+1), true, false},
+}
+
+func TestRequestID(t *testing.T) {
+	for _, c := range requestIDTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			r := httptest.NewRequest("GET", "/", nil)
+			if c.clientID != "" {
+				r.Header.Set(routes.RequestIDHeader, c.clientID)
+			}
+
+			// Execute
+			w := httptest.NewRecorder()
+			requestID(c.trustClient)(echoRequestID).ServeHTTP(w, r)
+
+			// Assert
+			id := w.Header().Get(routes.RequestIDHeader)
+			require.NotEmpty(t, id)
+			require.Equal(t, id, w.Body.String())
+			if c.expectKept {
+				require.Equal(t, c.clientID, id)
+			} else {
+				require.NotEqual(t, c.clientID, id)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	// Prepare
+	var out bytes.Buffer
+	logAccess, err := accessLog(AccessLogJSON, &out)
+	require.NoError(t, err)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	r := httptest.NewRequest("PUT", "/api/v1/machine", nil)
+	r.Header.Set(routes.RequestIDHeader, "req-1")
+
+	// Execute
+	chain(h, requestID(true), logAccess).ServeHTTP(httptest.NewRecorder(), r)
+
+	// Assert
+	var entry accessEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	require.Equal(t, "req-1", entry.RequestID)
+	require.Equal(t, "PUT", entry.Method)
+	require.Equal(t, "/api/v1/machine", entry.Path)
+	require.Equal(t, http.StatusCreated, entry.Status)
+	require.Equal(t, int64(5), entry.Bytes)
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	cases := []struct {
+		format string
+		valid  bool
+	}{
+		{AccessLogJSON, true},
+		{AccessLogText, true},
+		{AccessLogOff, true},
+		{"xml", false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.format, func(t *testing.T) {
+			var out bytes.Buffer
+			logAccess, err := accessLog(c.format, &out)
+			if !c.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			logAccess(echoRequestID).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			require.Equal(t, c.format != AccessLogOff, out.Len() > 0)
+		})
+	}
+}
+
+// testContext gives every caller the same in-memory dal and event bus.
+type testContext struct {
+	dal    dal.Dal
+	events events.Bus
+}
+
+func (tc *testContext) GetContext() context.Context {
+	return tc
+}
+
+func (tc *testContext) GetDal() dal.Dal {
+	return tc.dal
+}
+
+func (tc *testContext) GetEventBus() events.Bus {
+	return tc.events
+}
+
+// logLines receives each line of the access log as it is written.
+type logLines chan []byte
+
+func (ll logLines) Write(b []byte) (int, error) {
+	ll <- append([]byte{}, b...)
+	return len(b), nil
+}
+
+func TestStreamEventsThroughMiddleware(t *testing.T) {
+	// Prepare
+	ctx := &testContext{dal.NewMemoryDal(), events.NewBus(events.DefaultBufferSize)}
+	router, err := routes.New(ctx, routes.Config{UnversionedSunset: time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)})
+	require.NoError(t, err)
+	lines := make(logLines, 1)
+	logAccess, err := accessLog(AccessLogJSON, lines)
+	require.NoError(t, err)
+	srv := httptest.NewServer(chain(router, requestID(true), logAccess))
+	defer srv.Close()
+
+	// Execute
+	res, err := http.Get(srv.URL + "/api/v1/events")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	ctx.events.Publish(events.MachineCreated, "foo")
+
+	// Assert: the event arrives while the stream is open.
+	r := bufio.NewReader(res.Body)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	for _, expect := range []string{"id: 1\n", "event: machine.created\n"} {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, expect, line)
+	}
+
+	// Once the router is closed the stream ends, and is logged.
+	router.Close()
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	var entry accessEntry
+	select {
+	case line := <-lines:
+		require.NoError(t, json.Unmarshal(line, &entry))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream was not logged")
+	}
+	require.Equal(t, "/api/v1/events", entry.Route)
+	require.Equal(t, http.StatusOK, entry.Status)
+	require.True(t, entry.Bytes > 0)
+}
@@ -1,44 +1,147 @@
 package server
 
 import (
+	gocontext "context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"harkd/context"
 	"harkd/routes"
 )
 
+// shutdownTimeout is how long requests in progress are given to finish once
+// the server is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 // HarkdServer is a HTTP server providing hark's backend functionality.
 type HarkdServer interface {
+	// Run serves requests until the process is interrupted or terminated,
+	// and then stops the server's background work.
 	Run() error
 }
 
 // Config is the config for a Hark server.
 type Config struct {
 	Port int `default:"8080"`
+
+	// DriftCheckInterval is how often, in seconds, to check that the machines
+	// in the state match the VMs which exist. 0 disables periodic checks.
+	DriftCheckInterval int `default:"60"`
+
+	// StateBackend is the backend which stores hark's state: "json" or
+	// "journal".
+	StateBackend string `default:"json"`
+
+	// StateBackups is the number of backup generations kept of the state
+	// file, for recovering it if it is corrupted.
+	StateBackups int `default:"3"`
+
+	// StateLockTimeout is how long, in milliseconds, to wait for the state
+	// lock before failing a request.
+	StateLockTimeout int `default:"5000"`
+
+	// AccessLog is the format of the access log written to stderr: "json",
+	// "text" or "off".
+	AccessLog string `default:"json"`
+
+	// TrustRequestID is whether to keep the X-Request-ID a client sends,
+	// rather than always giving a request a new ID.
+	TrustRequestID bool `default:"true"`
+
+	// UnversionedSunset is the date, as YYYY-MM-DD, from which the
+	// unversioned /api paths may be removed. It is announced to clients in
+	// the Sunset header, and cannot be less than six months after the paths
+	// were deprecated.
+	UnversionedSunset string `default:"2027-04-30"`
+}
+
+// ContextConfig is the part of the config which configures hark's state.
+func (c Config) ContextConfig() context.Config {
+	return context.Config{
+		StateBackend:     c.StateBackend,
+		StateBackups:     c.StateBackups,
+		StateLockTimeout: time.Duration(c.StateLockTimeout) * time.Millisecond,
+	}
 }
 
 func (c Config) listenAddr() string {
 	return fmt.Sprintf(":%d", c.Port)
 }
 
+func (c Config) routesConfig() (routes.Config, error) {
+	sunset, err := time.Parse("2006-01-02", c.UnversionedSunset)
+	if err != nil {
+		return routes.Config{}, fmt.Errorf("unversioned sunset %q is not a date: %s", c.UnversionedSunset, err)
+	}
+	return routes.Config{
+		DriftCheckInterval: time.Duration(c.DriftCheckInterval) * time.Second,
+		UnversionedSunset:  sunset,
+	}, nil
+}
+
 // New constructs a new instance of HarkdServer.
 func New(config Config, ctxFactory context.Factory) (HarkdServer, error) {
-	router, err := routes.New(ctxFactory)
+	// The access log is set up first, so that a bad format is reported
+	// before any background work starts.
+	logAccess, err := accessLog(config.AccessLog, os.Stderr)
 	if err != nil {
 		return nil, err
 	}
-	return harkdServer{config, router}, nil
+
+	routesConfig, err := config.routesConfig()
+	if err != nil {
+		return nil, err
+	}
+	router, err := routes.New(ctxFactory, routesConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every request goes through the middleware, outermost first.
+	handler := chain(router, requestID(config.TrustRequestID), logAccess)
+	return harkdServer{config, router, handler}, nil
 }
 
 type harkdServer struct {
 	Config
-	routes.Router
+	router  routes.Router
+	handler http.Handler
 }
 
 // Run runs the server.
 func (hds harkdServer) Run() error {
+	defer hds.router.Close()
+
 	listenAddr := hds.Config.listenAddr()
+	srv := &http.Server{Addr: listenAddr, Handler: hds.handler}
+
+	// Streams of events never finish by themselves, so they are ended as
+	// soon as shutting down starts, along with the background work.
+	srv.RegisterOnShutdown(hds.router.Close)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	served := make(chan error, 1)
 	fmt.Printf("harkd: listening on %s\n", listenAddr)
-	return http.ListenAndServe(listenAddr, hds.Router)
+	go func() { served <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		fmt.Printf("harkd: %s, shutting down\n", sig)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != gocontext.DeadlineExceeded {
+		return err
+	}
+	return srv.Close()
 }
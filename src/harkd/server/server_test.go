@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutesConfigSunset(t *testing.T) {
+	cases := []struct {
+		name         string
+		sunset       string
+		expectSunset time.Time
+		expectError  bool
+	}{
+		{"date", "2027-04-30", time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC), false},
+		{"not a date", "30/04/2027", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Execute
+			config, err := Config{UnversionedSunset: c.sunset}.routesConfig()
+
+			// Assert
+			if c.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expectSunset, config.UnversionedSunset)
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"harkd/context"
+	"harkd/core"
+	"harkd/dal"
+	"harkd/driver"
+	"harkd/events"
+	"harkd/util/command"
+)
+
+// DriftService reconciles the machines in hark's state with the VMs which
+// actually exist in their drivers' backends.
+type DriftService interface {
+	// GetDrift reports the drift found by the latest check. If no periodic
+	// check is running, it checks now.
+	GetDrift() (core.DriftReport, error)
+
+	// Start checks for drift every interval in the background, until ctx is
+	// done. A warning is logged and published whenever a check finds drift
+	// which differs from the last check's.
+	Start(ctx gocontext.Context, interval time.Duration)
+}
+
+// NewDriftService provides a DriftService.
+func NewDriftService(ctxFactory context.Factory) DriftService {
+	ctx := ctxFactory.GetContext()
+	return &driftService{
+		dal:          ctx.GetDal(),
+		driverConfig: driver.Config{Runner: command.NewRunner()},
+		events:       ctx.GetEventBus(),
+	}
+}
+
+type driftService struct {
+	dal          dal.Dal
+	driverConfig driver.Config
+	events       events.Publisher
+
+	// mutex serializes checks, and guards the result of the last one.
+	mutex    sync.Mutex
+	periodic bool
+	last     *core.DriftReport
+}
+
+func (ds *driftService) GetDrift() (core.DriftReport, error) {
+	ds.mutex.Lock()
+	periodic, last := ds.periodic, ds.last
+	ds.mutex.Unlock()
+
+	if periodic && last != nil {
+		return *last, nil
+	}
+	return ds.check()
+}
+
+func (ds *driftService) Start(ctx gocontext.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ds.mutex.Lock()
+	ds.periodic = true
+	ds.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := ds.check(); err != nil {
+				fmt.Fprintf(os.Stderr, "harkd: drift check failed: %s\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				ds.mutex.Lock()
+				ds.periodic = false
+				ds.mutex.Unlock()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// check compares the state with every driver's backend, and warns if the
+// drift found has changed since the last check.
+func (ds *driftService) check() (core.DriftReport, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	report, err := ds.findDrift()
+	if err != nil {
+		return report, err
+	}
+
+	if report.HasDrift() && (ds.last == nil || !sameDrift(*ds.last, report)) {
+		fmt.Fprintf(os.Stderr, "harkd: warning: drift detected: %s\n", report.Summary())
+		ds.events.Publish(events.DriftDetected, report)
+	}
+	ds.last = &report
+	return report, nil
+}
+
+func (ds *driftService) findDrift() (core.DriftReport, error) {
+	report := core.DriftReport{
+		CheckedAt:  time.Now().UTC(),
+		Missing:    []string{},
+		Orphaned:   []core.OrphanedVM{},
+		Mismatched: []core.ConfigMismatch{},
+	}
+
+	machines, err := ds.dal.GetMachines()
+	if err != nil {
+		return report, err
+	}
+
+	// Every registered driver is checked for orphans, even if no machine in
+	// the state uses it.
+	byDriver := make(map[string][]core.Machine)
+	for _, name := range driver.Names() {
+		byDriver[name] = nil
+	}
+	for _, m := range machines {
+		if m.Driver == "" {
+			m.Driver = driver.DefaultDriver
+		}
+		byDriver[m.Driver] = append(byDriver[m.Driver], m)
+	}
+
+	var names []string
+	for name := range byDriver {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := ds.findDriverDrift(&report, name, byDriver[name]); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	return report, nil
+}
+
+// findDriverDrift adds the drift between a driver's backend and the machines
+// it owns to the report.
+func (ds *driftService) findDriverDrift(report *core.DriftReport, name string, machines []core.Machine) error {
+	d, err := driver.Lookup(name, ds.driverConfig)
+	if err != nil {
+		return err
+	}
+
+	// If the backend cannot be listed, nothing can be said about its
+	// machines: they are not reported missing.
+	vmIDs, err := d.ListMachineIDs()
+	if err != nil {
+		return err
+	}
+
+	missing, orphaned := core.FindMissingAndOrphaned(machines, vmIDs)
+	report.Missing = append(report.Missing, missing...)
+	for _, id := range orphaned {
+		report.Orphaned = append(report.Orphaned, core.OrphanedVM{Driver: name, MachineID: id})
+	}
+
+	for _, m := range machines {
+		if containsID(missing, m.ID) {
+			continue
+		}
+		info, err := d.Inspect(m)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: machine %s: %s", name, m.ID, err))
+			continue
+		}
+		report.Mismatched = append(report.Mismatched, core.CompareHardware(m, info)...)
+	}
+	return nil
+}
+
+// sameDrift reports whether two reports found the same drift, regardless of
+// when they were made.
+func sameDrift(a, b core.DriftReport) bool {
+	return reflect.DeepEqual(a.Missing, b.Missing) &&
+		reflect.DeepEqual(a.Orphaned, b.Orphaned) &&
+		reflect.DeepEqual(a.Mismatched, b.Mismatched)
+}
+
+func containsID(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	gocontext "context"
+	"testing"
+	"time"
+
+	"harkd/driver/drivertest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lastDrift returns when the latest check was made, if one has been, and
+// whether checks are running periodically.
+func (ds *driftService) lastDrift() (*time.Time, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.last == nil {
+		return nil, ds.periodic
+	}
+	return &ds.last.CheckedAt, ds.periodic
+}
+
+func TestDriftServiceStops(t *testing.T) {
+	// Prepare
+	drivertest.Install()
+	ds := NewDriftService(newTestContext()).(*driftService)
+	checking, stop := gocontext.WithCancel(gocontext.Background())
+	defer stop()
+	ds.Start(checking, time.Millisecond)
+
+	// Execute
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if last, _ := ds.lastDrift(); last != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	// Assert: once checking has stopped, no more checks are made, and a
+	// request for the drift checks again.
+	for {
+		if _, periodic := ds.lastDrift(); !periodic {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the drift check did not stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stopped, _ := ds.lastDrift()
+	require.NotNil(t, stopped)
+	time.Sleep(20 * time.Millisecond)
+	last, _ := ds.lastDrift()
+	require.Equal(t, *stopped, *last)
+
+	report, err := ds.GetDrift()
+	require.NoError(t, err)
+	require.True(t, report.CheckedAt.After(*stopped))
+}
@@ -1,27 +1,70 @@
 package services
 
 import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"os"
+
 	"harkd/context"
 	"harkd/core"
 	"harkd/dal"
+	"harkd/driver"
+	"harkd/errors"
+	"harkd/events"
+	"harkd/util"
+	"harkd/util/command"
+	"harkd/util/mergepatch"
 )
 
 // MachineService is a http service for working with machines.
 type MachineService interface {
 	GetMachineByID(id string) (core.Machine, error)
-	GetMachines() ([]core.Machine, error)
+	ListMachines(core.MachineQuery) (core.MachinePage, error)
+	GetMachineState(id string) (core.RuntimeInfo, error)
+	GetMachineHistory(id string) ([]core.MachineVersion, error)
+
+	CreateMachine(core.Machine) (core.Operation, error)
+	CreateMachineWithNewID(core.Machine) (core.Machine, core.Operation, error)
+	UpdateMachine(id string, patch []byte, pre core.Precondition) (core.Operation, error)
+	RestoreMachine(id string, revision uint64, pre core.Precondition) (core.Operation, error)
+	DeleteMachine(id string, force bool, pre core.Precondition) (core.Operation, error)
 
-	CreateMachine(core.Machine) error
+	PowerAction(id string, action core.Action, force bool, pre core.Precondition) (core.Operation, error)
 }
 
 // NewMachineService provides a MachineService.
-func NewMachineService(ctxFactory context.Factory) MachineService {
-	return machineService{ctxFactory, ctxFactory.GetContext().GetDal()}
+func NewMachineService(ctxFactory context.Factory, operations OperationService) MachineService {
+	ctx := ctxFactory.GetContext()
+	return machineService{
+		ctxFactory,
+		ctx.GetDal(),
+		driver.Config{Runner: command.NewRunner(), Events: ctx.GetEventBus()},
+		operations,
+		ctx.GetEventBus(),
+	}
 }
 
 type machineService struct {
 	context.Factory
-	dal dal.Dal
+	dal          dal.Dal
+	driverConfig driver.Config
+	operations   OperationService
+	events       events.Publisher
+}
+
+// driverFor looks up the driver which owns a machine.
+func (mc machineService) driverFor(m core.Machine) (driver.Driver, error) {
+	return driver.Lookup(m.Driver, mc.driverConfig)
+}
+
+// driverUntil looks up the driver which owns a machine, for work which gives
+// up once ctx is done: the driver runs no more commands after that, and kills
+// any it is running.
+func (mc machineService) driverUntil(ctx gocontext.Context, m core.Machine) (driver.Driver, error) {
+	cfg := mc.driverConfig
+	cfg.Runner = command.WithContext(ctx, cfg.Runner)
+	return driver.Lookup(m.Driver, cfg)
 }
 
 // GetMachineID looks up a machine by ID. It returns an error if the machine does not exist.
@@ -29,12 +72,383 @@ func (mc machineService) GetMachineByID(id string) (core.Machine, error) {
 	return mc.dal.GetMachineByID(id)
 }
 
-// GetMachines looks up all of the machines managed by hark.
-func (mc machineService) GetMachines() ([]core.Machine, error) {
-	return mc.dal.GetMachines()
+// ListMachines lists a page of the machines a query selects. Selecting by
+// state asks each machine's driver for its state; a machine whose state
+// cannot be found is in StateUnknown.
+func (mc machineService) ListMachines(q core.MachineQuery) (core.MachinePage, error) {
+	machines, err := mc.dal.GetMachines()
+	if err != nil {
+		return core.MachinePage{}, err
+	}
+
+	return core.SelectMachines(machines, q, func(m core.Machine) core.MachineState {
+		d, err := mc.driverFor(m)
+		if err != nil {
+			return core.StateUnknown
+		}
+		state, err := d.Status(m)
+		if err != nil {
+			return core.StateUnknown
+		}
+		return state
+	})
+}
+
+// GetMachineState reports the live state of the VM backing a machine.
+func (mc machineService) GetMachineState(id string) (core.RuntimeInfo, error) {
+	m, err := mc.dal.GetMachineByID(id)
+	if err != nil {
+		return core.RuntimeInfo{}, err
+	}
+
+	d, err := mc.driverFor(m)
+	if err != nil {
+		return core.RuntimeInfo{}, err
+	}
+	return d.Inspect(m)
+}
+
+// GetMachineHistory lists the versions kept of a machine, oldest first.
+func (mc machineService) GetMachineHistory(id string) ([]core.MachineVersion, error) {
+	return mc.dal.GetMachineHistory(id)
+}
+
+// CreateMachine saves a new Machine to the state and starts an operation
+// which creates its VM. The operation's result is the machine as it was
+// created. If the VM cannot be created, the machine is removed from the state
+// again.
+//
+// Once it has started, creating the VM is not given up part way, since a
+// half-built VM could not then be removed.
+func (mc machineService) CreateMachine(m core.Machine) (core.Operation, error) {
+	_, op, err := mc.createMachine(m)
+	return op, err
+}
+
+// createMachine saves a new machine and starts the operation creating its VM,
+// returning the machine as it was saved along with the operation.
+func (mc machineService) createMachine(m core.Machine) (core.Machine, core.Operation, error) {
+	if m.Driver == "" {
+		m.Driver = driver.DefaultDriver
+	}
+	d, err := mc.driverFor(m)
+	if err != nil {
+		return m, core.Operation{}, err
+	}
+
+	// Save the machine first, so that a conflicting ID is caught before the
+	// operation is accepted, and read it back to pick up the revision the
+	// dal gave it.
+	err = mc.dal.Update(func(tx dal.WriteTx) error {
+		if err := tx.SaveMachine(m); err != nil {
+			return err
+		}
+		m, err = tx.GetMachineByID(m.ID)
+		return err
+	})
+	if err != nil {
+		return m, core.Operation{}, err
+	}
+
+	op, err := mc.operations.StartOperation("machine.create", m.ID, func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		if err := ctx.Err(); err != nil {
+			mc.removeMachine(m, "it was cancelled")
+			return nil, err
+		}
+		if err := d.Create(m); err != nil {
+			mc.removeMachine(m, "its VM could not be created")
+			return nil, err
+		}
+
+		mc.events.Publish(events.MachineCreated, m)
+		return m, nil
+	})
+	if err != nil {
+		mc.removeMachine(m, "its creation could not be started")
+	}
+	return m, op, err
+}
+
+// removeMachine rolls back saving a machine which could not be created. The
+// error which stopped it being created is the one the caller needs to see, so
+// a failure to roll back is only logged.
+func (mc machineService) removeMachine(m core.Machine, why string) {
+	if err := mc.dal.DeleteMachine(m.ID); err != nil {
+		fmt.Fprintf(os.Stderr, "harkd: warning: failed to remove machine %q after %s: %s\n", m.ID, why, err)
+	}
+}
+
+// CreateMachineWithNewID creates a new Machine with an ID generated by the
+// server, like CreateMachine. The machine must not already have an ID. Since
+// the caller cannot know the ID, the machine is returned as it was saved, as
+// well as the operation creating its VM.
+func (mc machineService) CreateMachineWithNewID(m core.Machine) (core.Machine, core.Operation, error) {
+	var v errors.Violations
+	if m.ID != "" {
+		v.Add("/id", errors.ReasonReadOnly, "machine id is generated by the server; use PUT to choose one")
+	}
+
+	id, err := util.NewULID()
+	if err != nil {
+		return m, core.Operation{}, err
+	}
+	m.ID = id
+
+	if err := m.Validate(); err != nil {
+		detailer, ok := err.(errors.Detailer)
+		if !ok {
+			return m, core.Operation{}, err
+		}
+		v = append(v, detailer.Details()...)
+	}
+	if err := v.Err(); err != nil {
+		return m, core.Operation{}, err
+	}
+	return mc.createMachine(m)
+}
+
+// UpdateMachine starts an operation which applies a JSON merge patch (RFC
+// 7396) to a machine and saves the result, provided the patched machine is
+// still valid and pre accepts its current revision. The operation's result is
+// the machine as it was saved.
+func (mc machineService) UpdateMachine(id string, patch []byte, pre core.Precondition) (core.Operation, error) {
+	return mc.startUpdate("machine.update", id, pre, func(tx dal.ReadTx, current core.Machine) (core.Machine, error) {
+		return patchMachine(current, patch)
+	})
+}
+
+// RestoreMachine starts an operation which rolls a machine's definition back
+// to the version saved at a revision, which is saved as a new revision. The
+// restored machine must still be valid, and pre must accept the machine's
+// current revision. The operation's result is the machine as it was saved.
+func (mc machineService) RestoreMachine(id string, revision uint64, pre core.Precondition) (core.Operation, error) {
+	return mc.startUpdate("machine.restore", id, pre, func(tx dal.ReadTx, current core.Machine) (core.Machine, error) {
+		history, err := tx.GetMachineHistory(id)
+		if err != nil {
+			return current, err
+		}
+		for _, v := range history {
+			if v.Revision == revision {
+				return v.Machine, nil
+			}
+		}
+		return current, errors.ErrMachineVersionNotFound(id, revision)
+	})
+}
+
+// startUpdate starts an operation which saves the machine returned by
+// change, provided it is still valid and pre accepts the current revision.
+// change reads the state in the same transaction as the machine is saved in.
+//
+// If the machine's hardware changes, its VM is reconfigured to match, which
+// it must be powered off for. A machine with no VM can be changed freely.
+//
+// The change is checked before the operation is accepted, and again when it
+// is saved, so that a change which cannot be made is refused rather than
+// accepted only to fail.
+func (mc machineService) startUpdate(opType, id string, pre core.Precondition, change func(dal.ReadTx, core.Machine) (core.Machine, error)) (core.Operation, error) {
+	plan := func(tx dal.ReadTx) ([]machineUpdate, error) {
+		current, err := tx.GetMachineByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := pre.CheckMachine(current); err != nil {
+			return nil, err
+		}
+
+		updated, err := change(tx, current)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMachineUpdate(current, &updated); err != nil {
+			return nil, err
+		}
+		return []machineUpdate{{current, updated}}, nil
+	}
+
+	var planned []machineUpdate
+	err := mc.dal.View(func(tx dal.ReadTx) (err error) {
+		planned, err = plan(tx)
+		return err
+	})
+	if err != nil {
+		return core.Operation{}, err
+	}
+	if err := checkVMs(mc.driverConfig, planned); err != nil {
+		return core.Operation{}, err
+	}
+
+	check := func(tx dal.ReadTx) error {
+		_, err := plan(tx)
+		return err
+	}
+	return mc.operations.StartOperationIf(opType, id, check, func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		return mc.updateMachine(id, plan)
+	})
+}
+
+// updateMachine saves the change plan works out for a machine, reconfiguring
+// its VM if need be, and returns the machine as it was saved.
+func (mc machineService) updateMachine(id string, plan func(dal.ReadTx) ([]machineUpdate, error)) (core.Machine, error) {
+	var m core.Machine
+	err := saveMachineUpdates(mc.dal, mc.driverConfig, plan, func(tx dal.WriteTx, updates []machineUpdate) (err error) {
+		m, err = tx.UpdateMachine(id, func(core.Machine) (core.Machine, error) {
+			return updates[0].updated, nil
+		})
+		return err
+	})
+	if err != nil {
+		return m, err
+	}
+
+	mc.events.Publish(events.MachineUpdated, m)
+	return m, nil
+}
+
+func patchMachine(m core.Machine, patch []byte) (core.Machine, error) {
+	var patched core.Machine
+
+	doc, err := json.Marshal(m)
+	if err != nil {
+		return patched, errors.ErrSerialization("serializing machine", err)
+	}
+
+	doc, err = mergepatch.Apply(doc, patch)
+	if err != nil {
+		return patched, errors.ErrBadRequestEntity(err)
+	}
+
+	if err := errors.DecodeEntity(doc, &patched); err != nil {
+		return patched, err
+	}
+	return patched, nil
+}
+
+// DeleteMachine starts an operation which tears down the VM backing a machine
+// and removes it from the state. It refuses to delete a running machine unless
+// force is set, or a machine whose revision pre does not accept.
+//
+// If the machine's driver is not installed, it cannot have made a VM for the
+// machine, so the driver is not called and the machine is only removed from
+// the state.
+func (mc machineService) DeleteMachine(id string, force bool, pre core.Precondition) (core.Operation, error) {
+	m, err := mc.dal.GetMachineByID(id)
+	if err != nil {
+		return core.Operation{}, err
+	}
+
+	d, err := mc.driverFor(m)
+	if err != nil {
+		return core.Operation{}, err
+	}
+
+	hasVM := d.Info().Installed
+	if hasVM {
+		state, err := d.Status(m)
+		if err != nil {
+			return core.Operation{}, err
+		}
+		if state.Active() && !force {
+			return core.Operation{}, errors.ErrMachineRunning(id)
+		}
+	}
+
+	return mc.operations.StartOperationIf("machine.delete", id, checkRevision(id, pre), func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		if hasVM {
+			// Cancelling stops the teardown between commands, leaving the
+			// machine in the state.
+			d, err := mc.driverUntil(ctx, m)
+			if err != nil {
+				return nil, err
+			}
+
+			// Once the VM is gone the machine must be removed from the
+			// state, so there is no giving up after this point.
+			if err := d.Destroy(m); err != nil {
+				return nil, err
+			}
+			progress(50)
+		}
+
+		if err := mc.dal.DeleteMachine(id); err != nil {
+			return nil, err
+		}
+
+		mc.events.Publish(events.MachineDeleted, m)
+		return m, nil
+	})
+}
+
+// PowerAction starts an operation which takes a power action on a machine,
+// such as starting or pausing it. The lifecycle must allow the action from the
+// machine's current state. The operation's result is the state of the machine
+// once the action has been taken. pre must accept the machine's revision.
+//
+// force only applies to stopping a machine: it powers the machine off rather
+// than asking the guest to shut down.
+func (mc machineService) PowerAction(id string, action core.Action, force bool, pre core.Precondition) (core.Operation, error) {
+	m, err := mc.dal.GetMachineByID(id)
+	if err != nil {
+		return core.Operation{}, err
+	}
+
+	d, err := mc.driverFor(m)
+	if err != nil {
+		return core.Operation{}, err
+	}
+
+	state, err := d.Status(m)
+	if err != nil {
+		return core.Operation{}, err
+	}
+	if _, err := core.Transition(state, action); err != nil {
+		return core.Operation{}, err
+	}
+
+	return mc.operations.StartOperationIf("machine."+string(action), id, checkRevision(id, pre), func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		cancellable, err := mc.driverUntil(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		if err := takePowerAction(cancellable, m, state, action, force); err != nil {
+			return nil, err
+		}
+		progress(50)
+
+		// The action has been taken, so the operation succeeds even if it
+		// is cancelled while its result is found.
+		return d.Inspect(m)
+	})
+}
+
+// checkRevision checks, in the transaction starting an operation on a
+// machine, that pre accepts the machine's revision, so that the machine
+// cannot change between the check and the operation being accepted.
+func checkRevision(id string, pre core.Precondition) func(dal.ReadTx) error {
+	return func(tx dal.ReadTx) error {
+		m, err := tx.GetMachineByID(id)
+		if err != nil {
+			return err
+		}
+		return pre.CheckMachine(m)
+	}
 }
 
-// CreateMachine creates a new Machine and saves it to the state.
-func (mc machineService) CreateMachine(m core.Machine) error {
-	return mc.dal.SaveMachine(m)
+func takePowerAction(d driver.Driver, m core.Machine, state core.MachineState, action core.Action, force bool) error {
+	switch action {
+	case core.ActionStart:
+		return d.Start(m)
+	case core.ActionStop:
+		// A paused guest cannot respond to an ACPI shutdown.
+		return d.Stop(m, force || state == core.StatePaused)
+	case core.ActionRestart:
+		return d.Restart(m)
+	case core.ActionPause:
+		return d.Pause(m)
+	case core.ActionResume:
+		return d.Resume(m)
+	case core.ActionSave:
+		return d.Save(m)
+	}
+	return errors.ErrIllegalTransition(string(action), string(state))
 }
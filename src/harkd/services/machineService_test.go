@@ -0,0 +1,346 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/driver/drivertest"
+	"harkd/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hookedDal runs a hook before each Update, so that tests can change the state
+// while a service is working, or make the Update fail.
+type hookedDal struct {
+	dal.Dal
+	beforeUpdate func() error
+}
+
+func (hd hookedDal) Update(fn func(dal.WriteTx) error) error {
+	if hd.beforeUpdate != nil {
+		if err := hd.beforeUpdate(); err != nil {
+			return err
+		}
+	}
+	return hd.Dal.Update(fn)
+}
+
+// newTestMachineService provides a MachineService for machines using the fake
+// driver, with a machine "foo" whose VM, if it has one, is in the given
+// state.
+func newTestMachineService(t *testing.T, state core.MachineState) (machineService, *testContext, *drivertest.Backend) {
+	backend := drivertest.Install()
+	ops, ctx := newTestOperationService(t)
+	mc := NewMachineService(ctx, ops).(machineService)
+
+	require.NoError(t, ctx.dal.SaveMachine(core.Machine{ID: "foo", Name: "foo", MemoryMB: 512, Driver: drivertest.Name}))
+	if state != core.StateUnknown {
+		backend.SetVM("foo", drivertest.VM{State: state, MemoryMB: 512})
+	}
+	return mc, ctx, backend
+}
+
+// machineResult waits for an operation started by the machine service, and
+// returns the machine it resulted in, or the error it was refused or failed
+// with.
+func machineResult(t *testing.T, mc machineService, op core.Operation, err error) (core.Machine, error) {
+	var m core.Machine
+	if err != nil {
+		return m, err
+	}
+
+	op = waitForOperation(t, mc.operations, op.ID)
+	if err := op.Failure(); err != nil {
+		return m, err
+	}
+	require.NoError(t, json.Unmarshal(op.Result, &m))
+	return m, nil
+}
+
+func requireCode(t *testing.T, code int, err error) {
+	require.Error(t, err)
+	coder, ok := err.(errors.Coder)
+	require.True(t, ok, "%T is not a Coder", err)
+	require.Equal(t, code, coder.Code())
+}
+
+func TestUpdateMachineHardware(t *testing.T) {
+	cases := []struct {
+		name         string
+		state        core.MachineState
+		expectCode   int
+		expectModify bool
+	}{
+		{"powered off", core.StatePoweroff, 0, true},
+		{"no vm", core.StateUnknown, 0, false},
+		{"running", core.StateRunning, 409002, false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			mc, ctx, backend := newTestMachineService(t, c.state)
+
+			// Execute
+			op, err := mc.UpdateMachine("foo", []byte(`{"memoryMB":1024}`), nil)
+			m, err := machineResult(t, mc, op, err)
+
+			// Assert
+			saved, getErr := ctx.dal.GetMachineByID("foo")
+			require.NoError(t, getErr)
+			vm, _ := backend.GetVM("foo")
+			if c.expectCode != 0 {
+				requireCode(t, c.expectCode, err)
+				require.Equal(t, uint(512), saved.MemoryMB)
+				require.Equal(t, uint(512), vm.MemoryMB)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, uint(1024), m.MemoryMB)
+			require.True(t, m.Revision > 1, "the revision did not advance")
+			require.Equal(t, m, saved)
+			require.Equal(t, c.expectModify, vm.MemoryMB == 1024)
+			require.Equal(t, c.expectModify, contains(backend.GetCalls(), "Modify foo"))
+		})
+	}
+}
+
+func TestUpdateMachineReportsEveryViolation(t *testing.T) {
+	// Prepare
+	mc, _, _ := newTestMachineService(t, core.StatePoweroff)
+
+	// Execute
+	_, err := mc.UpdateMachine("foo", []byte(`{"driver":"virtualbox","name":"","memoryMB":0}`), nil)
+
+	// Assert
+	requireCode(t, 400002, err)
+	require.Equal(t, []errors.Violation{
+		{Field: "/driver", Reason: errors.ReasonImmutable, Message: "machine driver cannot be changed"},
+		{Field: "/name", Reason: errors.ReasonRequired, Message: "machine name cannot be empty"},
+		{Field: "/memoryMB", Reason: errors.ReasonMinimum, Message: "machine memoryMB cannot be 0"},
+	}, err.(errors.Detailer).Details())
+}
+
+func TestUpdateMachineNotSaved(t *testing.T) {
+	cases := []struct {
+		name       string
+		hook       func(ctx *testContext) error
+		expectCode int
+	}{
+		{
+			"save fails",
+			func(ctx *testContext) error {
+				return errors.ErrStatePersist(fmt.Errorf("disk full"))
+			},
+			500002,
+		},
+		{
+			"hardware changed meanwhile",
+			func(ctx *testContext) error {
+				_, err := ctx.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+					m.MemoryMB = 2048
+					return m, nil
+				})
+				return err
+			},
+			409006,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			mc, ctx, backend := newTestMachineService(t, core.StatePoweroff)
+			mc.dal = hookedDal{ctx.dal, func() error { return c.hook(ctx) }}
+
+			// Execute
+			op, err := mc.UpdateMachine("foo", []byte(`{"memoryMB":1024}`), nil)
+			_, err = machineResult(t, mc, op, err)
+
+			// Assert: the VM was put back as it was.
+			requireCode(t, c.expectCode, err)
+			vm, _ := backend.GetVM("foo")
+			require.Equal(t, uint(512), vm.MemoryMB)
+			require.Equal(t, []string{"Inspect foo", "Inspect foo", "Modify foo", "Modify foo"}, backend.GetCalls())
+		})
+	}
+}
+
+func TestUpdateMachineMergesConcurrentChanges(t *testing.T) {
+	// Prepare: the name is changed after the patch was first applied.
+	mc, ctx, _ := newTestMachineService(t, core.StatePoweroff)
+	mc.dal = hookedDal{ctx.dal, func() error {
+		_, err := ctx.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+			m.Name = "renamed"
+			return m, nil
+		})
+		return err
+	}}
+
+	// Execute
+	op, err := mc.UpdateMachine("foo", []byte(`{"memoryMB":1024}`), nil)
+	m, err := machineResult(t, mc, op, err)
+
+	// Assert: the patch was applied to the machine as it was saved.
+	require.NoError(t, err)
+	require.Equal(t, "renamed", m.Name)
+	require.Equal(t, uint(1024), m.MemoryMB)
+}
+
+func TestCreateMachineRollsBack(t *testing.T) {
+	// Prepare
+	mc, ctx, backend := newTestMachineService(t, core.StateUnknown)
+	backend.SetFail("Create", fmt.Errorf("no room"))
+
+	// Execute
+	op, err := mc.CreateMachine(core.Machine{ID: "bar", Name: "bar", MemoryMB: 512, Driver: drivertest.Name})
+	_, err = machineResult(t, mc, op, err)
+
+	// Assert
+	require.EqualError(t, err, "no room")
+	_, err = ctx.dal.GetMachineByID("bar")
+	requireCode(t, 404001, err)
+}
+
+func TestMachineOperationChecksRevisionWhenAccepted(t *testing.T) {
+	cases := []struct {
+		name  string
+		start func(mc machineService, pre core.Precondition) (core.Operation, error)
+	}{
+		{"delete", func(mc machineService, pre core.Precondition) (core.Operation, error) {
+			return mc.DeleteMachine("foo", false, pre)
+		}},
+		{"update", func(mc machineService, pre core.Precondition) (core.Operation, error) {
+			return mc.UpdateMachine("foo", []byte(`{"memoryMB":1024}`), pre)
+		}},
+		{"power action", func(mc machineService, pre core.Precondition) (core.Operation, error) {
+			return mc.PowerAction("foo", core.ActionStart, false, pre)
+		}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare: the machine is changed after the request is checked
+			// against the driver, but before the operation is recorded.
+			mc, ctx, backend := newTestMachineService(t, core.StatePoweroff)
+			mc.operations.(*operationService).dal = hookedDal{ctx.dal, func() error {
+				_, err := ctx.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+					m.Name = "renamed"
+					return m, nil
+				})
+				return err
+			}}
+
+			// Execute
+			_, err := c.start(mc, func(r uint64) bool { return r == 1 })
+
+			// Assert
+			requireCode(t, 412001, err)
+			ops, err := mc.operations.GetOperations()
+			require.NoError(t, err)
+			require.Empty(t, ops)
+			require.Equal(t, []string{"Inspect foo"}, backend.GetCalls())
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRestoreMachine(t *testing.T) {
+	cases := []struct {
+		name         string
+		revision     uint64
+		pre          core.Precondition
+		expectCode   int
+		expectMemory uint
+	}{
+		{"earlier revision", 1, nil, 0, 512},
+		{"current revision", 0, nil, 0, 1024},
+		{"unknown revision", 99, nil, 404004, 1024},
+		{"precondition met", 1, func(r uint64) bool { return r != 1 }, 0, 512},
+		{"precondition failed", 1, func(r uint64) bool { return r == 1 }, 412001, 1024},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			mc, ctx, backend := newTestMachineService(t, core.StatePoweroff)
+			op, err := mc.UpdateMachine("foo", []byte(`{"memoryMB":1024}`), nil)
+			patched, err := machineResult(t, mc, op, err)
+			require.NoError(t, err)
+
+			// A revision of 0 stands for the revision the patch was saved
+			// at.
+			revision := c.revision
+			if revision == 0 {
+				revision = patched.Revision
+			}
+
+			// Execute
+			op, err = mc.RestoreMachine("foo", revision, c.pre)
+			m, err := machineResult(t, mc, op, err)
+
+			// Assert
+			saved, getErr := ctx.dal.GetMachineByID("foo")
+			require.NoError(t, getErr)
+			vm, _ := backend.GetVM("foo")
+			require.Equal(t, c.expectMemory, saved.MemoryMB)
+			require.Equal(t, c.expectMemory, vm.MemoryMB)
+			if c.expectCode != 0 {
+				requireCode(t, c.expectCode, err)
+				require.Equal(t, patched.Revision, saved.Revision)
+				return
+			}
+
+			// The restored version is saved as a new revision.
+			require.NoError(t, err)
+			require.Equal(t, saved, m)
+			require.True(t, m.Revision > patched.Revision, "the revision did not advance")
+			history, err := mc.GetMachineHistory("foo")
+			require.NoError(t, err)
+			require.Len(t, history, 3)
+		})
+	}
+}
+
+func TestRestoreMachineReadsHistoryWhenSaving(t *testing.T) {
+	// Prepare: the machine is changed again after the version to restore is
+	// first looked up.
+	mc, ctx, _ := newTestMachineService(t, core.StateUnknown)
+	mc.dal = hookedDal{ctx.dal, func() error {
+		_, err := ctx.dal.UpdateMachine("foo", func(m core.Machine) (core.Machine, error) {
+			m.Name = "renamed"
+			return m, nil
+		})
+		return err
+	}}
+
+	// Execute
+	op, err := mc.RestoreMachine("foo", 1, nil)
+	m, err := machineResult(t, mc, op, err)
+
+	// Assert: the version was restored over the latest revision.
+	require.NoError(t, err)
+	require.Equal(t, "foo", m.Name)
+	history, err := mc.GetMachineHistory("foo")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, "renamed", history[1].Machine.Name)
+	require.Equal(t, m, history[2].Machine)
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"fmt"
+	"os"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/driver"
+	"harkd/errors"
+)
+
+// machineUpdate is a change to the definition of a machine.
+type machineUpdate struct {
+	current core.Machine
+	updated core.Machine
+}
+
+// checkMachineUpdate checks that a machine's definition can be changed to
+// updated: its ID and driver cannot change, and it must still be valid. Every
+// problem found is reported together. The revision is maintained by the dal,
+// so updated is given the current one.
+func checkMachineUpdate(current core.Machine, updated *core.Machine) error {
+	updated.Revision = current.Revision
+
+	var v errors.Violations
+	if updated.ID != current.ID {
+		v.Add("/id", errors.ReasonImmutable, "machine id cannot be changed")
+	}
+	if updated.Driver != current.Driver {
+		v.Add("/driver", errors.ReasonImmutable, "machine driver cannot be changed")
+	}
+	if err := updated.Validate(); err != nil {
+		detailer, ok := err.(errors.Detailer)
+		if !ok {
+			return err
+		}
+		v = append(v, detailer.Details()...)
+	}
+	return v.Err()
+}
+
+// saveMachineUpdates saves changes to the definitions of machines, and
+// reconfigures the VMs of those whose hardware changes to match.
+//
+// The drivers are not called with the state locked. Instead, plan works out
+// the changes from the state, and the VMs are reconfigured; then plan works
+// them out again in a transaction, and save saves them, provided each machine
+// still has the hardware its VM was reconfigured for. If they cannot be
+// saved, the VMs are put back as they were.
+func saveMachineUpdates(d dal.Dal, cfg driver.Config, plan func(dal.ReadTx) ([]machineUpdate, error), save func(dal.WriteTx, []machineUpdate) error) error {
+	var planned []machineUpdate
+	err := d.View(func(tx dal.ReadTx) (err error) {
+		planned, err = plan(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	reconfigured, err := reconfigureVMs(cfg, planned)
+	if err != nil {
+		return err
+	}
+
+	err = d.Update(func(tx dal.WriteTx) error {
+		updates, err := plan(tx)
+		if err != nil {
+			return err
+		}
+		if err := checkSameHardware(planned, updates); err != nil {
+			return err
+		}
+		return save(tx, updates)
+	})
+	if err != nil {
+		restoreVMs(cfg, reconfigured)
+	}
+	return err
+}
+
+// checkSameHardware checks that updates give every machine the hardware they
+// were planned to, so that its VM was reconfigured to match.
+func checkSameHardware(planned, updates []machineUpdate) error {
+	switch {
+	case len(updates) > len(planned):
+		return errors.ErrMachineChanged(updates[len(planned)].current.ID)
+	case len(updates) < len(planned):
+		return errors.ErrMachineChanged(planned[len(updates)].current.ID)
+	}
+	for i, u := range updates {
+		p := planned[i]
+		if u.current.ID != p.current.ID || u.current.HardwareDiffers(p.current) || u.updated.HardwareDiffers(p.updated) {
+			return errors.ErrMachineChanged(u.current.ID)
+		}
+	}
+	return nil
+}
+
+// reconfigureVMs reconfigures the VMs of the machines whose hardware changes.
+// It returns the updates whose VMs were reconfigured. If a VM cannot be
+// reconfigured, those already done are put back.
+func reconfigureVMs(cfg driver.Config, updates []machineUpdate) ([]machineUpdate, error) {
+	var done []machineUpdate
+	for _, u := range updates {
+		reconfigured, err := reconfigureVM(cfg, u)
+		if err != nil {
+			restoreVMs(cfg, done)
+			return nil, err
+		}
+		if reconfigured {
+			done = append(done, u)
+		}
+	}
+	return done, nil
+}
+
+// checkVMs checks that the VM of every machine whose hardware changes can be
+// reconfigured, without reconfiguring it.
+func checkVMs(cfg driver.Config, updates []machineUpdate) error {
+	for _, u := range updates {
+		if _, err := vmToReconfigure(cfg, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconfigureVM reconfigures a machine's VM if its hardware changes, and
+// reports whether it did.
+func reconfigureVM(cfg driver.Config, u machineUpdate) (bool, error) {
+	d, err := vmToReconfigure(cfg, u)
+	if d == nil || err != nil {
+		return false, err
+	}
+	return true, d.Modify(u.updated)
+}
+
+// vmToReconfigure returns the driver of a machine whose VM must be
+// reconfigured because its hardware changes, which it must be powered off
+// for, or nil if there is nothing to reconfigure. A machine with no VM has
+// nothing to reconfigure.
+func vmToReconfigure(cfg driver.Config, u machineUpdate) (driver.Driver, error) {
+	if !u.updated.HardwareDiffers(u.current) {
+		return nil, nil
+	}
+
+	d, err := driver.Lookup(u.current.Driver, cfg)
+	if err != nil {
+		return nil, err
+	}
+	state, err := d.Status(u.current)
+	if err != nil {
+		return nil, err
+	}
+	if state == core.StateUnknown {
+		return nil, nil
+	}
+	if !state.PoweredOff() {
+		return nil, errors.ErrMachineNotPoweredOff(u.current.ID)
+	}
+	return d, nil
+}
+
+// restoreVMs puts back the VMs reconfigured for updates which could not be
+// saved. There is nobody to report a failure to, since the error the updates
+// failed with is the one the caller needs, so it is logged.
+func restoreVMs(cfg driver.Config, reconfigured []machineUpdate) {
+	for _, u := range reconfigured {
+		d, err := driver.Lookup(u.current.Driver, cfg)
+		if err == nil {
+			err = d.Modify(u.current)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "harkd: warning: failed to restore the hardware of machine %q after a failed update: %s\n", u.current.ID, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"harkd/context"
+	"harkd/core"
+	"harkd/dal"
+	"harkd/errors"
+	"harkd/events"
+	"harkd/util"
+)
+
+// OperationFunc does the work of an operation. It should give up early if ctx
+// is cancelled, and may report its progress as a percentage.
+//
+// The value it returns becomes the operation's result.
+type OperationFunc func(ctx gocontext.Context, progress func(int)) (interface{}, error)
+
+// OperationService runs long-running work in the background, tracking it as
+// operations which are persisted in the state.
+type OperationService interface {
+	GetOperations() ([]core.Operation, error)
+	GetOperation(id string) (core.Operation, error)
+
+	StartOperation(opType, machineID string, fn OperationFunc) (core.Operation, error)
+	StartOperationIf(opType, machineID string, check func(dal.ReadTx) error, fn OperationFunc) (core.Operation, error)
+	CancelOperation(id string) (core.Operation, error)
+}
+
+// NewOperationService provides an OperationService.
+//
+// Operations are only tracked by the process running them, so any operation
+// which is still pending or running in the state when the service is created
+// was orphaned by a restart: these are marked as failed.
+func NewOperationService(ctxFactory context.Factory) (OperationService, error) {
+	ctx := ctxFactory.GetContext()
+	ops := &operationService{
+		dal:     ctx.GetDal(),
+		events:  ctx.GetEventBus(),
+		cancels: make(map[string]gocontext.CancelFunc),
+	}
+
+	if err := ops.failOrphaned(); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+type operationService struct {
+	dal    dal.Dal
+	events events.Publisher
+
+	// cancels holds the cancel funcs of the operations running in this
+	// process.
+	mutex   sync.Mutex
+	cancels map[string]gocontext.CancelFunc
+}
+
+func (ops *operationService) GetOperations() ([]core.Operation, error) {
+	return ops.dal.GetOperations()
+}
+
+func (ops *operationService) GetOperation(id string) (core.Operation, error) {
+	return ops.dal.GetOperation(id)
+}
+
+// StartOperation records a new pending operation and runs fn in the
+// background to do its work.
+func (ops *operationService) StartOperation(opType, machineID string, fn OperationFunc) (core.Operation, error) {
+	return ops.StartOperationIf(opType, machineID, nil, fn)
+}
+
+// StartOperationIf is like StartOperation, but the operation is only started
+// if check, which is run in the transaction recording it, returns no error.
+// This lets the caller check the state as of when the operation is accepted.
+func (ops *operationService) StartOperationIf(opType, machineID string, check func(dal.ReadTx) error, fn OperationFunc) (core.Operation, error) {
+	id, err := util.NewRandomID()
+	if err != nil {
+		return core.Operation{}, err
+	}
+
+	now := time.Now().UTC()
+	op := core.Operation{
+		ID:        id,
+		Type:      opType,
+		MachineID: machineID,
+		Status:    core.OperationPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = ops.dal.Update(func(tx dal.WriteTx) error {
+		if check != nil {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+		return tx.PutOperation(op)
+	})
+	if err != nil {
+		return op, err
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	ops.mutex.Lock()
+	ops.cancels[id] = cancel
+	ops.mutex.Unlock()
+
+	ops.events.Publish(events.OperationStarted, op)
+	go ops.run(ctx, op, fn)
+
+	return op, nil
+}
+
+// CancelOperation asks a running operation to stop. The operation is marked as
+// cancelled once its work has given up.
+func (ops *operationService) CancelOperation(id string) (core.Operation, error) {
+	op, err := ops.dal.GetOperation(id)
+	if err != nil {
+		return op, err
+	}
+	if op.Status.Finished() {
+		return op, errors.ErrOperationFinished(id)
+	}
+
+	ops.mutex.Lock()
+	cancel, ok := ops.cancels[id]
+	ops.mutex.Unlock()
+
+	if !ok {
+		return op, errors.ErrOperationNotCancellable(id)
+	}
+	cancel()
+
+	return op, nil
+}
+
+func (ops *operationService) run(ctx gocontext.Context, op core.Operation, fn OperationFunc) {
+	defer ops.forget(op.ID)
+
+	// The operation is owned by this goroutine from here on; the mutex only
+	// serializes progress reports with the final update.
+	var mutex sync.Mutex
+	update := func(change func(*core.Operation)) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if op.Status.Finished() {
+			return
+		}
+		change(&op)
+		op.UpdatedAt = time.Now().UTC()
+		// There is nobody to report a failure to save to; the next update
+		// will try again.
+		ops.dal.PutOperation(op)
+	}
+
+	update(func(o *core.Operation) { o.Status = core.OperationRunning })
+
+	res, err := fn(ctx, func(progress int) {
+		update(func(o *core.Operation) { o.Progress = progress })
+	})
+
+	update(func(o *core.Operation) {
+		finishOperation(ctx, o, res, err)
+	})
+
+	ops.events.Publish(events.OperationFinished, op)
+}
+
+// finishOperation records the outcome of an operation's work.
+func finishOperation(ctx gocontext.Context, op *core.Operation, res interface{}, err error) {
+	if err == nil && res != nil {
+		op.Result, err = json.Marshal(res)
+		if err != nil {
+			err = errors.ErrSerialization("serializing operation result", err)
+		}
+	}
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		op.Status = core.OperationCancelled
+	case err != nil:
+		op.Status = core.OperationFailed
+		op.Error = operationError(err)
+	default:
+		op.Status = core.OperationSucceeded
+		op.Progress = 100
+	}
+}
+
+func operationError(err error) *core.OperationError {
+	code := errors.DefaultErrorCode
+	if coder, ok := err.(errors.Coder); ok {
+		code = coder.Code()
+	}
+	return &core.OperationError{ErrorCode: code, Message: err.Error()}
+}
+
+func (ops *operationService) forget(id string) {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+
+	if cancel, ok := ops.cancels[id]; ok {
+		cancel()
+		delete(ops.cancels, id)
+	}
+}
+
+func (ops *operationService) failOrphaned() error {
+	operations, err := ops.dal.GetOperations()
+	if err != nil {
+		return err
+	}
+
+	for _, op := range operations {
+		if op.Status.Finished() {
+			continue
+		}
+		op.Status = core.OperationFailed
+		op.Error = operationError(errors.ErrOperationInterrupted())
+		op.UpdatedAt = time.Now().UTC()
+		if err := ops.dal.PutOperation(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
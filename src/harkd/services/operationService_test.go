@@ -0,0 +1,179 @@
+package services
+
+import (
+	gocontext "context"
+	"testing"
+	"time"
+
+	"harkd/context"
+	"harkd/core"
+	"harkd/dal"
+	"harkd/errors"
+	"harkd/events"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testContext gives every caller the same in-memory dal and event bus.
+type testContext struct {
+	dal    dal.Dal
+	events events.Bus
+}
+
+func newTestContext() *testContext {
+	return &testContext{dal.NewMemoryDal(), events.NewBus(events.DefaultBufferSize)}
+}
+
+func (tc *testContext) GetContext() context.Context {
+	return tc
+}
+
+func (tc *testContext) GetDal() dal.Dal {
+	return tc.dal
+}
+
+func (tc *testContext) GetEventBus() events.Bus {
+	return tc.events
+}
+
+// waitForOperation polls an operation until it has finished.
+func waitForOperation(t *testing.T, ops OperationService, id string) core.Operation {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		op, err := ops.GetOperation(id)
+		require.NoError(t, err)
+		if op.Status.Finished() {
+			return op
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("operation %s still %s", id, op.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestOperationService(t *testing.T) (OperationService, *testContext) {
+	ctx := newTestContext()
+	ops, err := NewOperationService(ctx)
+	require.NoError(t, err)
+	return ops, ctx
+}
+
+func TestStartOperation(t *testing.T) {
+	cases := []struct {
+		name         string
+		fn           OperationFunc
+		expectStatus core.OperationStatus
+		expectResult string
+		expectCode   int
+	}{
+		{
+			"succeeds",
+			func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+				progress(50)
+				return "done", nil
+			},
+			core.OperationSucceeded, `"done"`, 0,
+		},
+		{
+			"fails",
+			func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+				return nil, errors.ErrMachineNotFound("foo")
+			},
+			core.OperationFailed, "", 404001,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			ops, _ := newTestOperationService(t)
+
+			// Execute
+			started, err := ops.StartOperation("test", "foo", c.fn)
+			require.NoError(t, err)
+			op := waitForOperation(t, ops, started.ID)
+
+			// Assert
+			require.Equal(t, core.OperationPending, started.Status)
+			require.Equal(t, "test", op.Type)
+			require.Equal(t, "foo", op.MachineID)
+			require.Equal(t, c.expectStatus, op.Status)
+			require.Equal(t, c.expectResult, string(op.Result))
+			if c.expectCode == 0 {
+				require.Nil(t, op.Error)
+				require.Equal(t, 100, op.Progress)
+			} else {
+				require.NotNil(t, op.Error)
+				require.Equal(t, c.expectCode, op.Error.Code())
+			}
+		})
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	// Prepare
+	ops, _ := newTestOperationService(t)
+	running := make(chan struct{})
+	started, err := ops.StartOperation("test", "", func(ctx gocontext.Context, progress func(int)) (interface{}, error) {
+		close(running)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, err)
+	<-running
+
+	// Execute
+	_, err = ops.CancelOperation(started.ID)
+	require.NoError(t, err)
+	op := waitForOperation(t, ops, started.ID)
+
+	// Assert
+	require.Equal(t, core.OperationCancelled, op.Status)
+
+	// A finished operation cannot be cancelled again.
+	_, err = ops.CancelOperation(started.ID)
+	require.Error(t, err)
+	require.Equal(t, 409004, err.(errors.Coder).Code())
+}
+
+func TestCancelOperationNotFound(t *testing.T) {
+	ops, _ := newTestOperationService(t)
+
+	_, err := ops.CancelOperation("nothing")
+
+	require.Error(t, err)
+	require.Equal(t, 404003, err.(errors.Coder).Code())
+}
+
+func TestOrphanedOperationsFail(t *testing.T) {
+	// Prepare: operations left behind by a process which has stopped.
+	ctx := newTestContext()
+	for _, op := range []core.Operation{
+		{ID: "pending", Status: core.OperationPending},
+		{ID: "running", Status: core.OperationRunning},
+		{ID: "done", Status: core.OperationSucceeded},
+	} {
+		require.NoError(t, ctx.dal.PutOperation(op))
+	}
+
+	// Execute: the service is started again.
+	ops, err := NewOperationService(ctx)
+	require.NoError(t, err)
+
+	// Assert
+	for _, id := range []string{"pending", "running"} {
+		op, err := ops.GetOperation(id)
+		require.NoError(t, err)
+		require.Equal(t, core.OperationFailed, op.Status)
+		require.Equal(t, 500008, op.Error.Code())
+
+		// An orphaned operation has nothing running to cancel.
+		_, err = ops.CancelOperation(id)
+		require.Equal(t, 409004, err.(errors.Coder).Code())
+	}
+	op, err := ops.GetOperation("done")
+	require.NoError(t, err)
+	require.Equal(t, core.OperationSucceeded, op.Status)
+}
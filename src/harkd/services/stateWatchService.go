@@ -0,0 +1,86 @@
+package services
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"time"
+
+	"harkd/context"
+	"harkd/dal"
+	"harkd/events"
+	"harkd/util/watch"
+)
+
+// statePollInterval is how often the state file is checked for changes where
+// it cannot be watched with inotify.
+const statePollInterval = 2 * time.Second
+
+// StateWatchService watches the state file for changes made by other
+// processes, such as the CLI or a text editor.
+type StateWatchService interface {
+	// Start watches the state file in the background until ctx is done.
+	// When it is changed by something else, the state is reloaded and a
+	// notification is published. It does nothing if the state is not kept
+	// in a file which can be changed by other processes.
+	Start(ctx gocontext.Context) error
+}
+
+// ExternalModification is the data published when the state file is changed
+// by something other than this harkd.
+type ExternalModification struct {
+	File string `json:"file"`
+}
+
+// NewStateWatchService provides a StateWatchService.
+func NewStateWatchService(ctxFactory context.Factory) StateWatchService {
+	ctx := ctxFactory.GetContext()
+	return stateWatchService{ctx.GetDal(), ctx.GetEventBus()}
+}
+
+type stateWatchService struct {
+	dal    dal.Dal
+	events events.Publisher
+}
+
+func (sw stateWatchService) Start(ctx gocontext.Context) error {
+	reloader, ok := sw.dal.(dal.Reloader)
+	if !ok {
+		return nil
+	}
+
+	w, err := watch.File(reloader.StateFile(), statePollInterval)
+	if err != nil {
+		return err
+	}
+
+	// Load the state now, so that changes made before the first request are
+	// noticed.
+	if _, err := reloader.Reload(); err != nil {
+		fmt.Fprintf(os.Stderr, "harkd: warning: failed to load state: %s\n", err)
+	}
+
+	go func() {
+		defer w.Close()
+
+		// A change is reported until it has been published, so if the state
+		// cannot be reloaded the change is published after the next reload.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.Changes():
+			}
+
+			changed, err := reloader.Reload()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "harkd: warning: failed to reload externally modified state: %s\n", err)
+				continue
+			}
+			if changed {
+				sw.events.Publish(events.StateExternallyModified, ExternalModification{reloader.StateFile()})
+			}
+		}
+	}()
+	return nil
+}
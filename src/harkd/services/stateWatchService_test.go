@@ -0,0 +1,112 @@
+package services
+
+import (
+	gocontext "context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"harkd/core"
+	"harkd/dal"
+	"harkd/events"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newWatchedDals provides two dals on the same state file: one for harkd, and
+// one standing in for another process.
+func newWatchedDals(t *testing.T) (d, other dal.Dal, cleanup func()) {
+	dir, err := ioutil.TempDir("", "hark-watch")
+	require.NoError(t, err)
+	filename := filepath.Join(dir, "hark-state.json")
+
+	d, err = dal.NewJSONFileDal(filename, time.Second)
+	require.NoError(t, err)
+	other, err = dal.NewJSONFileDal(filename, time.Second)
+	require.NoError(t, err)
+	return d, other, func() { os.RemoveAll(dir) }
+}
+
+// heldReloader holds back every reload of the state but the first until it is
+// released, so that a test can read the state before the watcher reloads it.
+type heldReloader struct {
+	dal.Dal
+	started bool
+	release chan struct{}
+}
+
+func (hr *heldReloader) StateFile() string {
+	return hr.Dal.(dal.Reloader).StateFile()
+}
+
+func (hr *heldReloader) Reload() (bool, error) {
+	if hr.started {
+		<-hr.release
+	}
+	hr.started = true
+	return hr.Dal.(dal.Reloader).Reload()
+}
+
+func TestStateWatchServiceStops(t *testing.T) {
+	// Prepare
+	d, other, cleanup := newWatchedDals(t)
+	defer cleanup()
+	ctx := &testContext{d, events.NewBus(events.DefaultBufferSize)}
+	sub := ctx.events.Subscribe(0)
+	defer sub.Close()
+
+	watching, stop := gocontext.WithCancel(gocontext.Background())
+	defer stop()
+	require.NoError(t, NewStateWatchService(ctx).Start(watching))
+
+	// Execute & Assert: a change made by another process is published until
+	// the service is stopped.
+	require.NoError(t, other.SaveMachine(core.Machine{ID: "foo", Name: "foo", MemoryMB: 512}))
+	select {
+	case ev := <-sub.Events():
+		require.Equal(t, events.StateExternallyModified, ev.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not published")
+	}
+
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, other.SaveMachine(core.Machine{ID: "bar", Name: "bar", MemoryMB: 512}))
+	select {
+	case ev := <-sub.Events():
+		t.Fatalf("%s was published after the service stopped", ev.Type)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestStateWatchServiceAfterRead(t *testing.T) {
+	// Prepare
+	d, other, cleanup := newWatchedDals(t)
+	defer cleanup()
+	held := &heldReloader{Dal: d, release: make(chan struct{})}
+	ctx := &testContext{held, events.NewBus(events.DefaultBufferSize)}
+	sub := ctx.events.Subscribe(0)
+	defer sub.Close()
+
+	watching, stop := gocontext.WithCancel(gocontext.Background())
+	defer stop()
+	require.NoError(t, NewStateWatchService(ctx).Start(watching))
+
+	// Execute: the state is read, and so reloaded, after another process
+	// changes it but before the watcher reloads it.
+	require.NoError(t, other.SaveMachine(core.Machine{ID: "foo", Name: "foo", MemoryMB: 512}))
+	machines, err := d.GetMachines()
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+	close(held.release)
+
+	// Assert: the change is still published.
+	select {
+	case ev := <-sub.Events():
+		require.Equal(t, events.StateExternallyModified, ev.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not published")
+	}
+}
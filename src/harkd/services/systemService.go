@@ -1,7 +1,16 @@
 package services
 
 import (
+	"fmt"
+	"io"
+
+	"harkd/context"
+	"harkd/core"
+	"harkd/dal"
 	"harkd/driver"
+	"harkd/errors"
+	"harkd/events"
+	"harkd/util"
 	"harkd/util/command"
 )
 
@@ -10,26 +19,285 @@ import (
 type SystemService interface {
 	GetStatus() Status
 	GetDriverInfo() []driver.Info
+	GetDrift() (core.DriftReport, error)
+
+	// ExportState writes the machines to a bundle which can be imported by
+	// another hark.
+	ExportState(w io.Writer) error
+
+	// ImportState imports the machines from a bundle written by ExportState.
+	// VMs are neither created nor destroyed, so drift detection will report
+	// any machines whose VM is not on this host; but a replaced machine's VM
+	// is reconfigured if its hardware changes, as for any other update. A
+	// machine whose VM is running is not deleted unless force is set. With
+	// dryRun set, the changes are reported but not made.
+	ImportState(r io.Reader, mode core.ImportMode, force, dryRun bool) (core.ImportReport, error)
+
+	// GetStateLock reports who holds the state lock, and how long this
+	// process has waited for it.
+	GetStateLock() (util.LockStats, error)
 }
 
 // Status represents the current overall status of the hark service.
 type Status struct {
 	Healthy bool `json:"healthy"`
+
+	// Warnings are problems which need an operator's attention, but which do
+	// not stop hark working.
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // NewSystemService constructs a SystemService.
-func NewSystemService() SystemService {
-	return systemService{command.NewRunner()}
+func NewSystemService(ctxFactory context.Factory, drift DriftService) SystemService {
+	return systemService{command.NewRunner(), ctxFactory, drift}
 }
 
 type systemService struct {
 	command.Runner
+	context.Factory
+	drift DriftService
 }
 
 func (sc systemService) GetStatus() Status {
-	return Status{true}
+	status := Status{Healthy: true}
+	if w, ok := sc.GetContext().GetDal().(dal.Warner); ok {
+		status.Warnings = w.Warnings()
+	}
+	return status
 }
 
 func (sc systemService) GetDriverInfo() []driver.Info {
-	return driver.GetDriverInfo(sc.Runner)
+	return driver.GetDriverInfo(driver.Config{Runner: sc.Runner})
+}
+
+func (sc systemService) GetDrift() (core.DriftReport, error) {
+	return sc.drift.GetDrift()
+}
+
+func (sc systemService) GetStateLock() (util.LockStats, error) {
+	l, ok := sc.GetContext().GetDal().(dal.Locker)
+	if !ok {
+		return util.LockStats{}, errors.ErrStateNotLocked()
+	}
+	return l.LockStats(), nil
+}
+
+func (sc systemService) ExportState(w io.Writer) error {
+	machines, err := sc.GetContext().GetDal().GetMachines()
+	if err != nil {
+		return err
+	}
+	return dal.WriteStateBundle(w, machines)
+}
+
+func (sc systemService) ImportState(r io.Reader, mode core.ImportMode, force, dryRun bool) (core.ImportReport, error) {
+	imported, err := dal.ReadStateBundle(r)
+	if err != nil {
+		return core.ImportReport{}, err
+	}
+
+	ctx := sc.GetContext()
+	d := ctx.GetDal()
+
+	// Replacing a machine is checked, and its VM reconfigured, the same way
+	// as any other change to a machine.
+	var report core.ImportReport
+	plan := func(tx dal.ReadTx) ([]machineUpdate, error) {
+		existing, err := tx.GetMachines()
+		if err != nil {
+			return nil, err
+		}
+		report, err = core.PlanImport(existing, imported, mode)
+		if err != nil {
+			return nil, err
+		}
+		return planImportUpdates(tx, report, imported)
+	}
+
+	// A deleted machine is only removed from the state, leaving its VM with
+	// nothing to manage it, so the VMs are checked before the state is
+	// locked. If another machine is to be deleted by the time the import is
+	// made, it has not been checked.
+	cfg := driver.Config{Runner: sc.Runner, Events: ctx.GetEventBus()}
+	var deleted []core.Machine
+	err = d.View(func(tx dal.ReadTx) error {
+		if _, err := plan(tx); err != nil {
+			return err
+		}
+		deleted, err = getMachines(tx, report.Deleted)
+		return err
+	})
+	if err == nil && !force {
+		err = checkDeletedVMs(cfg, deleted)
+	}
+	if dryRun || err != nil {
+		report.DryRun = dryRun
+		return report, err
+	}
+
+	// The import is planned and made in one transaction, so that it is made
+	// completely or not at all, and nothing changes in between.
+	var changes []importChange
+	err = saveMachineUpdates(d, cfg, plan, func(tx dal.WriteTx, updates []machineUpdate) (err error) {
+		if id, ok := uncheckedDeletion(report.Deleted, deleted); ok && !force {
+			return errors.ErrMachineChanged(id)
+		}
+		changes, err = applyImport(tx, report, imported, updates)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	bus := ctx.GetEventBus()
+	for _, c := range changes {
+		bus.Publish(c.eventType, c.machine)
+	}
+	return report, nil
+}
+
+// importChange is a change made by an import, to be published once the import
+// has been saved.
+type importChange struct {
+	eventType string
+	machine   core.Machine
+}
+
+// importedMachines indexes imported machines by ID. Revisions belong to the
+// hark the machines were exported from, so they are dropped.
+func importedMachines(imported []core.Machine) map[string]core.Machine {
+	byID := make(map[string]core.Machine, len(imported))
+	for _, m := range imported {
+		m.Revision = 0
+		byID[m.ID] = m
+	}
+	return byID
+}
+
+// planImportUpdates works out the changes to the existing machines an import
+// replaces, checking that each can be made. A problem with a machine is
+// reported at its place in the bundle's state.
+func planImportUpdates(tx dal.ReadTx, report core.ImportReport, imported []core.Machine) ([]machineUpdate, error) {
+	byID := importedMachines(imported)
+	index := make(map[string]int, len(imported))
+	for i, m := range imported {
+		index[m.ID] = i
+	}
+
+	var updates []machineUpdate
+	for _, id := range report.Updated {
+		current, err := tx.GetMachineByID(id)
+		if err != nil {
+			return nil, err
+		}
+		updated := byID[id]
+		if err := checkMachineUpdate(current, &updated); err != nil {
+			return nil, violationsAt(fmt.Sprintf("/machines/%d", index[id]), id, err)
+		}
+		updates = append(updates, machineUpdate{current, updated})
+	}
+	return updates, nil
+}
+
+// violationsAt reports the problems with the fields of a machine, if err has
+// any, as problems with the fields of the machine at pointer.
+func violationsAt(pointer, id string, err error) error {
+	detailer, ok := err.(errors.Detailer)
+	if !ok {
+		return err
+	}
+
+	var v errors.Violations
+	for _, d := range detailer.Details() {
+		v.Add(pointer+d.Field, d.Reason, fmt.Sprintf("machine %q: %s", id, d.Message))
+	}
+	return v.Err()
+}
+
+// getMachines gets the machines with the given IDs.
+func getMachines(tx dal.ReadTx, ids []string) ([]core.Machine, error) {
+	machines := make([]core.Machine, 0, len(ids))
+	for _, id := range ids {
+		m, err := tx.GetMachineByID(id)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// checkDeletedVMs checks that none of the machines an import deletes has a
+// running VM.
+func checkDeletedVMs(cfg driver.Config, deleted []core.Machine) error {
+	for _, m := range deleted {
+		d, err := driver.Lookup(m.Driver, cfg)
+		if err != nil {
+			return err
+		}
+		if !d.Info().Installed {
+			continue
+		}
+		state, err := d.Status(m)
+		if err != nil {
+			return err
+		}
+		if state.Active() {
+			return errors.ErrMachineRunning(m.ID)
+		}
+	}
+	return nil
+}
+
+// uncheckedDeletion returns a machine to be deleted which is not one of those
+// whose VM was checked, if there is one.
+func uncheckedDeletion(ids []string, checked []core.Machine) (string, bool) {
+	known := make(map[string]bool, len(checked))
+	for _, m := range checked {
+		known[m.ID] = true
+	}
+	for _, id := range ids {
+		if !known[id] {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// applyImport makes the changes planned for an import, with the updates to
+// existing machines planned by planImportUpdates.
+func applyImport(tx dal.WriteTx, report core.ImportReport, imported []core.Machine, updates []machineUpdate) ([]importChange, error) {
+	byID := importedMachines(imported)
+
+	var changes []importChange
+	for _, id := range report.Deleted {
+		m, err := tx.GetMachineByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.DeleteMachine(id); err != nil {
+			return nil, err
+		}
+		changes = append(changes, importChange{events.MachineDeleted, m})
+	}
+	for _, u := range updates {
+		m, err := tx.UpdateMachine(u.current.ID, func(core.Machine) (core.Machine, error) {
+			return u.updated, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, importChange{events.MachineUpdated, m})
+	}
+	for _, id := range report.Created {
+		if err := tx.SaveMachine(byID[id]); err != nil {
+			return nil, err
+		}
+		m, err := tx.GetMachineByID(id)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, importChange{events.MachineCreated, m})
+	}
+	return changes, nil
 }
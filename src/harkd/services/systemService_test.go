@@ -0,0 +1,144 @@
+package services
+
+import (
+	"testing"
+
+	"harkd/core"
+	"harkd/dal/daltest"
+	"harkd/driver/drivertest"
+	"harkd/errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fakeMachine(id string, memoryMB uint) core.Machine {
+	return core.Machine{ID: id, Name: id, MemoryMB: memoryMB, Driver: drivertest.Name}
+}
+
+var importReplaceTests = []struct {
+	name         string
+	state        core.MachineState
+	imported     core.Machine
+	dryRun       bool
+	expectCode   int
+	expectField  string
+	expectMemory uint // of the VM
+}{
+	{"powered off", core.StatePoweroff, fakeMachine("foo", 1024), false, 0, "", 1024},
+	{"no vm", core.StateUnknown, fakeMachine("foo", 1024), false, 0, "", 0},
+	{"running", core.StateRunning, fakeMachine("foo", 1024), false, 409002, "", 512},
+	{"driver changed", core.StatePoweroff, core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: "virtualbox"}, false, 400002, "/machines/1/driver", 512},
+	{"driver changed in a dry run", core.StatePoweroff, core.Machine{ID: "foo", Name: "foo", MemoryMB: 1024, Driver: "virtualbox"}, true, 400002, "/machines/1/driver", 512},
+}
+
+func TestImportStateReplace(t *testing.T) {
+	for _, c := range importReplaceTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			_, ctx, backend := newTestMachineService(t, c.state)
+			require.NoError(t, ctx.dal.SaveMachine(fakeMachine("bar", 512)))
+			sc := NewSystemService(ctx, nil)
+			bundle := daltest.StateBundle(t, fakeMachine("baz", 512), c.imported)
+
+			// Execute
+			report, err := sc.ImportState(bundle, core.ImportReplace, false, c.dryRun)
+
+			// Assert
+			foo, getErr := ctx.dal.GetMachineByID("foo")
+			require.NoError(t, getErr)
+			vm, _ := backend.GetVM("foo")
+			if c.expectCode != 0 {
+				requireCode(t, c.expectCode, err)
+				if c.expectField != "" {
+					details := err.(errors.Detailer).Details()
+					require.Len(t, details, 1)
+					require.Equal(t, c.expectField, details[0].Field)
+				}
+				require.Equal(t, uint(512), foo.MemoryMB)
+				require.Equal(t, c.expectMemory, vm.MemoryMB)
+				_, getErr = ctx.dal.GetMachineByID("bar")
+				require.NoError(t, getErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, []string{"foo"}, report.Updated)
+			require.Equal(t, []string{"bar"}, report.Deleted)
+			require.Equal(t, []string{"baz"}, report.Created)
+			require.Equal(t, uint(1024), foo.MemoryMB)
+			require.Equal(t, c.expectMemory, vm.MemoryMB)
+			_, getErr = ctx.dal.GetMachineByID("bar")
+			requireCode(t, 404001, getErr)
+		})
+	}
+}
+
+func TestImportStateReplaceRunningMachine(t *testing.T) {
+	cases := []struct {
+		name          string
+		force         bool
+		dryRun        bool
+		expectCode    int
+		expectDeleted bool
+	}{
+		{"refused", false, false, 409001, false},
+		{"refused in a dry run", false, true, 409001, false},
+		{"forced", true, false, 0, true},
+		{"forced in a dry run", true, true, 0, false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare: replacing the state deletes bar, whose VM is running.
+			_, ctx, backend := newTestMachineService(t, core.StatePoweroff)
+			require.NoError(t, ctx.dal.SaveMachine(fakeMachine("bar", 512)))
+			backend.SetVM("bar", drivertest.VM{State: core.StateRunning, MemoryMB: 512})
+			sc := NewSystemService(ctx, nil)
+			bundle := daltest.StateBundle(t, fakeMachine("foo", 512))
+
+			// Execute
+			report, err := sc.ImportState(bundle, core.ImportReplace, c.force, c.dryRun)
+
+			// Assert
+			if c.expectCode != 0 {
+				requireCode(t, c.expectCode, err)
+				require.Contains(t, err.Error(), `"bar"`)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, []string{"bar"}, report.Deleted)
+			}
+			_, getErr := ctx.dal.GetMachineByID("bar")
+			if c.expectDeleted {
+				requireCode(t, 404001, getErr)
+			} else {
+				require.NoError(t, getErr)
+			}
+
+			// The VM is left as it was either way.
+			vm, ok := backend.GetVM("bar")
+			require.True(t, ok)
+			require.Equal(t, core.StateRunning, vm.State)
+		})
+	}
+}
+
+func TestImportStateMerge(t *testing.T) {
+	// Prepare
+	_, ctx, backend := newTestMachineService(t, core.StatePoweroff)
+	sc := NewSystemService(ctx, nil)
+	bundle := daltest.StateBundle(t, fakeMachine("foo", 1024), fakeMachine("bar", 512))
+
+	// Execute
+	report, err := sc.ImportState(bundle, core.ImportMerge, false, false)
+
+	// Assert: merging never changes an existing machine.
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar"}, report.Created)
+	require.Len(t, report.Conflicts, 1)
+	foo, err := ctx.dal.GetMachineByID("foo")
+	require.NoError(t, err)
+	require.Equal(t, uint(512), foo.MemoryMB)
+	require.NotContains(t, backend.GetCalls(), "Modify foo")
+}
@@ -3,6 +3,8 @@ package fixtures
 import (
 	"io"
 	"os"
+
+	"harkd/util/fs"
 )
 
 // NewFsFixture creates a new, empty FsFixture.
@@ -17,6 +19,13 @@ type FsFixture struct {
 		WillReturn    io.ReadCloser
 		WillReturnErr error
 	}
+	MockOpenFile struct {
+		CalledWithPath string
+		CalledWithFlag int
+		CalledWithPerm os.FileMode
+		WillReturn     fs.File
+		WillReturnErr  error
+	}
 	MockStat struct {
 		CalledWith    string
 		WillReturn    os.FileInfo
@@ -28,6 +37,24 @@ type FsFixture struct {
 		CalledWithPerm os.FileMode
 		WillReturnErr  error
 	}
+	MockRename struct {
+		CalledWithOldPath string
+		CalledWithNewPath string
+		WillReturnErr     error
+	}
+	MockLink struct {
+		CalledWithOldPath string
+		CalledWithNewPath string
+		WillReturnErr     error
+	}
+	MockRemove struct {
+		CalledWith    string
+		WillReturnErr error
+	}
+	MockSyncDir struct {
+		CalledWith    string
+		WillReturnErr error
+	}
 }
 
 func (fs *FsFixture) Open(path string) (io.ReadCloser, error) {
@@ -35,6 +62,13 @@ func (fs *FsFixture) Open(path string) (io.ReadCloser, error) {
 	return fs.MockOpen.WillReturn, fs.MockOpen.WillReturnErr
 }
 
+func (fs *FsFixture) OpenFile(path string, flag int, perm os.FileMode) (fs.File, error) {
+	fs.MockOpenFile.CalledWithPath = path
+	fs.MockOpenFile.CalledWithFlag = flag
+	fs.MockOpenFile.CalledWithPerm = perm
+	return fs.MockOpenFile.WillReturn, fs.MockOpenFile.WillReturnErr
+}
+
 func (fs *FsFixture) Stat(path string) (os.FileInfo, error) {
 	fs.MockStat.CalledWith = path
 	return fs.MockStat.WillReturn, fs.MockStat.WillReturnErr
@@ -47,3 +81,25 @@ func (fs *FsFixture) WriteFile(path string, d []byte, perm os.FileMode) error {
 
 	return fs.MockWriteFile.WillReturnErr
 }
+
+func (fs *FsFixture) Rename(oldPath, newPath string) error {
+	fs.MockRename.CalledWithOldPath = oldPath
+	fs.MockRename.CalledWithNewPath = newPath
+	return fs.MockRename.WillReturnErr
+}
+
+func (fs *FsFixture) Link(oldPath, newPath string) error {
+	fs.MockLink.CalledWithOldPath = oldPath
+	fs.MockLink.CalledWithNewPath = newPath
+	return fs.MockLink.WillReturnErr
+}
+
+func (fs *FsFixture) Remove(path string) error {
+	fs.MockRemove.CalledWith = path
+	return fs.MockRemove.WillReturnErr
+}
+
+func (fs *FsFixture) SyncDir(path string) error {
+	fs.MockSyncDir.CalledWith = path
+	return fs.MockSyncDir.WillReturnErr
+}
@@ -0,0 +1,76 @@
+package fixtures
+
+import (
+	"fmt"
+	"reflect"
+
+	"harkd/util/command"
+)
+
+// NewRunnerFixture creates a new RunnerFixture which expects to run the
+// provided commands, in order.
+func NewRunnerFixture(script ...ScriptedCommand) *RunnerFixture {
+	return &RunnerFixture{Script: script}
+}
+
+// ScriptedCommand is a command a RunnerFixture expects to run, and the result
+// it should return when it does.
+type ScriptedCommand struct {
+	Args   []string
+	Result command.SimpleResult
+}
+
+// Expect creates a ScriptedCommand for the given command line which succeeds
+// with no output.
+func Expect(args ...string) ScriptedCommand {
+	return ScriptedCommand{Args: args, Result: command.SimpleResult{ExitStatus: 0}}
+}
+
+// WithOutput sets the output the command will produce.
+func (sc ScriptedCommand) WithOutput(output string) ScriptedCommand {
+	sc.Result.Output = []byte(output)
+	return sc
+}
+
+// WithError makes the command fail with the given error.
+func (sc ScriptedCommand) WithError(err error) ScriptedCommand {
+	sc.Result.Error = err
+	sc.Result.ExitStatus = 1
+	return sc
+}
+
+// RunnerFixture implements command.Runner by replaying a script of expected
+// commands. Every command run is recorded in Calls, so that tests can assert
+// the exact argument lists; a command which does not match the next one in the
+// script fails.
+type RunnerFixture struct {
+	Script []ScriptedCommand
+	Calls  [][]string
+
+	MockHaveOnPath struct {
+		CalledWith string
+		WillReturn bool
+	}
+}
+
+func (rf *RunnerFixture) HaveOnPath(name string) bool {
+	rf.MockHaveOnPath.CalledWith = name
+	return rf.MockHaveOnPath.WillReturn
+}
+
+func (rf *RunnerFixture) RunSimple(name string, args ...string) command.SimpleResult {
+	call := append([]string{name}, args...)
+	rf.Calls = append(rf.Calls, call)
+
+	if len(rf.Script) == 0 {
+		return command.SimpleResult{Error: fmt.Errorf("unexpected command: %q", call), ExitStatus: -1}
+	}
+
+	next := rf.Script[0]
+	rf.Script = rf.Script[1:]
+
+	if !reflect.DeepEqual(next.Args, call) {
+		return command.SimpleResult{Error: fmt.Errorf("expected command %q, got %q", next.Args, call), ExitStatus: -1}
+	}
+	return next.Result
+}
@@ -0,0 +1,167 @@
+// Package bundle reads and writes self-describing archives: gzipped tarballs
+// holding a set of files and a manifest which lists them with their
+// checksums.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// ManifestName is the name of the manifest within a bundle. It is always the
+// first file in the archive.
+const ManifestName = "manifest.json"
+
+// maxContentSize is the most uncompressed content read from a bundle.
+const maxContentSize = 64 << 20
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	// Format names what the bundle holds, so that a bundle of one kind is not
+	// mistaken for another.
+	Format        string    `json:"format"`
+	SchemaVersion int       `json:"schemaVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Files         []File    `json:"files"`
+}
+
+// File is a file in a bundle.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Write writes a bundle of files to w. The files are listed in the manifest,
+// replacing any files it already lists.
+func Write(w io.Writer, m Manifest, files map[string][]byte) error {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m.Files = nil
+	for _, name := range names {
+		m.Files = append(m.Files, File{name, int64(len(files[name])), checksum(files[name])})
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeFile(tw, ManifestName, manifest, m.CreatedAt); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := writeFile(tw, name, files[name], m.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeFile(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// Read reads a bundle from r, checking that it holds exactly the files its
+// manifest lists, with the right checksums.
+func Read(r io.Reader) (Manifest, map[string][]byte, error) {
+	var m Manifest
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return m, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return m, nil, fmt.Errorf("%s is not a regular file", hdr.Name)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			return m, nil, fmt.Errorf("%s appears more than once", hdr.Name)
+		}
+		if size += hdr.Size; size > maxContentSize {
+			return m, nil, fmt.Errorf("bundle is larger than %d bytes", maxContentSize)
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return m, nil, err
+		}
+		files[hdr.Name] = b
+	}
+
+	manifest, ok := files[ManifestName]
+	if !ok {
+		return m, nil, fmt.Errorf("no %s", ManifestName)
+	}
+	delete(files, ManifestName)
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return m, nil, fmt.Errorf("%s: %s", ManifestName, err)
+	}
+
+	if err := verify(m, files); err != nil {
+		return m, nil, err
+	}
+	return m, files, nil
+}
+
+// verify checks that files are exactly the ones the manifest lists.
+func verify(m Manifest, files map[string][]byte) error {
+	listed := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		b, ok := files[f.Name]
+		if !ok {
+			return fmt.Errorf("%s is missing", f.Name)
+		}
+		if int64(len(b)) != f.Size || checksum(b) != f.SHA256 {
+			return fmt.Errorf("%s does not match its checksum", f.Name)
+		}
+		listed[f.Name] = true
+	}
+	for name := range files {
+		if !listed[name] {
+			return fmt.Errorf("%s is not listed in %s", name, ManifestName)
+		}
+	}
+	return nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,78 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testManifest = Manifest{
+	Format:        "test",
+	SchemaVersion: 3,
+	CreatedAt:     time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+}
+
+// tarball builds a bundle by hand, so that it can be broken.
+func tarball(t *testing.T, files ...[2]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		require.NoError(t, writeFile(tw, f[0], []byte(f[1]), time.Now()))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Prepare
+	var buf bytes.Buffer
+	files := map[string][]byte{"b.json": []byte(`{"b":2}`), "a.json": []byte(`{"a":1}`)}
+
+	// Execute
+	require.NoError(t, Write(&buf, testManifest, files))
+	m, read, err := Read(&buf)
+
+	// Assert
+	require.NoError(t, err)
+	require.Equal(t, files, read)
+	require.Equal(t, "test", m.Format)
+	require.Equal(t, 3, m.SchemaVersion)
+	require.True(t, testManifest.CreatedAt.Equal(m.CreatedAt))
+	require.Equal(t, []File{
+		{"a.json", 7, "015abd7f5cc57a2dd94b7590f04ad8084273905ee33ec5cebeae62276a97f862"},
+		{"b.json", 7, "0ab1a6d394cd30195f0642b67ae1180c375ffadf5dd7f39c390668b5fdb6da93"},
+	}, m.Files)
+}
+
+var readTests = []struct {
+	name  string
+	files [][2]string
+}{
+	{"no manifest", [][2]string{{"a.json", "{}"}}},
+	{"invalid manifest", [][2]string{{ManifestName, "abcd"}}},
+	{"missing file", [][2]string{{ManifestName, `{"files":[{"name":"a.json","size":2,"sha256":"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"}]}`}}},
+	{"bad checksum", [][2]string{{ManifestName, `{"files":[{"name":"a.json","size":2,"sha256":"00"}]}`}, {"a.json", "{}"}}},
+	{"unlisted file", [][2]string{{ManifestName, `{"files":[]}`}, {"a.json", "{}"}}},
+	{"duplicate file", [][2]string{{ManifestName, `{"files":[]}`}, {ManifestName, `{"files":[]}`}}},
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, c := range readTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := Read(bytes.NewReader(tarball(t, c.files...)))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestReadNotGzip(t *testing.T) {
+	_, _, err := Read(bytes.NewReader([]byte("abcd")))
+	require.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	"os/exec"
 )
 
@@ -32,9 +33,15 @@ func (r runner) HaveOnPath(name string) bool {
 }
 
 func (r runner) RunSimple(name string, args ...string) SimpleResult {
-	res := SimpleResult{nil, -1, nil}
+	return r.run(exec.Command(name, args...))
+}
+
+func (r runner) RunContext(ctx context.Context, name string, args ...string) SimpleResult {
+	return r.run(exec.CommandContext(ctx, name, args...))
+}
 
-	cmd := exec.Command(name, args...)
+func (r runner) run(cmd *exec.Cmd) SimpleResult {
+	res := SimpleResult{nil, -1, nil}
 
 	output, err := cmd.CombinedOutput()
 	res.Output = output
@@ -49,3 +56,32 @@ func (r runner) RunSimple(name string, args ...string) SimpleResult {
 
 	return res
 }
+
+// ContextRunner is a Runner which can also run a command until a context is
+// done, killing the command if it is still running then.
+type ContextRunner interface {
+	Runner
+	RunContext(ctx context.Context, name string, args ...string) SimpleResult
+}
+
+// WithContext returns a Runner which runs commands with r until ctx is done.
+// Once ctx is done no more commands are started, and if r is a ContextRunner,
+// a command which is still running is killed.
+func WithContext(ctx context.Context, r Runner) Runner {
+	return contextRunner{r, ctx}
+}
+
+type contextRunner struct {
+	Runner
+	ctx context.Context
+}
+
+func (cr contextRunner) RunSimple(name string, args ...string) SimpleResult {
+	if err := cr.ctx.Err(); err != nil {
+		return SimpleResult{err, -1, nil}
+	}
+	if r, ok := cr.Runner.(ContextRunner); ok {
+		return r.RunContext(cr.ctx, name, args...)
+	}
+	return cr.Runner.RunSimple(name, args...)
+}
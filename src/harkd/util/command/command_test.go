@@ -0,0 +1,58 @@
+package command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingRunner counts the commands it is asked to run.
+type countingRunner struct {
+	runs int
+}
+
+func (cr *countingRunner) HaveOnPath(name string) bool {
+	return true
+}
+
+func (cr *countingRunner) RunSimple(name string, args ...string) SimpleResult {
+	cr.runs++
+	return SimpleResult{}
+}
+
+func TestWithContextStopsRunning(t *testing.T) {
+	// Prepare
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &countingRunner{}
+	cr := WithContext(ctx, r)
+
+	// Execute
+	before := cr.RunSimple("true")
+	cancel()
+	after := cr.RunSimple("true")
+
+	// Assert
+	require.NoError(t, before.Error)
+	require.Equal(t, context.Canceled, after.Error)
+	require.Equal(t, 1, r.runs)
+}
+
+func TestWithContextKillsCommand(t *testing.T) {
+	if !NewRunner().HaveOnPath("sleep") {
+		t.Skip("no sleep command")
+	}
+
+	// Prepare
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Execute
+	start := time.Now()
+	res := WithContext(ctx, NewRunner()).RunSimple("sleep", "10")
+
+	// Assert
+	require.Error(t, res.Error)
+	require.True(t, time.Since(start) < 5*time.Second)
+}
@@ -2,8 +2,8 @@ package fs
 
 import (
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 // Filesystem is an interface that wraps some standard file i/o operations.
@@ -12,9 +12,28 @@ import (
 // this makes them more testable.
 type Filesystem interface {
 	Open(string) (io.ReadCloser, error)
+	// OpenFile opens a file with the given flags, as os.OpenFile does.
+	OpenFile(path string, flag int, perm os.FileMode) (File, error)
 	Stat(string) (os.FileInfo, error)
 
+	// WriteFile writes a file and flushes it to disk before returning.
 	WriteFile(string, []byte, os.FileMode) error
+	Rename(oldPath, newPath string) error
+	Link(oldPath, newPath string) error
+	Remove(string) error
+
+	// SyncDir flushes a directory to disk, so that renames and new files in
+	// it survive a crash.
+	SyncDir(string) error
+}
+
+// File is a file opened by Filesystem.OpenFile.
+type File interface {
+	io.ReadWriteCloser
+	io.Seeker
+	Truncate(size int64) error
+	// Sync flushes the file to disk.
+	Sync() error
 }
 
 // NewFilesystem constructs a new Filesystem backed by the real system filesystem.
@@ -29,10 +48,70 @@ func (fs fileSystem) Open(path string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
+func (fs fileSystem) OpenFile(path string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
 func (fs fileSystem) Stat(path string) (os.FileInfo, error) {
 	return os.Stat(path)
 }
 
 func (fs fileSystem) WriteFile(path string, d []byte, perm os.FileMode) error {
-	return ioutil.WriteFile(path, d, perm)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(d)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (fs fileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (fs fileSystem) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (fs fileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (fs fileSystem) SyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+const tempFileSuffix = ".tmp"
+
+// WriteFileAtomic replaces a file so that, even if the process or machine
+// crashes part way through, the file is left with either its old contents or
+// its new ones.
+//
+// The new contents are written to a temporary file alongside it and flushed
+// to disk, then renamed over the file.
+func WriteFileAtomic(fsys Filesystem, path string, d []byte, perm os.FileMode) error {
+	tempPath := path + tempFileSuffix
+	if err := fsys.WriteFile(tempPath, d, perm); err != nil {
+		fsys.Remove(tempPath)
+		return err
+	}
+
+	if err := fsys.Rename(tempPath, path); err != nil {
+		fsys.Remove(tempPath)
+		return err
+	}
+
+	return fsys.SyncDir(filepath.Dir(path))
 }
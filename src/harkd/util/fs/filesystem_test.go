@@ -0,0 +1,48 @@
+package fs_test
+
+import (
+	"errors"
+	"testing"
+
+	"harkd/test/fixtures"
+	"harkd/util/fs"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errFailed = errors.New("failed")
+
+func TestWriteFileAtomic(t *testing.T) {
+	fsys := fixtures.NewFsFixture()
+
+	err := fs.WriteFileAtomic(fsys, "/tmp/hark/state.json", []byte("{}"), 0644)
+
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/hark/state.json.tmp", fsys.MockWriteFile.CalledWithPath)
+	require.Equal(t, "/tmp/hark/state.json.tmp", fsys.MockRename.CalledWithOldPath)
+	require.Equal(t, "/tmp/hark/state.json", fsys.MockRename.CalledWithNewPath)
+	require.Equal(t, "/tmp/hark", fsys.MockSyncDir.CalledWith)
+	require.Empty(t, fsys.MockRemove.CalledWith)
+}
+
+func TestWriteFileAtomicFailedWrite(t *testing.T) {
+	fsys := fixtures.NewFsFixture()
+	fsys.MockWriteFile.WillReturnErr = errFailed
+
+	err := fs.WriteFileAtomic(fsys, "/tmp/hark/state.json", []byte("{}"), 0644)
+
+	require.Error(t, err)
+	require.Empty(t, fsys.MockRename.CalledWithOldPath)
+	require.Equal(t, "/tmp/hark/state.json.tmp", fsys.MockRemove.CalledWith)
+}
+
+func TestWriteFileAtomicFailedRename(t *testing.T) {
+	fsys := fixtures.NewFsFixture()
+	fsys.MockRename.WillReturnErr = errFailed
+
+	err := fs.WriteFileAtomic(fsys, "/tmp/hark/state.json", []byte("{}"), 0644)
+
+	require.Error(t, err)
+	require.Equal(t, "/tmp/hark/state.json.tmp", fsys.MockRemove.CalledWith)
+	require.Empty(t, fsys.MockSyncDir.CalledWith)
+}
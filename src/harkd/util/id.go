@@ -0,0 +1,105 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const randomIDBytes = 16
+
+// NewRandomID generates a random identifier, hex-encoded.
+func NewRandomID() (string, error) {
+	b := make([]byte, randomIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ulidEncoding is Crockford's base32 alphabet. Its characters are in ASCII
+// order, so encoded ULIDs sort the same way as the values they encode.
+const ulidEncoding = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const ulidLength = 26
+
+var errULIDOverflow = errors.New("too many ULIDs generated in one millisecond")
+
+var ulids = &ulidGenerator{random: rand.Reader}
+
+// NewULID generates a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, encoded as 26 characters of Crockford's base32.
+//
+// ULIDs sort in the order they were generated. IDs generated within the same
+// millisecond increment the random part of the previous one rather than
+// drawing new random bits, so that they sort correctly too.
+func NewULID() (string, error) {
+	return ulids.next(time.Now())
+}
+
+type ulidGenerator struct {
+	random io.Reader
+
+	mutex      sync.Mutex
+	lastMS     uint64
+	lastRandom [10]byte
+}
+
+func (g *ulidGenerator) next(now time.Time) (string, error) {
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// If the clock has not moved on (or has gone backwards), stay in the last
+	// millisecond so that the new ID still sorts after the last one.
+	if ms <= g.lastMS {
+		ms = g.lastMS
+		if !incrementBytes(g.lastRandom[:]) {
+			return "", errULIDOverflow
+		}
+	} else {
+		if _, err := io.ReadFull(g.random, g.lastRandom[:]); err != nil {
+			return "", err
+		}
+		g.lastMS = ms
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	copy(id[6:], g.lastRandom[:])
+	return encodeULID(id), nil
+}
+
+// incrementBytes adds one to a big-endian number, reporting false if it
+// overflows.
+func incrementBytes(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits as 26 base32 characters, five bits at a time
+// from the end. The 26 characters hold 130 bits, so the first character only
+// ever encodes three.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	out := make([]byte, ulidLength)
+	for i := ulidLength - 1; i >= 0; i-- {
+		out[i] = ulidEncoding[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func msTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+var encodeULIDTests = []struct {
+	name   string
+	id     [16]byte
+	expect string
+}{
+	{"zero", [16]byte{}, "00000000000000000000000000"},
+	{"max", [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+	{"one", [16]byte{15: 1}, "00000000000000000000000001"},
+}
+
+func TestEncodeULID(t *testing.T) {
+	for _, c := range encodeULIDTests {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expect, encodeULID(c.id))
+		})
+	}
+}
+
+func TestULIDTimestamp(t *testing.T) {
+	g := &ulidGenerator{random: bytes.NewReader(make([]byte, 10))}
+
+	id, err := g.next(msTime(1469918176385))
+
+	require.NoError(t, err)
+	require.Equal(t, "01ARYZ6S410000000000000000", id)
+}
+
+func TestULIDSameMillisecondIsMonotonic(t *testing.T) {
+	g := &ulidGenerator{random: bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff})}
+
+	first, err := g.next(msTime(1000))
+	require.NoError(t, err)
+	second, err := g.next(msTime(1000))
+	require.NoError(t, err)
+	// The clock going backwards must not break the ordering either.
+	third, err := g.next(msTime(999))
+	require.NoError(t, err)
+
+	require.Equal(t, "00000000Z8000000000000007Z", first)
+	require.Equal(t, "00000000Z80000000000000080", second)
+	require.Equal(t, "00000000Z80000000000000081", third)
+}
+
+func TestULIDOverflow(t *testing.T) {
+	g := &ulidGenerator{random: bytes.NewReader(bytes.Repeat([]byte{0xff}, 10))}
+
+	_, err := g.next(msTime(1000))
+	require.NoError(t, err)
+	_, err = g.next(msTime(1000))
+	require.Error(t, err)
+}
+
+func TestNewULIDSorts(t *testing.T) {
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id, err := NewULID()
+		require.NoError(t, err)
+		require.Len(t, id, ulidLength)
+		require.True(t, id > last, "%s should sort after %s", id, last)
+		last = id
+	}
+}
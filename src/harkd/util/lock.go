@@ -1,72 +1,423 @@
 package util
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/nightlyone/lockfile"
-
 	"harkd/errors"
 )
 
-const lockMaxRetries = 5
-const lockDelayInterval = time.Millisecond * time.Duration(50)
+// DefaultLockTimeout is how long a Lock waits to be taken if no timeout is
+// given.
+const DefaultLockTimeout = 5 * time.Second
+
+// lockMaxDelay is the longest wait between attempts to take a lock which is
+// held. The wait starts at a millisecond and doubles up to this.
+const lockMaxDelay = 50 * time.Millisecond
 
-// Lock implements a lock that has both a mutex (for exclusive access within a
-// single process) and a file lock (for exclusive access between processes).
+const lockFileMode = 0644
+
+// Lock is a readers-writer lock on a lock file. It is shared between
+// processes as well as goroutines: every Lock and RLock opens the lock file
+// and locks it with an advisory file lock, which the OS releases if the
+// process dies. Within a process, the file lock is only tried once a
+// sync.RWMutex has been taken, so that a goroutine waiting to write is not
+// starved by a stream of readers.
+//
+// A process holding the lock exclusively records itself in the lock file, so
+// that others can report who holds it.
+//
+// This is not compatible with the PID file lock of earlier versions, which
+// created the lock file to take the lock and removed it to release it, and
+// which removes a lock file it cannot read a PID from. A process of an
+// earlier version must not share a lock file with a newer one.
 type Lock interface {
+	// Lock takes the lock exclusively, waiting for the lock's timeout at
+	// most.
 	Lock() error
 	Unlock() error
+
+	// RLock takes the lock shared with other readers, waiting for the lock's
+	// timeout at most.
+	RLock() error
+	RUnlock() error
+
+	// Stats reports who holds the lock, and how long taking it has taken.
+	Stats() LockStats
 }
 
-// NewLock creates a new Lock whose file-level lock will use the provided lock
-// file path.
-func NewLock(lockFilePath string) (Lock, error) {
-	return newLock(lockFilePath)
+// LockStats describes a lock and how it has been used by this process.
+type LockStats struct {
+	File    string        `json:"file"`
+	Timeout time.Duration `json:"timeoutNs"`
+
+	// Holder is the process recorded in the lock file as holding the lock
+	// exclusively, if any.
+	Holder *LockHolder `json:"holder"`
+
+	// Exclusive is whether this process holds the lock exclusively, and
+	// Shared the number of shared locks it holds.
+	Exclusive bool `json:"exclusive"`
+	Shared    int  `json:"shared"`
+
+	// Waiting is the number of goroutines in this process waiting for the
+	// lock.
+	Waiting int `json:"waiting"`
+
+	Writes LockWaitStats `json:"writes"`
+	Reads  LockWaitStats `json:"reads"`
+
+	// StaleCleared is the number of times the lock was taken from a holder
+	// which had died without releasing it.
+	StaleCleared int `json:"staleCleared"`
 }
 
-type lock struct {
-	fileLock lockfile.Lockfile
-	mutex    *sync.Mutex
+// LockHolder is a process recorded in a lock file as holding the lock.
+type LockHolder struct {
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+
+	// Stale is set if the process is no longer running: it died without
+	// clearing the lock file.
+	Stale bool `json:"stale"`
 }
 
-func newLock(lockFilePath string) (*lock, error) {
-	lockfile, err := lockfile.New(lockFilePath)
-	if err != nil {
-		// TODO(cera) - Wrap this
-		return nil, err
+// LockWaitStats counts the attempts to take a lock in one mode.
+type LockWaitStats struct {
+	Acquired  uint64        `json:"acquired"`
+	TimedOut  uint64        `json:"timedOut"`
+	TotalWait time.Duration `json:"totalWaitNs"`
+	MaxWait   time.Duration `json:"maxWaitNs"`
+}
+
+func (s *LockWaitStats) record(waited time.Duration, acquired bool) {
+	if acquired {
+		s.Acquired++
+	} else {
+		s.TimedOut++
 	}
+	s.TotalWait += waited
+	if waited > s.MaxWait {
+		s.MaxWait = waited
+	}
+}
+
+// NewLock creates a new Lock which locks the given lock file, giving up on
+// taking it after timeout. A zero timeout means DefaultLockTimeout.
+func NewLock(lockFilePath string, timeout time.Duration) (Lock, error) {
+	return newLock(lockFilePath, timeout)
+}
+
+type lock struct {
+	filename string
+	timeout  time.Duration
+
+	// local is held alongside the file lock, in the same mode.
+	local sync.RWMutex
 
-	return &lock{lockfile, new(sync.Mutex)}, nil
+	// mutex guards the rest.
+	mutex        sync.Mutex
+	exclusive    *os.File
+	shared       []*os.File
+	waiting      int
+	writes       LockWaitStats
+	reads        LockWaitStats
+	staleCleared int
 }
 
-// Lock attempts to take the lock.
-// It first takes the file lock, then the mutex.
+func newLock(lockFilePath string, timeout time.Duration) (*lock, error) {
+	if lockFilePath == "" {
+		return nil, errors.ErrStateLock(fmt.Errorf("no lock file given"))
+	}
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	return &lock{filename: lockFilePath, timeout: timeout}, nil
+}
+
+// Lock takes the lock exclusively and records this process as its holder. A
+// holder left in the lock file by a process which died holding the lock is
+// counted as stale and replaced.
 func (l *lock) Lock() error {
-	// Take the file lock, then the mutex
-	for i := 0; ; i++ {
-		err := l.fileLock.TryLock()
-		if err == nil {
-			// We now have the file lock
-			break
-		} else if i >= lockMaxRetries {
-			return errors.ErrStateLock(err)
-		}
+	f, err := l.acquire(false)
+	if err != nil {
+		return err
+	}
 
-		time.Sleep(lockDelayInterval)
+	stale := readLockHolder(f) != nil
+	if err := writeLockHolder(f, LockHolder{PID: os.Getpid(), Since: time.Now().UTC()}); err != nil {
+		f.Close()
+		return errors.ErrStateLock(err)
 	}
 
 	l.mutex.Lock()
-
+	defer l.mutex.Unlock()
+	l.exclusive = f
+	if stale {
+		l.staleCleared++
+	}
 	return nil
 }
 
+// Unlock clears the holder from the lock file and releases the lock.
 func (l *lock) Unlock() error {
-	// Release the file lock, then the mutex
-	err := l.fileLock.Unlock()
+	l.mutex.Lock()
+	f := l.exclusive
+	l.exclusive = nil
+	l.mutex.Unlock()
+
+	if f == nil {
+		return errors.ErrStateLock(fmt.Errorf("%s is not locked", l.filename))
+	}
+	defer l.local.Unlock()
+
+	err := f.Truncate(0)
+	if cerr := release(f); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *lock) RLock() error {
+	f, err := l.acquire(true)
 	if err != nil {
 		return err
 	}
-	l.mutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.shared = append(l.shared, f)
 	return nil
 }
+
+// RUnlock releases one of the shared locks held by this process. They are
+// all alike, so it does not matter which.
+func (l *lock) RUnlock() error {
+	l.mutex.Lock()
+	n := len(l.shared)
+	if n == 0 {
+		l.mutex.Unlock()
+		return errors.ErrStateLock(fmt.Errorf("%s is not read locked", l.filename))
+	}
+	f := l.shared[n-1]
+	l.shared = l.shared[:n-1]
+	l.mutex.Unlock()
+
+	defer l.local.RUnlock()
+	return release(f)
+}
+
+func (l *lock) Stats() LockStats {
+	l.mutex.Lock()
+	stats := LockStats{
+		File:         l.filename,
+		Timeout:      l.timeout,
+		Exclusive:    l.exclusive != nil,
+		Shared:       len(l.shared),
+		Waiting:      l.waiting,
+		Writes:       l.writes,
+		Reads:        l.reads,
+		StaleCleared: l.staleCleared,
+	}
+	l.mutex.Unlock()
+
+	if f, err := os.Open(l.filename); err == nil {
+		stats.Holder = readLockHolder(f)
+		f.Close()
+	}
+	return stats
+}
+
+// acquire takes the local lock, then opens the lock file and locks it,
+// retrying with a growing delay until the lock's timeout.
+//
+// The local lock comes first so that a goroutine only holds the file lock
+// while it holds the local lock too. Taken the other way round, a goroutine
+// could hold the file lock while queueing for the local one, and the file
+// lock would not be handed over with the local lock as goroutines take
+// turns.
+func (l *lock) acquire(shared bool) (*os.File, error) {
+	start := time.Now()
+	l.mutex.Lock()
+	l.waiting++
+	l.mutex.Unlock()
+
+	var f *os.File
+	err := l.lockLocal(shared)
+	if err == nil {
+		if f, err = l.tryAcquire(shared, start); err != nil {
+			l.unlockLocal(shared)
+		}
+	}
+	waited := time.Since(start)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.waiting--
+	stats := &l.writes
+	if shared {
+		stats = &l.reads
+	}
+	if err == nil {
+		stats.record(waited, true)
+	} else if _, ok := err.(timeoutError); ok {
+		stats.record(waited, false)
+		return nil, errors.ErrStateLockTimeout(l.timeout, l.describeHolder())
+	}
+	return f, err
+}
+
+// lockLocal takes the local lock, waiting for the lock's timeout at most.
+//
+// A sync.RWMutex cannot give up waiting, so if the timeout passes first, the
+// goroutine waiting for it is left to release it once it has been taken.
+// Until then it keeps its place in the queue, as if the wait had continued.
+// No goroutine is started if the local lock is free.
+func (l *lock) lockLocal(shared bool) error {
+	if shared && l.local.TryRLock() || !shared && l.local.TryLock() {
+		return nil
+	}
+
+	taken := make(chan struct{})
+	go func() {
+		if shared {
+			l.local.RLock()
+		} else {
+			l.local.Lock()
+		}
+		close(taken)
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-taken:
+		return nil
+	case <-timer.C:
+		go func() {
+			<-taken
+			l.unlockLocal(shared)
+		}()
+		return timeoutError{}
+	}
+}
+
+func (l *lock) unlockLocal(shared bool) {
+	if shared {
+		l.local.RUnlock()
+	} else {
+		l.local.Unlock()
+	}
+}
+
+// timeoutError is returned by tryAcquire when the lock could not be taken in
+// time.
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "timed out"
+}
+
+func (l *lock) tryAcquire(shared bool, start time.Time) (*os.File, error) {
+	f, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE, lockFileMode)
+	if err != nil {
+		return nil, errors.ErrStateLock(err)
+	}
+
+	delay := time.Millisecond
+	for {
+		ok, err := tryLockFile(f, shared)
+		if err != nil {
+			f.Close()
+			return nil, errors.ErrStateLock(err)
+		} else if ok {
+			return f, nil
+		}
+
+		remaining := l.timeout - time.Since(start)
+		if remaining <= 0 {
+			f.Close()
+			return nil, timeoutError{}
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > lockMaxDelay {
+			delay = lockMaxDelay
+		}
+	}
+}
+
+// describeHolder describes who holds the lock, for a timeout error.
+func (l *lock) describeHolder() string {
+	f, err := os.Open(l.filename)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+
+	holder := readLockHolder(f)
+	switch {
+	case holder == nil:
+		return "it is held by readers, or by a process which does not record itself"
+	case holder.Stale:
+		return fmt.Sprintf("%s names pid %d, which is no longer running, so the lock is held by readers", l.filename, holder.PID)
+	case holder.PID == os.Getpid():
+		return fmt.Sprintf("it has been held by this process since %s", holder.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("it has been held by pid %d since %s", holder.PID, holder.Since.Format(time.RFC3339))
+}
+
+// release unlocks and closes a lock file.
+func release(f *os.File) error {
+	err := unlockFile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readLockHolder reads the holder recorded in a lock file, or nil if none is.
+// A lock file holding just a PID, as written by earlier versions, is also
+// understood.
+func readLockHolder(f *os.File) *LockHolder {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	content := strings.TrimSpace(string(b))
+	if content == "" {
+		return nil
+	}
+
+	var holder LockHolder
+	if pid, err := strconv.Atoi(content); err == nil {
+		holder.PID = pid
+	} else if err := json.Unmarshal(b, &holder); err != nil || holder.PID <= 0 {
+		return nil
+	}
+	holder.Stale = !processRunning(holder.PID)
+	return &holder
+}
+
+func writeLockHolder(f *os.File, holder LockHolder) error {
+	b, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(append(b, '\n'), 0)
+	return err
+}
@@ -1,25 +1,47 @@
 package util
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
-	//"sync"
+	"os/exec"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"harkd/errors"
 
 	"github.com/stretchr/testify/require"
 )
 
+const testLockTimeout = 20 * time.Millisecond
+
 func tempFile(t *testing.T) string {
 	tf, err := ioutil.TempFile("", "")
 	require.NoError(t, err)
 	return tf.Name()
 }
 
+// deadPID gives the PID of a process which has exited.
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	return cmd.Process.Pid
+}
+
+func requireTimeout(t *testing.T, err error) {
+	require.Error(t, err)
+	coder, ok := err.(errors.Coder)
+	require.True(t, ok)
+	require.Equal(t, 503001, coder.Code())
+}
+
 func TestLockSimple(t *testing.T) {
 	tf := tempFile(t)
 	defer os.Remove(tf)
 
-	l, err := NewLock(tf)
+	l, err := NewLock(tf, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,3 +51,237 @@ func TestLockSimple(t *testing.T) {
 	err = l.Unlock()
 	require.NoError(t, err)
 }
+
+func TestLockIsExclusive(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare
+	holder, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+	other, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+	require.NoError(t, holder.Lock())
+
+	// Execute & Assert
+	requireTimeout(t, other.Lock())
+	requireTimeout(t, other.RLock())
+
+	require.NoError(t, holder.Unlock())
+	require.NoError(t, other.Lock())
+	require.NoError(t, other.Unlock())
+
+	stats := other.Stats()
+	require.Equal(t, uint64(1), stats.Writes.Acquired)
+	require.Equal(t, uint64(1), stats.Writes.TimedOut)
+	require.Equal(t, uint64(1), stats.Reads.TimedOut)
+	require.True(t, stats.Writes.MaxWait >= testLockTimeout)
+}
+
+func TestRLockIsShared(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare
+	l, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+
+	// Execute & Assert
+	require.NoError(t, l.RLock())
+	require.NoError(t, l.RLock())
+	require.Equal(t, 2, l.Stats().Shared)
+	requireTimeout(t, l.Lock())
+
+	require.NoError(t, l.RUnlock())
+	requireTimeout(t, l.Lock())
+	require.NoError(t, l.RUnlock())
+	require.Error(t, l.RUnlock())
+
+	require.NoError(t, l.Lock())
+	require.NoError(t, l.Unlock())
+	require.Error(t, l.Unlock())
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare
+	holder, err := NewLock(tf, time.Second)
+	require.NoError(t, err)
+	waiter, err := NewLock(tf, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, holder.Lock())
+
+	// Execute
+	go func() {
+		time.Sleep(testLockTimeout)
+		holder.Unlock()
+	}()
+	err = waiter.Lock()
+
+	// Assert
+	require.NoError(t, err)
+	require.True(t, waiter.Stats().Writes.TotalWait >= testLockTimeout)
+	require.NoError(t, waiter.Unlock())
+}
+
+func TestLockHandsOverFileLockWithinProcess(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare: goroutines which queue for the lock behind a holder.
+	l, err := NewLock(tf, time.Second)
+	require.NoError(t, err)
+	other, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+	require.NoError(t, l.Lock())
+
+	// Execute
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Lock(); err != nil {
+				errs <- err
+				return
+			}
+			// Another process must not get the lock while this goroutine
+			// holds it.
+			if other.Lock() == nil {
+				other.Unlock()
+				errs <- fmt.Errorf("lock was taken by another process while held")
+			}
+			errs <- l.Unlock()
+		}()
+	}
+	time.Sleep(testLockTimeout)
+	require.NoError(t, l.Unlock())
+	wg.Wait()
+	close(errs)
+
+	// Assert
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestLockIsNotStarvedByReaders(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare: readers which between them always hold the lock.
+	l, err := NewLock(tf, time.Second)
+	require.NoError(t, err)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if l.RLock() == nil {
+					time.Sleep(time.Millisecond)
+					l.RUnlock()
+				}
+			}
+		}()
+	}
+	time.Sleep(testLockTimeout)
+
+	// Execute
+	err = l.Lock()
+	close(stop)
+
+	// Assert
+	require.NoError(t, err)
+	require.NoError(t, l.Unlock())
+	wg.Wait()
+}
+
+func TestLockTimeoutReleasesLocalLock(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare
+	l, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+	require.NoError(t, l.RLock())
+
+	// Execute: a writer gives up waiting for the reader.
+	requireTimeout(t, l.Lock())
+	require.NoError(t, l.RUnlock())
+
+	// Assert: the lock can be taken once the reader has gone.
+	require.NoError(t, l.Lock())
+	require.NoError(t, l.Unlock())
+	require.NoError(t, l.RLock())
+	require.NoError(t, l.RUnlock())
+}
+
+func TestLockRecordsHolder(t *testing.T) {
+	tf := tempFile(t)
+	defer os.Remove(tf)
+
+	// Prepare
+	l, err := NewLock(tf, testLockTimeout)
+	require.NoError(t, err)
+	require.Nil(t, l.Stats().Holder)
+
+	// Execute
+	require.NoError(t, l.Lock())
+	stats := l.Stats()
+	require.NoError(t, l.Unlock())
+
+	// Assert
+	require.True(t, stats.Exclusive)
+	require.NotNil(t, stats.Holder)
+	require.Equal(t, os.Getpid(), stats.Holder.PID)
+	require.False(t, stats.Holder.Stale)
+	require.Nil(t, l.Stats().Holder)
+}
+
+func TestLockReplacesStaleHolder(t *testing.T) {
+	pid := deadPID(t)
+	cases := []struct {
+		name    string
+		content string
+	}{
+		{"holder record", `{"pid":` + strconv.Itoa(pid) + `,"since":"2017-01-02T03:04:05Z"}`},
+		{"bare pid", strconv.Itoa(pid) + "\n"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			tf := tempFile(t)
+			defer os.Remove(tf)
+
+			// Prepare
+			require.NoError(t, ioutil.WriteFile(tf, []byte(c.content), 0644))
+			l, err := NewLock(tf, testLockTimeout)
+			require.NoError(t, err)
+
+			before := l.Stats()
+			require.NotNil(t, before.Holder)
+			require.Equal(t, pid, before.Holder.PID)
+			require.True(t, before.Holder.Stale)
+
+			// Execute
+			require.NoError(t, l.Lock())
+			stats := l.Stats()
+			require.NoError(t, l.Unlock())
+
+			// Assert
+			require.Equal(t, 1, stats.StaleCleared)
+			require.Equal(t, os.Getpid(), stats.Holder.PID)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Package mergepatch implements JSON merge patches as described in RFC 7396.
+package mergepatch
+
+import (
+	"encoding/json"
+)
+
+// Apply applies a merge patch to a JSON document and returns the patched
+// document.
+//
+// Objects in the patch are merged recursively into the document; a null value
+// in the patch removes the corresponding member. Any other patch value
+// replaces the target outright.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = merge(targetObj[k], v)
+		}
+	}
+
+	return targetObj
+}
@@ -0,0 +1,49 @@
+package mergepatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These cases are the examples from Appendix A of RFC 7396.
+var applyTests = []struct {
+	doc    string
+	patch  string
+	expect string
+}{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+}
+
+func TestApply(t *testing.T) {
+	for _, c := range applyTests {
+		c := c
+		t.Run(c.doc+" + "+c.patch, func(t *testing.T) {
+			res, err := Apply([]byte(c.doc), []byte(c.patch))
+			require.NoError(t, err)
+			require.JSONEq(t, c.expect, string(res))
+		})
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	_, err := Apply([]byte(`{"a":`), []byte(`{}`))
+	require.Error(t, err)
+
+	_, err = Apply([]byte(`{}`), []byte(`abcd`))
+	require.Error(t, err)
+}
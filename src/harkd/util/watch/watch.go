@@ -0,0 +1,114 @@
+// Package watch reports changes to a file, using inotify where it is
+// available and polling the file's metadata elsewhere.
+package watch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher reports changes to a file.
+type Watcher interface {
+	// Changes delivers a value whenever the file may have changed. Changes
+	// which happen before the last one has been received are merged into it.
+	Changes() <-chan struct{}
+
+	// Close stops watching the file.
+	Close() error
+}
+
+// File watches a file for changes. The file is watched by name: it may not
+// exist yet, and it may be replaced by renaming another file over it. Where
+// inotify is unavailable, or stops working, the file is polled every
+// pollInterval.
+func File(filename string, pollInterval time.Duration) (Watcher, error) {
+	w, err := newNotifier(filename, pollInterval)
+	if err == nil {
+		return w, nil
+	}
+	return Poll(filename, pollInterval), nil
+}
+
+// changes merges notifications of changes, so that a slow receiver only sees
+// one for all the changes since it last looked.
+type changes chan struct{}
+
+func newChanges() changes {
+	return make(changes, 1)
+}
+
+func (c changes) notify() {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// poller watches a file by checking its metadata at intervals.
+type poller struct {
+	filename string
+	changes  changes
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// Poll watches a file by checking at intervals whether it has been replaced,
+// or its modification time or size has changed.
+func Poll(filename string, interval time.Duration) Watcher {
+	return startPoller(filename, interval, newChanges())
+}
+
+// startPoller polls a file, reporting changes to it on changes.
+func startPoller(filename string, interval time.Duration, changes changes) *poller {
+	p := &poller{
+		filename: filename,
+		changes:  changes,
+		stop:     make(chan struct{}),
+	}
+	// The file is looked at before returning, so that any change made
+	// after that is noticed.
+	last, _ := os.Stat(filename)
+	go p.run(interval, last)
+	return p
+}
+
+func (p *poller) run(interval time.Duration, last os.FileInfo) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, _ := os.Stat(p.filename)
+		if changed(last, info) {
+			p.changes.notify()
+		}
+		last = info
+	}
+}
+
+// changed compares a file's metadata at two points in time. A nil FileInfo
+// means the file did not exist.
+func changed(before, after os.FileInfo) bool {
+	if before == nil || after == nil {
+		return before != after
+	}
+	return !os.SameFile(before, after) ||
+		!before.ModTime().Equal(after.ModTime()) ||
+		before.Size() != after.Size()
+}
+
+func (p *poller) Changes() <-chan struct{} {
+	return p.changes
+}
+
+func (p *poller) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
@@ -0,0 +1,139 @@
+package watch
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// notifyMask selects the inotify events on the file's directory which can
+// change the file: it being written and closed, or created, deleted or
+// renamed.
+const notifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// notifier watches a file with inotify. It watches the file's directory
+// rather than the file itself, so that it sees the file being replaced.
+//
+// If the watch stops working other than by being closed, such as because the
+// directory was removed, the file is polled instead.
+type notifier struct {
+	fd           int
+	wd           int
+	filename     string
+	name         string
+	pollInterval time.Duration
+
+	changes   changes
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// mutex guards the inotify instance, which is closed once the goroutine
+	// reading it stops, and the poller replacing it.
+	mutex    sync.Mutex
+	fdClosed bool
+	closing  bool
+	poller   *poller
+}
+
+func newNotifier(filename string, pollInterval time.Duration) (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, filepath.Dir(filename), notifyMask)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	n := &notifier{
+		fd:           fd,
+		wd:           wd,
+		filename:     filename,
+		name:         filepath.Base(filename),
+		pollInterval: pollInterval,
+		changes:      newChanges(),
+		closed:       make(chan struct{}),
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *notifier) run() {
+	defer close(n.closed)
+	n.read()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	syscall.Close(n.fd)
+	n.fdClosed = true
+	if !n.closing {
+		// The file may have changed since the last event was read, so a
+		// change is reported when polling takes over.
+		n.poller = startPoller(n.filename, n.pollInterval, n.changes)
+		n.changes.notify()
+	}
+}
+
+// read reads events until the watch is removed or the inotify instance
+// fails.
+func (n *notifier) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		size, err := syscall.Read(n.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || size <= 0 {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+
+			// The watch has been removed, by Close or because the directory
+			// was deleted.
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			name := string(bytes.TrimRight(buf[start:offset], "\x00"))
+			if name == n.name || event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				n.changes.notify()
+			}
+		}
+	}
+}
+
+func (n *notifier) Changes() <-chan struct{} {
+	return n.changes
+}
+
+// Close removes the watch, which wakes the goroutine reading events so that
+// it can close the inotify instance. If that goroutine has already stopped,
+// the instance is closed and its descriptor may have been reused, so it is
+// left alone, and the poller which took over is stopped instead.
+func (n *notifier) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		n.mutex.Lock()
+		n.closing = true
+		if !n.fdClosed {
+			_, err = syscall.InotifyRmWatch(n.fd, uint32(n.wd))
+		}
+		n.mutex.Unlock()
+		if err != nil {
+			return
+		}
+
+		<-n.closed
+		if n.poller != nil {
+			n.poller.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package watch
+
+import (
+	"errors"
+	"time"
+)
+
+// newNotifier fails where inotify is unavailable, so that the file is polled.
+func newNotifier(filename string, pollInterval time.Duration) (Watcher, error) {
+	return nil, errors.New("inotify is not available")
+}
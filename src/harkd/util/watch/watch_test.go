@@ -0,0 +1,120 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testTimeout = 2 * time.Second
+
+func tempFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "hark-watch")
+	require.NoError(t, err)
+
+	filename := filepath.Join(dir, "hark-state.json")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{}"), 0644))
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func requireChange(t *testing.T, w Watcher) {
+	select {
+	case <-w.Changes():
+	case <-time.After(testTimeout):
+		t.Fatal("no change was reported")
+	}
+}
+
+func requireNoChange(t *testing.T, w Watcher) {
+	select {
+	case <-w.Changes():
+		t.Fatal("unexpected change was reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// replace replaces a file the way the dal does, by renaming a new file over
+// it.
+func replace(t *testing.T, filename, contents string) {
+	require.NoError(t, ioutil.WriteFile(filename+".tmp", []byte(contents), 0644))
+	require.NoError(t, os.Rename(filename+".tmp", filename))
+}
+
+var watchers = []struct {
+	name  string
+	watch func(filename string) (Watcher, error)
+}{
+	{"default", func(filename string) (Watcher, error) { return File(filename, 10*time.Millisecond) }},
+	{"poll", func(filename string) (Watcher, error) { return Poll(filename, 10*time.Millisecond), nil }},
+}
+
+func TestWatch(t *testing.T) {
+	for _, c := range watchers {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			filename, cleanup := tempFile(t)
+			defer cleanup()
+			w, err := c.watch(filename)
+			require.NoError(t, err)
+			defer w.Close()
+
+			// Execute & Assert
+			require.NoError(t, ioutil.WriteFile(filepath.Join(filepath.Dir(filename), "other.json"), []byte("{}"), 0644))
+			requireNoChange(t, w)
+
+			replace(t, filename, `{"machines":[]}`)
+			requireChange(t, w)
+
+			require.NoError(t, ioutil.WriteFile(filename, []byte(`{"machines":null}`), 0644))
+			requireChange(t, w)
+
+			require.NoError(t, os.Remove(filename))
+			requireChange(t, w)
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, c := range watchers {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			filename, cleanup := tempFile(t)
+			defer cleanup()
+			w, err := c.watch(filename)
+			require.NoError(t, err)
+
+			require.NoError(t, w.Close())
+			require.NoError(t, w.Close())
+		})
+	}
+}
+
+func TestWatchDirectoryReplaced(t *testing.T) {
+	for _, c := range watchers {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			// Prepare
+			filename, cleanup := tempFile(t)
+			defer cleanup()
+			w, err := c.watch(filename)
+			require.NoError(t, err)
+			defer w.Close()
+
+			// Execute: the directory is removed, which ends an inotify
+			// watch on it, and made again.
+			require.NoError(t, os.RemoveAll(filepath.Dir(filename)))
+			requireChange(t, w)
+			require.NoError(t, os.Mkdir(filepath.Dir(filename), 0755))
+			require.NoError(t, ioutil.WriteFile(filename, []byte("{}"), 0644))
+
+			// Assert: the file is still watched.
+			requireChange(t, w)
+			require.NoError(t, w.Close())
+		})
+	}
+}